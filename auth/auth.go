@@ -10,19 +10,70 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"runtime/secret"
+	"time"
 )
 
 // PacketType identifies the message type in the security-hardened UDP protocol.
 type PacketType byte
 
 const (
-	PacketData PacketType = 'D' // Client sends encrypted data (signed + AES-GCM encrypted payload)
-	PacketAck  PacketType = 'A' // Server acknowledges receipt
+	PacketData  PacketType = 'D' // Client sends encrypted data (signed + AES-GCM encrypted payload)
+	PacketAck   PacketType = 'A' // Server confirms the key was installed (encrypted reply payload)
+	PacketNack  PacketType = 'N' // Server failed to install the key (encrypted reply payload)
+	PacketHello PacketType = 'H' // Both sides exchange their election rank (encrypted payload)
+	PacketBye   PacketType = 'B' // Sender shuts down and leaves the peering (encrypted payload)
+	PacketKEM   PacketType = 'K' // Sender starts an ML-KEM exchange with its encapsulation key (encrypted payload)
+	PacketKEMCT PacketType = 'C' // Server answers a KEM packet with the ML-KEM ciphertext (encrypted payload)
 )
 
+// ErrorClass describes why the server failed to install a key, it is carried in NACK packets.
+type ErrorClass byte
+
+const (
+	ErrorNone       ErrorClass = 0 // key installed, only valid in ACK packets
+	ErrorKMS        ErrorClass = 1 // key could not be retrieved from the KMS
+	ErrorPQC        ErrorClass = 2 // PQC key missing although required by MODE
+	ErrorWireGuard  ErrorClass = 3 // PSK could not be configured on the WireGuard peer
+	ErrorInternal   ErrorClass = 4 // any other failure of the PSK pipeline
+	ErrorSuperseded ErrorClass = 5 // a newer key ID arrived before this one was processed
+	ErrorConflict   ErrorClass = 6 // both nodes acted as PRIMARY for the same interval
+	ErrorMismatch   ErrorClass = 7 // the PSK confirmation of the client did not match
+)
+
+// String returns the name of the error class used in logs and metrics.
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorNone:
+		return "none"
+	case ErrorKMS:
+		return "kms"
+	case ErrorPQC:
+		return "pqc"
+	case ErrorWireGuard:
+		return "wireguard"
+	case ErrorSuperseded:
+		return "superseded"
+	case ErrorConflict:
+		return "conflict"
+	case ErrorMismatch:
+		return "mismatch"
+	}
+	return "internal"
+}
+
+// NackError is returned when the peer answered a key ID with a NACK.
+type NackError struct {
+	Class ErrorClass
+}
+
+func (e *NackError) Error() string {
+	return fmt.Sprintf("peer failed to install key: %s", e.Class)
+}
+
 // Packet represents a security-hardened UDP message with HMAC authentication
 // and timestamp for replay protection.
 type Packet struct {
@@ -192,3 +243,209 @@ func UnmarshalPacket(psk, data []byte) (*Packet, error) {
 
 	return p, nil
 }
+
+// ConfirmationSize is the size of a PSK confirmation value.
+const ConfirmationSize = sha256.Size
+
+// confirmationLabel separates PSK confirmation values from any other use of the PSK.
+const confirmationLabel = "arnika psk confirmation:"
+
+// Confirmation computes HMAC-SHA256 keyed with the final PSK over a dedicated label
+// and the key ID. Both nodes exchange it to detect diverging PSKs (e.g. different PQC
+// keys) without revealing the PSK.
+// Uses runtime/secret.Do to ensure sensitive key material is zeroed after use.
+func Confirmation(psk []byte, keyID string) []byte {
+	result := make([]byte, ConfirmationSize)
+	secret.Do(func() {
+		mac := hmac.New(sha256.New, psk)
+		mac.Write([]byte(confirmationLabel))
+		mac.Write([]byte(keyID))
+		copy(result, mac.Sum(nil))
+	})
+	return result
+}
+
+// VerifyConfirmation checks a PSK confirmation value using constant-time comparison.
+func VerifyConfirmation(psk []byte, keyID string, confirmation []byte) bool {
+	return subtle.ConstantTimeCompare(Confirmation(psk, keyID), confirmation) == 1
+}
+
+// KeyPayload is the plaintext of a DATA packet.
+type KeyPayload struct {
+	Sender       uint64 // election nonce of the sender, a node drops DATA packets carrying its own
+	KeyID        string
+	Activation   time.Time // instant both nodes install the PSK derived from the key
+	Confirmation []byte    // Confirmation of the PSK derived by the sender
+	PQCID        string    // generation of the PQC key combined by the sender, empty if none or unknown
+}
+
+// KeyPayloadVersion is the version of the DATA payload format written by Marshal. It
+// changes with every incompatible change of the format, both nodes must run the same one.
+const KeyPayloadVersion = 1
+
+// ErrUnsupportedVersion is returned by UnmarshalKeyPayload for a payload of another
+// version, i.e. sent by a node running an incompatible Arnika version.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// keyPayloadHeader is the size of the fixed fields preceding the PQC ID.
+const keyPayloadHeader = 1 + 8 + 8 + ConfirmationSize + 1
+
+// Marshal encodes the payload. PQC IDs longer than 255 bytes are not supported.
+// Format: [version(1)][sender(8)][activation_unix_nano(8)][confirmation(32)][pqc_id_len(1)][pqc_id(P)][key_id(N)]
+func (k *KeyPayload) Marshal() []byte {
+	pqcID := k.PQCID[:min(len(k.PQCID), 255)]
+	buf := make([]byte, keyPayloadHeader, keyPayloadHeader+len(pqcID)+len(k.KeyID))
+	buf[0] = KeyPayloadVersion
+	binary.BigEndian.PutUint64(buf[1:], k.Sender)
+	binary.BigEndian.PutUint64(buf[9:], uint64(k.Activation.UnixNano()))
+	copy(buf[17:], k.Confirmation)
+	buf[keyPayloadHeader-1] = byte(len(pqcID))
+	buf = append(buf, pqcID...)
+	return append(buf, k.KeyID...)
+}
+
+// UnmarshalKeyPayload decodes the plaintext of a DATA packet, see KeyPayload.Marshal.
+// It returns ErrUnsupportedVersion for a payload of another KeyPayloadVersion.
+func UnmarshalKeyPayload(plain []byte) (*KeyPayload, error) {
+	if len(plain) > 0 && plain[0] != KeyPayloadVersion {
+		return nil, fmt.Errorf("%w %d, expected %d", ErrUnsupportedVersion, plain[0], KeyPayloadVersion)
+	}
+	if len(plain) <= keyPayloadHeader {
+		return nil, fmt.Errorf("authentication failed")
+	}
+	keyID := keyPayloadHeader + int(plain[keyPayloadHeader-1])
+	if len(plain) <= keyID {
+		return nil, fmt.Errorf("authentication failed")
+	}
+	return &KeyPayload{
+		Sender:       binary.BigEndian.Uint64(plain[1:9]),
+		KeyID:        string(plain[keyID:]),
+		Activation:   time.Unix(0, int64(binary.BigEndian.Uint64(plain[9:17]))),
+		Confirmation: append([]byte(nil), plain[17:17+ConfirmationSize]...),
+		PQCID:        string(plain[keyPayloadHeader:keyID]),
+	}, nil
+}
+
+// EncodeHello encodes the plaintext of a HELLO packet carrying the election rank of
+// the sender: its Arnika ID and a random nonce chosen at startup. The rank identifies
+// the sender, a node drops HELLO packets carrying its own.
+// Format: [nonce(8)][arnika_id(N)]
+func EncodeHello(arnikaID string, nonce uint64) []byte {
+	buf := make([]byte, 8, 8+len(arnikaID))
+	binary.BigEndian.PutUint64(buf, nonce)
+	return append(buf, arnikaID...)
+}
+
+// DecodeHello decodes the plaintext of a HELLO packet, see EncodeHello.
+func DecodeHello(plain []byte) (string, uint64, error) {
+	if len(plain) <= 8 {
+		return "", 0, fmt.Errorf("authentication failed")
+	}
+	return string(plain[8:]), binary.BigEndian.Uint64(plain[:8]), nil
+}
+
+// Bye is the payload of a BYE packet. It carries the election rank of the sender, so
+// that only the BYE of the node the receiver knows ends the peering.
+type Bye struct {
+	ArnikaID    string
+	Nonce       uint64
+	Invalidated bool // the sender replaced its PSK with a random one
+}
+
+// EncodeBye encodes the plaintext of a BYE packet announcing that the sender shuts down.
+// Format: [invalidated(1)][nonce(8)][arnika_id(N)]
+func EncodeBye(bye *Bye) []byte {
+	buf := make([]byte, 9, 9+len(bye.ArnikaID))
+	if bye.Invalidated {
+		buf[0] = 1
+	}
+	binary.BigEndian.PutUint64(buf[1:], bye.Nonce)
+	return append(buf, bye.ArnikaID...)
+}
+
+// DecodeBye decodes the plaintext of a BYE packet, see EncodeBye.
+func DecodeBye(plain []byte) (*Bye, error) {
+	if len(plain) <= 9 || plain[0] > 1 {
+		return nil, fmt.Errorf("authentication failed")
+	}
+	return &Bye{
+		ArnikaID:    string(plain[9:]),
+		Nonce:       binary.BigEndian.Uint64(plain[1:9]),
+		Invalidated: plain[0] == 1,
+	}, nil
+}
+
+// KEM is the payload of the KEM and KEMCT packets of an ML-KEM exchange. Data holds the
+// encapsulation key of the initiator in a KEM packet and the ciphertext of the responder
+// in a KEMCT packet. Generation is the epoch interval from which on the established key
+// is used, it binds the answer to the exchange. Sender is the election nonce of the
+// sender, a node drops KEM and KEMCT packets carrying its own.
+type KEM struct {
+	Sender     uint64
+	Generation uint64
+	Data       []byte
+}
+
+// EncodeKEM encodes the plaintext of a KEM or KEMCT packet.
+// Format: [sender(8)][generation(8)][data(N)]
+func EncodeKEM(kem *KEM) []byte {
+	buf := make([]byte, 16, 16+len(kem.Data))
+	binary.BigEndian.PutUint64(buf, kem.Sender)
+	binary.BigEndian.PutUint64(buf[8:], kem.Generation)
+	return append(buf, kem.Data...)
+}
+
+// DecodeKEM decodes the plaintext of a KEM or KEMCT packet, see EncodeKEM.
+func DecodeKEM(plain []byte) (*KEM, error) {
+	if len(plain) <= 16 {
+		return nil, fmt.Errorf("authentication failed")
+	}
+	return &KEM{
+		Sender:     binary.BigEndian.Uint64(plain[:8]),
+		Generation: binary.BigEndian.Uint64(plain[8:16]),
+		Data:       append([]byte(nil), plain[16:]...),
+	}, nil
+}
+
+// NewReply builds the ACK (class ErrorNone) or NACK packet answering keyID. An ACK
+// carries the confirmation of the PSK derived by the server, a NACK none.
+// The payload binds the reply to the key ID and is encrypted like DATA payloads.
+// Payload format (before encryption): [class(1)][confirmation(32)][key_id(N)]
+func NewReply(psk []byte, keyID string, class ErrorClass, confirmation []byte) (*Packet, error) {
+	plain := make([]byte, 1+ConfirmationSize, 1+ConfirmationSize+len(keyID))
+	plain[0] = byte(class)
+	copy(plain[1:], confirmation)
+	plain = append(plain, keyID...)
+	encrypted, err := Encrypt(psk, plain)
+	if err != nil {
+		return nil, err
+	}
+	typ := PacketAck
+	if class != ErrorNone {
+		typ = PacketNack
+	}
+	return &Packet{Type: typ, Timestamp: time.Now().Unix(), Payload: encrypted}, nil
+}
+
+// ParseReply decrypts an ACK or NACK packet and returns the key ID it answers and the
+// PSK confirmation of an ACK. The error is a *NackError for a NACK and nil for an ACK.
+// Returns a uniform error message for malformed replies (side-channel resistant).
+func ParseReply(psk []byte, p *Packet) (string, []byte, error) {
+	if p.Type != PacketAck && p.Type != PacketNack {
+		return "", nil, fmt.Errorf("authentication failed")
+	}
+	plain, err := Decrypt(psk, p.Payload)
+	if err != nil || len(plain) < 1+ConfirmationSize {
+		return "", nil, fmt.Errorf("authentication failed")
+	}
+	class := ErrorClass(plain[0])
+	confirmation := plain[1 : 1+ConfirmationSize]
+	keyID := string(plain[1+ConfirmationSize:])
+	if (p.Type == PacketAck) != (class == ErrorNone) {
+		return "", nil, fmt.Errorf("authentication failed")
+	}
+	if class != ErrorNone {
+		return keyID, nil, &NackError{Class: class}
+	}
+	return keyID, confirmation, nil
+}
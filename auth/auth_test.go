@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -340,3 +341,162 @@ func TestEmptyPSKStillProducesDeterministicKeys(t *testing.T) {
 		t.Fatal("domain separation must hold even for empty PSK")
 	}
 }
+
+func TestReplyRoundTrip(t *testing.T) {
+	psk := []byte("reply-psk")
+	confirmation := Confirmation([]byte("wireguard-psk"), "key-1")
+	for _, class := range []ErrorClass{ErrorNone, ErrorKMS, ErrorPQC, ErrorWireGuard, ErrorInternal, ErrorSuperseded, ErrorConflict, ErrorMismatch} {
+		reply, err := NewReply(psk, "key-1", class, confirmation)
+		if err != nil {
+			t.Fatalf("NewReply(%s) failed: %v", class, err)
+		}
+		parsed, err := UnmarshalPacket(psk, reply.Marshal(psk))
+		if err != nil {
+			t.Fatalf("unmarshal failed: %v", err)
+		}
+		keyID, got, err := ParseReply(psk, parsed)
+		if keyID != "key-1" {
+			t.Fatalf("expected key-1, got %q", keyID)
+		}
+		if class == ErrorNone {
+			if parsed.Type != PacketAck || err != nil {
+				t.Fatalf("expected ACK without error, got %c, %v", parsed.Type, err)
+			}
+			if string(got) != string(confirmation) {
+				t.Fatal("expected ACK to carry the confirmation")
+			}
+			continue
+		}
+		var nack *NackError
+		if parsed.Type != PacketNack || !errors.As(err, &nack) || nack.Class != class {
+			t.Fatalf("expected NACK with class %s, got %c, %v", class, parsed.Type, err)
+		}
+	}
+}
+
+func TestParseReplyRejectsMismatchedType(t *testing.T) {
+	psk := []byte("reply-psk")
+	reply, err := NewReply(psk, "key-1", ErrorKMS, nil)
+	if err != nil {
+		t.Fatalf("NewReply failed: %v", err)
+	}
+	reply.Type = PacketAck
+	if _, _, err := ParseReply(psk, reply); err == nil || err.Error() != "authentication failed" {
+		t.Fatalf("expected authentication failure for ACK carrying an error class, got %v", err)
+	}
+	reply.Type = PacketData
+	if _, _, err := ParseReply(psk, reply); err == nil {
+		t.Fatal("expected DATA packet to be rejected as reply")
+	}
+}
+
+func TestParseReplyRejectsWrongPSK(t *testing.T) {
+	reply, err := NewReply([]byte("psk-a"), "key-1", ErrorNone, nil)
+	if err != nil {
+		t.Fatalf("NewReply failed: %v", err)
+	}
+	if _, _, err := ParseReply([]byte("psk-b"), reply); err == nil {
+		t.Fatal("expected reply encrypted with another PSK to be rejected")
+	}
+}
+
+func TestKeyPayloadRoundTrip(t *testing.T) {
+	in := KeyPayload{
+		Sender:       0xdeadbeef,
+		KeyID:        "key-1",
+		Activation:   time.Unix(1769101480, 500000000),
+		Confirmation: Confirmation([]byte("wireguard-psk"), "key-1"),
+		PQCID:        "3f2a9c0d1e4b5a67",
+	}
+	out, err := UnmarshalKeyPayload(in.Marshal())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if out.Sender != in.Sender || out.KeyID != in.KeyID || !out.Activation.Equal(in.Activation) || string(out.Confirmation) != string(in.Confirmation) || out.PQCID != in.PQCID {
+		t.Fatalf("expected %+v, got %+v", in, out)
+	}
+}
+
+func TestUnmarshalKeyPayloadRejectsMissingKeyID(t *testing.T) {
+	in := KeyPayload{Activation: time.Now()}
+	if _, err := UnmarshalKeyPayload(in.Marshal()); err == nil {
+		t.Fatal("expected payload without key ID to be rejected")
+	}
+	in.PQCID = "3f2a9c0d1e4b5a67"
+	if _, err := UnmarshalKeyPayload(in.Marshal()); err == nil {
+		t.Fatal("expected payload with PQC ID but without key ID to be rejected")
+	}
+}
+
+func TestUnmarshalKeyPayloadRejectsOtherVersion(t *testing.T) {
+	in := KeyPayload{KeyID: "key-1", Activation: time.Now()}
+	plain := in.Marshal()
+	if plain[0] != KeyPayloadVersion {
+		t.Fatalf("expected version %d in the first byte, got %d", KeyPayloadVersion, plain[0])
+	}
+	plain[0] = KeyPayloadVersion + 1
+	_, err := UnmarshalKeyPayload(plain)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+// TestConfirmationDetectsDivergence verifies that PSKs differing in a single bit,
+// or the same PSK confirmed for another key ID, produce different confirmations.
+func TestConfirmationDetectsDivergence(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	confirmation := Confirmation(psk, "key-1")
+	if !VerifyConfirmation(psk, "key-1", confirmation) {
+		t.Fatal("expected confirmation of the same PSK to verify")
+	}
+	other := append([]byte(nil), psk...)
+	other[0] ^= 0x01
+	if VerifyConfirmation(other, "key-1", confirmation) {
+		t.Fatal("expected confirmation of a different PSK to fail")
+	}
+	if VerifyConfirmation(psk, "key-2", confirmation) {
+		t.Fatal("expected confirmation for a different key ID to fail")
+	}
+	if string(confirmation) == string(Sign(psk, []byte("key-1"))) {
+		t.Fatal("confirmation must be domain separated from packet signatures")
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	id, nonce, err := DecodeHello(EncodeHello("9999", 0xdeadbeef))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if id != "9999" || nonce != 0xdeadbeef {
+		t.Fatalf("expected 9999/deadbeef, got %s/%x", id, nonce)
+	}
+	if _, _, err := DecodeHello(EncodeHello("", 1)); err == nil {
+		t.Fatal("expected HELLO without Arnika ID to be rejected")
+	}
+}
+
+func TestByeRoundTrip(t *testing.T) {
+	bye, err := DecodeBye(EncodeBye(&Bye{ArnikaID: "9999", Nonce: 0xdeadbeef, Invalidated: true}))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if bye.ArnikaID != "9999" || bye.Nonce != 0xdeadbeef || !bye.Invalidated {
+		t.Fatalf("unexpected BYE payload %+v", bye)
+	}
+	if _, err := DecodeBye(EncodeBye(&Bye{Nonce: 1})); err == nil {
+		t.Fatal("expected BYE without Arnika ID to be rejected")
+	}
+}
+
+func TestKEMRoundTrip(t *testing.T) {
+	kem, err := DecodeKEM(EncodeKEM(&KEM{Sender: 0xdeadbeef, Generation: 42, Data: []byte("encapsulation key")}))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if kem.Sender != 0xdeadbeef || kem.Generation != 42 || string(kem.Data) != "encapsulation key" {
+		t.Fatalf("unexpected KEM payload %+v", kem)
+	}
+	if _, err := DecodeKEM(EncodeKEM(&KEM{Generation: 1})); err == nil {
+		t.Fatal("expected KEM payload without data to be rejected")
+	}
+}
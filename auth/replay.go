@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors of ReplayCache.Check.
+var (
+	ErrReplay          = errors.New("packet replayed")
+	ErrReplayCacheFull = errors.New("replay cache full")
+)
+
+// ReplayCache remembers the signatures of accepted packets until their timestamp
+// leaves the clock-skew window, so a captured packet cannot be replayed while
+// its timestamp is still considered fresh.
+//
+// The cache is bounded: once capacity entries are held, new packets are rejected
+// until the first entry expires. Evicting an entry whose timestamp is still fresh
+// would let its packet be replayed. Only packets with a valid signature are
+// recorded, so filling the cache requires genuine traffic.
+type ReplayCache struct {
+	mu       sync.Mutex
+	maxAge   time.Duration
+	capacity int
+	entries  map[[sha256.Size]byte]int64 // signature -> expiry (unix seconds)
+	order    [][sha256.Size]byte         // signatures in insertion order
+	now      func() time.Time
+}
+
+// NewReplayCache creates a ReplayCache holding up to capacity signatures for
+// maxAge past their packet timestamp, maxAge should match the allowed clock skew.
+func NewReplayCache(maxAge time.Duration, capacity int) *ReplayCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ReplayCache{
+		maxAge:   maxAge,
+		capacity: capacity,
+		entries:  make(map[[sha256.Size]byte]int64),
+		now:      time.Now,
+	}
+}
+
+// Check records the packet. It returns ErrReplay if its signature was already
+// recorded and ErrReplayCacheFull if the packet can not be recorded. Call it after
+// the signature and timestamp checks, before decrypting the payload.
+func (c *ReplayCache) Check(p *Packet) error {
+	var key [sha256.Size]byte
+	copy(key[:], p.Signature)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire()
+	if _, ok := c.entries[key]; ok {
+		return ErrReplay
+	}
+	if len(c.order) >= c.capacity {
+		return ErrReplayCacheFull
+	}
+	c.entries[key] = p.Timestamp + int64(c.maxAge.Seconds())
+	c.order = append(c.order, key)
+	return nil
+}
+
+// Len returns the number of recorded signatures.
+func (c *ReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// expire drops all entries whose timestamp is outside the window.
+func (c *ReplayCache) expire() {
+	now := c.now().Unix()
+	kept := c.order[:0]
+	for _, key := range c.order {
+		if c.entries[key] < now {
+			delete(c.entries, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	clear(c.order[len(kept):])
+	c.order = kept
+}
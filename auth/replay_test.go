@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func signedPacket(t *testing.T, psk []byte, ts int64, payload string) *Packet {
+	t.Helper()
+	pkt := Packet{Type: PacketData, Timestamp: ts, Payload: []byte(payload)}
+	parsed, err := UnmarshalPacket(psk, pkt.Marshal(psk))
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	return parsed
+}
+
+func TestReplayCacheRejectsDuplicate(t *testing.T) {
+	psk := []byte("replay-psk")
+	cache := NewReplayCache(time.Minute, 16)
+	pkt := signedPacket(t, psk, time.Now().Unix(), "key-id")
+
+	if err := cache.Check(pkt); err != nil {
+		t.Fatalf("first packet must be accepted, got %v", err)
+	}
+	if err := cache.Check(pkt); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replayed packet must be rejected, got %v", err)
+	}
+}
+
+// TestReplayCacheAcceptsRetransmission verifies that a retry of udpClient, which
+// is a freshly signed packet carrying the same key ID, is not treated as a replay.
+func TestReplayCacheAcceptsRetransmission(t *testing.T) {
+	psk := []byte("replay-psk")
+	cache := NewReplayCache(time.Minute, 16)
+	ts := time.Now().Unix()
+
+	var packets []*Packet
+	for range 2 {
+		encrypted, err := Encrypt(psk, []byte("key-id"))
+		if err != nil {
+			t.Fatalf("encrypt failed: %v", err)
+		}
+		packets = append(packets, signedPacket(t, psk, ts, string(encrypted)))
+	}
+	first, retry := packets[0], packets[1]
+
+	if err := cache.Check(first); err != nil {
+		t.Fatalf("first packet must be accepted, got %v", err)
+	}
+	if err := cache.Check(retry); err != nil {
+		t.Fatalf("retransmission must be accepted, got %v", err)
+	}
+}
+
+func TestReplayCacheExpiresEntries(t *testing.T) {
+	psk := []byte("replay-psk")
+	cache := NewReplayCache(time.Minute, 16)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	pkt := signedPacket(t, psk, now.Unix(), "key-id")
+
+	_ = cache.Check(pkt)
+	now = now.Add(2 * time.Minute)
+	if err := cache.Check(signedPacket(t, psk, now.Unix(), "other")); err != nil {
+		t.Fatalf("unrelated packet must be accepted, got %v", err)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("expected expired entry to be dropped, got %d entries", cache.Len())
+	}
+}
+
+// TestReplayCacheBounded checks that a full cache rejects new packets instead of
+// evicting a fresh entry, whose packet could be replayed otherwise.
+func TestReplayCacheBounded(t *testing.T) {
+	psk := []byte("replay-psk")
+	cache := NewReplayCache(time.Minute, 2)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	oldest := signedPacket(t, psk, now.Unix()-10, "a")
+
+	for _, pkt := range []*Packet{oldest, signedPacket(t, psk, now.Unix(), "b")} {
+		if err := cache.Check(pkt); err != nil {
+			t.Fatalf("packet must be accepted, got %v", err)
+		}
+	}
+	if err := cache.Check(signedPacket(t, psk, now.Unix(), "c")); !errors.Is(err, ErrReplayCacheFull) {
+		t.Fatalf("expected ErrReplayCacheFull, got %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", cache.Len())
+	}
+	if err := cache.Check(oldest); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay of the oldest packet must be rejected, got %v", err)
+	}
+
+	// Once the oldest entry expired, its slot takes a new packet
+	now = now.Add(time.Minute - 5*time.Second)
+	if err := cache.Check(signedPacket(t, psk, now.Unix(), "d")); err != nil {
+		t.Fatalf("packet must be accepted after an entry expired, got %v", err)
+	}
+}
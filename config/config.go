@@ -2,14 +2,14 @@
 package config
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/arnika-project/arnika/logging"
 )
 
 // Config contains the configuration values for the arnika service.
@@ -18,72 +18,94 @@ type Config struct {
 	ServerAddress          string        // SERVER_ADDRESS, Address of the arnika server
 	ArnikaID               string        // ARNIKA_ID, up to 5-digit identifier (defaults to port number from ListenAddress)
 	ArnikaPSK              string        // ARNIKA_PSK, PSK to authenticate with the other peer
-	Certificate            string        // CERTIFICATE, Path to the client certificate file
-	PrivateKey             string        // PRIVATE_KEY, Path to the client key file
-	CACertificate          string        // CA_CERTIFICATE, Path to the CA certificate file
+	Certificate            string        // CERTIFICATE, Paths to the client certificate files, one per KMS URL or one for all
+	PrivateKey             string        // PRIVATE_KEY, Paths to the client key files, one per KMS URL or one for all
+	CACertificate          string        // CA_CERTIFICATE, Paths to the CA certificate files, one per KMS URL or one for all
 	ArnikaPeerTimeout      time.Duration // ARNIKA_PEER_TIMEOUT, TCP connection timeout for peer connections
-	KMSURL                 string        // KMS_URL, URL of the KMS server
+	ArnikaAckTimeout       time.Duration // ARNIKA_ACK_TIMEOUT, Maximum time to wait for the peer to confirm the key installation
+	ActivationDelay        time.Duration // ACTIVATION_DELAY, Time between sending a key ID and the PSK activation on both nodes
+	QKDSource              string        // QKD_SOURCE, Comma separated URIs of the QKD key source, derived from KMS_URL if empty
+	KMSURL                 string        // KMS_URL, Comma separated URLs of the KMS servers in order of preference
 	KMSHTTPTimeout         time.Duration // KMS_HTTP_TIMEOUT, HTTP connection timeout
 	KMSBackoffMaxRetries   int           // KMS_BACKOFF_MAX_RETRIES, Maximum number of retries for KMS requests
 	KMSBackoffBaseDelay    time.Duration // KMS_BACKOFF_BASE_DELAY, Base delay for KMS request retries, will get exponentially increased
 	KMSRetryInterval       time.Duration // KMS_RETRY_INTERVAL, Interval between KMS request retries
+	KMSBreakerThreshold    int           // KMS_BREAKER_THRESHOLD, Consecutive failures after which a KMS URL is skipped
+	KMSBreakerCooldown     time.Duration // KMS_BREAKER_COOLDOWN, Time a failing KMS URL is skipped
+	KMSRequestMethod       string        // KMS_REQUEST_METHOD, HTTP method for enc_keys and dec_keys ("auto", "post", "get")
+	KMSPoolSize            int           // KMS_POOL_SIZE, Number of keys prefetched from the KMS, disabled if 0
+	KMSPoolMaxKeyAge       time.Duration // KMS_POOL_MAX_KEY_AGE, Maximum time a prefetched key is kept in the pool
 	Interval               time.Duration // INTERVAL, Interval between key updates
 	WireGuardInterface     string        // WIREGUARD_INTERFACE, Name of the WireGuard interface to configure
 	WireguardPeerPublicKey string        // WIREGUARD_PEER_PUBLIC_KEY, Public key of the WireGuard peer
+	PQCSource              string        // PQC_SOURCE, URI of the PQC key source, derived from PQC_PSK_FILE or PQC_MLKEM if empty
 	PQCPSKFile             string        // PQC_PSK_FILE, Path to the PQC PSK file
+	PQCMaxKeyAge           time.Duration // PQC_MAX_KEY_AGE, Maximum time the PQC key file may stay unchanged, unlimited if 0
+	PQCMLKEM               int           // PQC_MLKEM, ML-KEM parameter set (768, 1024) of the built-in PQC key exchange, disabled if 0
 	Mode                   string        // MODE, Operation mode ("QkdAndPqcRequired", "AtLeastQkdRequired", "AtLeastPqcRequired", "EitherQkdOrPqcRequired")
+	GraceIntervals         int           // GRACE_INTERVALS, Consecutive failed intervals tolerated before the tunnel is invalidated
+	GraceMaxPSKAge         time.Duration // GRACE_MAX_PSK_AGE, Maximum age of the PSK kept during the grace period, unlimited if 0
+	RekeyBytes             int64         // REKEY_BYTES, Traffic volume after which the PRIMARY rotates the PSK early, disabled if 0
+	MaxPSKAge              time.Duration // MAX_PSK_AGE, Maximum age of the installed PSK before the tunnel is invalidated, unlimited if 0
+	StartupPolicy          string        // STARTUP_POLICY, PSK handling on startup ("keep", "invalidate")
+	ShutdownPolicy         string        // SHUTDOWN_POLICY, PSK handling on shutdown ("keep", "invalidate")
 	RateLimit              int           // RATE_LIMIT, Max requests per IP per window
 	RateWindow             time.Duration // RATE_WINDOW, Window duration for rate limiting
 	MaxClockSkew           time.Duration // MAX_CLOCK_SKEW, allowed timestamp difference as duration (replay protection)
+	MetricsAddress         string        // METRICS_ADDRESS, Address of the Prometheus metrics listener, disabled if empty
+	HealthAddress          string        // HEALTH_ADDRESS, Address of the /healthz and /readyz listener, disabled if empty
+	ReadyIntervals         int           // READY_INTERVALS, Number of intervals a PSK installation counts as recent for readiness
+	LogLevel               string        // LOG_LEVEL, Minimum log level ("debug", "info", "warn", "error")
+	LogFormat              string        // LOG_FORMAT, Log output format ("text", "json")
+	Peers                  []Peer        // PEERS, peers managed by this process, see Peer
 }
 
-// UsePQC returns a boolean indicating whether the PQC PSK file is set in the Config struct.
+// UsePQC returns a boolean indicating whether a PQC key source is set in the Config struct.
 //
 // No parameters.
-// Returns a boolean value indicating whether the PQC PSK file is set.
+// Returns a boolean value indicating whether PQC_SOURCE, the PQC PSK file or the ML-KEM exchange is set.
 func (c *Config) UsePQC() bool {
-	return c.PQCPSKFile != ""
+	return c.PQCSource != "" || c.PQCPSKFile != "" || c.PQCMLKEM != 0
 }
 
 func (c *Config) IsPQCRequired() bool {
-	return c.Mode == "QkdAndPqcRequired" || c.Mode == "AtLeastPqcRequired"
+	return isPQCRequired(c.Mode)
 }
 
 func (c *Config) IsQKDRequired() bool {
-	return c.Mode == "QkdAndPqcRequired" || c.Mode == "AtLeastQkdRequired"
-}
-
-// IsPrimary computes a deterministic role for the current interval using
-// HMAC-SHA256(ArnikaPSK, intervalNum). The first byte of the hash is XORed
-// with ArnikaID (parsed as int, truncated to uint8). The node whose result
-// has the lowest bit == 0 is PRIMARY for that interval. Because two peers
-// with different ArnikaIDs XOR different values, they get opposite results.
-func (c *Config) IsPrimary(intervalNum uint64) bool {
-	mac := hmac.New(sha256.New, []byte(c.ArnikaPSK))
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], intervalNum)
-	mac.Write(buf[:])
-	h := mac.Sum(nil)
-
-	id, _ := strconv.Atoi(c.ArnikaID) // always valid, checked during Parse
-	xored := h[0] ^ byte(id)
-	return xored&1 == 0
+	return isQKDRequired(c.Mode)
 }
 
 func (c *Config) PrintStartupConfig() {
 	fmt.Println("=== Arnika Configuration ===")
 	fmt.Printf("Arnika Mode:              %s\n", c.Mode)
+	fmt.Printf("Grace Intervals:          %d\n", c.GraceIntervals)
+	fmt.Printf("Grace Max PSK Age:        %s\n", c.GraceMaxPSKAge)
+	fmt.Printf("Rekey Bytes:              %d\n", c.RekeyBytes)
+	fmt.Printf("Max PSK Age:              %s\n", c.MaxPSKAge)
+	fmt.Printf("Startup Policy:           %s\n", c.StartupPolicy)
+	fmt.Printf("Shutdown Policy:          %s\n", c.ShutdownPolicy)
 	fmt.Printf("Arnika Interval:          %s\n", c.Interval)
 	fmt.Printf("Arnika ID:                %s\n", c.ArnikaID)
 	fmt.Printf("Arnika PSK:               %s\n", c.ArnikaPSK)
 	fmt.Printf("Arnika Listen Address:    %s\n", c.ListenAddress)
 	fmt.Printf("Arnika Peer Address:      %s\n", c.ServerAddress)
 	fmt.Printf("Arnika Peer Timeout:			%s\n", c.ArnikaPeerTimeout)
+	fmt.Printf("Arnika ACK Timeout:       %s\n", c.ArnikaAckTimeout)
+	fmt.Printf("Activation Delay:         %s\n", c.ActivationDelay)
+	if c.QKDSource != "" {
+		fmt.Printf("QKD Source:               %s\n", c.QKDSource)
+	}
 	fmt.Printf("KMS URL:                  %s\n", c.KMSURL)
 	fmt.Printf("KMS HTTP Timeout:         %s\n", c.KMSHTTPTimeout)
 	fmt.Printf("KMS Backoff Max Retries:  %d\n", c.KMSBackoffMaxRetries)
 	fmt.Printf("KMS Backoff Base Delay:   %s\n", c.KMSBackoffBaseDelay)
 	fmt.Printf("KMS Retry Interval:       %s\n", c.KMSRetryInterval)
+	fmt.Printf("KMS Breaker Threshold:    %d\n", c.KMSBreakerThreshold)
+	fmt.Printf("KMS Breaker Cooldown:     %s\n", c.KMSBreakerCooldown)
+	fmt.Printf("KMS Request Method:       %s\n", c.KMSRequestMethod)
+	fmt.Printf("KMS Pool Size:            %d\n", c.KMSPoolSize)
+	fmt.Printf("KMS Pool Max Key Age:     %s\n", c.KMSPoolMaxKeyAge)
 
 	if c.Certificate != "" {
 		fmt.Printf("Client Certificate:       %s\n", c.Certificate)
@@ -100,9 +122,16 @@ func (c *Config) PrintStartupConfig() {
 	} else {
 		fmt.Println("CA Certificate:           (not configured)")
 	}
-	if c.UsePQC() {
+	if c.PQCSource != "" {
+		fmt.Printf("PQC key provider:         ENABLED\n")
+		fmt.Printf("PQC key:                  %s\n", c.PQCSource)
+	} else if c.PQCMLKEM != 0 {
+		fmt.Printf("PQC key provider:         ENABLED\n")
+		fmt.Printf("PQC key:                  ML-KEM-%d\n", c.PQCMLKEM)
+	} else if c.UsePQC() {
 		fmt.Printf("PQC key provider:         ENABLED\n")
 		fmt.Printf("PQC key:                  %s\n", c.PQCPSKFile)
+		fmt.Printf("PQC max key age:          %s\n", c.PQCMaxKeyAge)
 	} else {
 		fmt.Println("PQC key provider:        DISABLED")
 	}
@@ -112,6 +141,40 @@ func (c *Config) PrintStartupConfig() {
 	fmt.Printf("Rate Limit:               %d\n", c.RateLimit)
 	fmt.Printf("Rate Window:              %s\n", c.RateWindow)
 	fmt.Printf("Max Clock Skew:           %s\n", c.MaxClockSkew)
+	if c.MetricsAddress != "" {
+		fmt.Printf("Metrics Address:          %s\n", c.MetricsAddress)
+	} else {
+		fmt.Println("Metrics Address:          (not configured)")
+	}
+	if c.HealthAddress != "" {
+		fmt.Printf("Health Address:           %s\n", c.HealthAddress)
+		fmt.Printf("Ready Intervals:          %d\n", c.ReadyIntervals)
+	} else {
+		fmt.Println("Health Address:           (not configured)")
+	}
+	fmt.Printf("Log Level:                %s\n", c.LogLevel)
+	fmt.Printf("Log Format:               %s\n", c.LogFormat)
+	for _, p := range c.Peers {
+		if p.Name == "" {
+			continue
+		}
+		fmt.Printf("Peer %s:\n", p.Name)
+		fmt.Printf("  Mode:                   %s\n", p.Mode)
+		fmt.Printf("  Grace Intervals:        %d\n", p.GraceIntervals)
+		fmt.Printf("  Grace Max PSK Age:      %s\n", p.GraceMaxPSKAge)
+		fmt.Printf("  Rekey Bytes:            %d\n", p.RekeyBytes)
+		fmt.Printf("  Max PSK Age:            %s\n", p.MaxPSKAge)
+		fmt.Printf("  Startup Policy:         %s\n", p.StartupPolicy)
+		fmt.Printf("  Shutdown Policy:        %s\n", p.ShutdownPolicy)
+		fmt.Printf("  Interval:               %s\n", p.Interval)
+		fmt.Printf("  Peer Address:           %s\n", p.ServerAddress)
+		fmt.Printf("  QKD Source:             %s\n", p.QKDSource)
+		fmt.Printf("  PQC Source:             %s\n", p.PQCSource)
+		fmt.Printf("  PQC max key age:        %s\n", p.PQCMaxKeyAge)
+		fmt.Printf("  PQC ML-KEM:             %d\n", p.PQCMLKEM)
+		fmt.Printf("  WireGuard Interface:    %s\n", p.WireGuardInterface)
+		fmt.Printf("  WireGuard Peer PubKey:  %s\n", p.WireguardPeerPublicKey)
+	}
 	fmt.Println("============================")
 }
 
@@ -120,18 +183,32 @@ func (c *Config) PrintStartupConfig() {
 // No parameters.
 // Returns a pointer to a Config struct and an error.
 func Parse() (*Config, error) {
+	return parse(nil)
+}
+
+// parse reads the configuration values from src, see source for the lookup order.
+//
+// If PEERS is set, the peer specific variables (SERVER_ADDRESS, KMS_URL, WIREGUARD_INTERFACE,
+// WIREGUARD_PEER_PUBLIC_KEY) become defaults which can be overridden per peer.
+//
+// Parameters:
+// - src: the configuration file values used for unset environment variables, may be nil.
+//
+// Returns a pointer to a Config struct and an error.
+func parse(src source) (*Config, error) {
 	config := &Config{}
 	var err error
-	config.ListenAddress, err = getEnv("LISTEN_ADDRESS")
+	multiPeer := len(splitList(src.getOrDefault("PEERS", ""))) > 0
+	config.ListenAddress, err = src.get("LISTEN_ADDRESS")
 	if err != nil {
 		return nil, err
 	}
-	config.ServerAddress, err = getEnv("SERVER_ADDRESS")
+	config.ServerAddress, err = src.getPeer("SERVER_ADDRESS", multiPeer)
 	if err != nil {
 		return nil, err
 	}
 	// Parse ArnikaID from environment or extract port from ListenAddress
-	arnikaIDEnv := os.Getenv("ARNIKA_ID")
+	arnikaIDEnv := src.getOrDefault("ARNIKA_ID", "")
 	if arnikaIDEnv != "" {
 		// Validate that it's a number with less than 6 digits
 		if len(arnikaIDEnv) > 5 {
@@ -149,87 +226,205 @@ func Parse() (*Config, error) {
 		}
 		config.ArnikaID = port
 	}
-	config.Certificate = getEnvOrDefault("CERTIFICATE", "")
-	config.PrivateKey = getEnvOrDefault("PRIVATE_KEY", "")
-	config.CACertificate = getEnvOrDefault("CA_CERTIFICATE", "")
-	config.KMSURL, err = getEnv("KMS_URL")
+	config.Certificate = src.getOrDefault("CERTIFICATE", "")
+	config.PrivateKey = src.getOrDefault("PRIVATE_KEY", "")
+	config.CACertificate = src.getOrDefault("CA_CERTIFICATE", "")
+	config.QKDSource = src.getOrDefault("QKD_SOURCE", "")
+	config.KMSURL, err = src.getPeer("KMS_URL", multiPeer || config.QKDSource != "")
 	if err != nil {
 		return nil, err
 	}
-	kmsHTTPTimeout, err := time.ParseDuration(getEnvOrDefault("KMS_HTTP_TIMEOUT", "10s"))
+	kmsHTTPTimeout, err := time.ParseDuration(src.getOrDefault("KMS_HTTP_TIMEOUT", "10s"))
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse KMS_HTTP_TIMEOUT: %w", err)
 	}
 	config.KMSHTTPTimeout = kmsHTTPTimeout
-	interval, err := time.ParseDuration(getEnvOrDefault("INTERVAL", "10s"))
+	interval, err := time.ParseDuration(src.getOrDefault("INTERVAL", "10s"))
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse INTERVAL: %w", err)
 	}
 	config.Interval = interval
-	config.WireGuardInterface, err = getEnv("WIREGUARD_INTERFACE")
+	config.WireGuardInterface, err = src.getPeer("WIREGUARD_INTERFACE", multiPeer)
 	if err != nil {
 		return nil, err
 	}
-	config.WireguardPeerPublicKey, err = getEnv("WIREGUARD_PEER_PUBLIC_KEY")
+	config.WireguardPeerPublicKey, err = src.getPeer("WIREGUARD_PEER_PUBLIC_KEY", multiPeer)
 	if err != nil {
 		return nil, err
 	}
-	config.PQCPSKFile = getEnvOrDefault("PQC_PSK_FILE", "")
+	config.PQCSource = src.getOrDefault("PQC_SOURCE", "")
+	config.PQCPSKFile = src.getOrDefault("PQC_PSK_FILE", "")
 	if config.PQCPSKFile != "" {
-		fileInfo, err := os.Stat(config.PQCPSKFile)
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("[ERROR] failed to open PQC PSK file: %w", err)
-		}
-		if err != nil {
-			return nil, fmt.Errorf("[ERROR] failed to stat PQC PSK file: %w", err)
-		}
-		perms := fileInfo.Mode().Perm()
-		if perms&0077 != 0 {
-			return nil, fmt.Errorf("[ERROR] PQC PSK file has insecure permissions %o: must be 0600 or stricter", perms)
+		if err := ValidatePQCFile(config.PQCPSKFile); err != nil {
+			return nil, err
 		}
 	}
-	config.Mode = getEnvOrDefault("MODE", "AtLeastQkdRequired")
-	if config.Mode != "QkdAndPqcRequired" && config.Mode != "AtLeastQkdRequired" && config.Mode != "AtLeastPqcRequired" && config.Mode != "EitherQkdOrPqcRequired" {
-		return nil, fmt.Errorf("[ERROR] invalid MODE value: %s", config.Mode)
+	config.PQCMaxKeyAge, err = time.ParseDuration(src.getOrDefault("PQC_MAX_KEY_AGE", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse PQC_MAX_KEY_AGE: %w", err)
+	}
+	if config.PQCMaxKeyAge < 0 {
+		return nil, fmt.Errorf("[ERROR] PQC_MAX_KEY_AGE must not be negative, got: %s", config.PQCMaxKeyAge)
+	}
+	config.PQCMLKEM, err = strconv.Atoi(src.getOrDefault("PQC_MLKEM", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse PQC_MLKEM: %w", err)
+	}
+	if err := validateMLKEM(config.PQCMLKEM, config.PQCPSKFile); err != nil {
+		return nil, err
+	}
+	config.Mode = src.getOrDefault("MODE", "AtLeastQkdRequired")
+	if err := validateMode(config.Mode); err != nil {
+		return nil, err
+	}
+	config.GraceIntervals, err = strconv.Atoi(src.getOrDefault("GRACE_INTERVALS", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse GRACE_INTERVALS: %w", err)
+	}
+	if config.GraceIntervals < 0 {
+		return nil, fmt.Errorf("[ERROR] GRACE_INTERVALS must not be negative, got: %d", config.GraceIntervals)
+	}
+	config.GraceMaxPSKAge, err = time.ParseDuration(src.getOrDefault("GRACE_MAX_PSK_AGE", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse GRACE_MAX_PSK_AGE: %w", err)
+	}
+	if config.GraceMaxPSKAge < 0 {
+		return nil, fmt.Errorf("[ERROR] GRACE_MAX_PSK_AGE must not be negative, got: %s", config.GraceMaxPSKAge)
+	}
+	config.RekeyBytes, err = parseBytes(src.getOrDefault("REKEY_BYTES", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse REKEY_BYTES: %w", err)
+	}
+	config.MaxPSKAge, err = time.ParseDuration(src.getOrDefault("MAX_PSK_AGE", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse MAX_PSK_AGE: %w", err)
+	}
+	if err := validateMaxPSKAge(config.MaxPSKAge, config.Interval); err != nil {
+		return nil, err
+	}
+	config.StartupPolicy = src.getOrDefault("STARTUP_POLICY", PolicyKeep)
+	if err := validatePolicy("STARTUP_POLICY", config.StartupPolicy); err != nil {
+		return nil, err
+	}
+	config.ShutdownPolicy = src.getOrDefault("SHUTDOWN_POLICY", PolicyKeep)
+	if err := validatePolicy("SHUTDOWN_POLICY", config.ShutdownPolicy); err != nil {
+		return nil, err
 	}
-	config.KMSBackoffMaxRetries, err = strconv.Atoi(getEnvOrDefault("KMS_BACKOFF_MAX_RETRIES", "5"))
+	config.KMSBackoffMaxRetries, err = strconv.Atoi(src.getOrDefault("KMS_BACKOFF_MAX_RETRIES", "5"))
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse KMS_BACKOFF_MAX_RETRIES: %w", err)
 	}
-	kmsBackoffBaseDelay, err := time.ParseDuration(getEnvOrDefault("KMS_BACKOFF_BASE_DELAY", "100ms"))
+	kmsBackoffBaseDelay, err := time.ParseDuration(src.getOrDefault("KMS_BACKOFF_BASE_DELAY", "100ms"))
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse KMS_BACKOFF_BASE_DELAY: %w", err)
 	}
 	config.KMSBackoffBaseDelay = kmsBackoffBaseDelay
-	config.KMSRetryInterval, err = time.ParseDuration(getEnvOrDefault("KMS_RETRY_INTERVAL", (config.Interval / 2).String()))
+	config.KMSRetryInterval, err = time.ParseDuration(src.getOrDefault("KMS_RETRY_INTERVAL", (config.Interval / 2).String()))
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse KMS_RETRY_INTERVAL: %w", err)
 	}
-	if !config.UsePQC() && config.IsPQCRequired() {
+	config.KMSBreakerThreshold, err = strconv.Atoi(src.getOrDefault("KMS_BREAKER_THRESHOLD", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse KMS_BREAKER_THRESHOLD: %w", err)
+	}
+	if config.KMSBreakerThreshold < 1 {
+		return nil, fmt.Errorf("[ERROR] KMS_BREAKER_THRESHOLD must be at least 1, got: %d", config.KMSBreakerThreshold)
+	}
+	config.KMSBreakerCooldown, err = time.ParseDuration(src.getOrDefault("KMS_BREAKER_COOLDOWN", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse KMS_BREAKER_COOLDOWN: %w", err)
+	}
+	if config.KMSBreakerCooldown <= 0 {
+		return nil, fmt.Errorf("[ERROR] KMS_BREAKER_COOLDOWN must be positive, got: %s", config.KMSBreakerCooldown)
+	}
+	config.KMSRequestMethod = src.getOrDefault("KMS_REQUEST_METHOD", "auto")
+	if err := validateKMSRequestMethod(config.KMSRequestMethod); err != nil {
+		return nil, err
+	}
+	config.KMSPoolSize, err = strconv.Atoi(src.getOrDefault("KMS_POOL_SIZE", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse KMS_POOL_SIZE: %w", err)
+	}
+	if config.KMSPoolSize < 0 {
+		return nil, fmt.Errorf("[ERROR] KMS_POOL_SIZE must not be negative, got: %d", config.KMSPoolSize)
+	}
+	config.KMSPoolMaxKeyAge, err = time.ParseDuration(src.getOrDefault("KMS_POOL_MAX_KEY_AGE", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse KMS_POOL_MAX_KEY_AGE: %w", err)
+	}
+	if config.KMSPoolMaxKeyAge <= 0 {
+		return nil, fmt.Errorf("[ERROR] KMS_POOL_MAX_KEY_AGE must be positive, got: %s", config.KMSPoolMaxKeyAge)
+	}
+	if !multiPeer && !config.UsePQC() && config.IsPQCRequired() {
 		return nil, fmt.Errorf("[ERROR] PQC PSK file missing as MODE is %s", config.Mode)
 	}
-	config.ArnikaPSK = getEnvOrDefault("ARNIKA_PSK", "")
-	config.ArnikaPeerTimeout, err = time.ParseDuration(getEnvOrDefault("ARNIKA_PEER_TIMEOUT", "500ms"))
+	config.ArnikaPSK = src.getOrDefault("ARNIKA_PSK", "")
+	config.ArnikaPeerTimeout, err = time.ParseDuration(src.getOrDefault("ARNIKA_PEER_TIMEOUT", "500ms"))
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse ARNIKA_PEER_TIMEOUT: %w", err)
 	}
-	rateLimitStr := getEnvOrDefault("RATE_LIMIT", "30")
+	config.ArnikaAckTimeout, err = time.ParseDuration(src.getOrDefault("ARNIKA_ACK_TIMEOUT", "10s"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse ARNIKA_ACK_TIMEOUT: %w", err)
+	}
+	if config.ArnikaAckTimeout < config.ArnikaPeerTimeout {
+		return nil, fmt.Errorf("[ERROR] ARNIKA_ACK_TIMEOUT must not be shorter than ARNIKA_PEER_TIMEOUT")
+	}
+	config.ActivationDelay, err = time.ParseDuration(src.getOrDefault("ACTIVATION_DELAY", "2s"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse ACTIVATION_DELAY: %w", err)
+	}
+	if config.ActivationDelay < config.ArnikaPeerTimeout {
+		// The BACKUP has to confirm the key ID before the activation time
+		return nil, fmt.Errorf("[ERROR] ACTIVATION_DELAY must not be shorter than ARNIKA_PEER_TIMEOUT, got: %s", config.ActivationDelay)
+	}
+	rateLimitStr := src.getOrDefault("RATE_LIMIT", "30")
 	config.RateLimit, err = strconv.Atoi(rateLimitStr)
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse RATE_LIMIT: %w", err)
 	}
-	rateWindowStr := getEnvOrDefault("RATE_WINDOW", "1m")
+	rateWindowStr := src.getOrDefault("RATE_WINDOW", "1m")
 	config.RateWindow, err = time.ParseDuration(rateWindowStr)
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse RATE_WINDOW: %w", err)
 	}
 	// Parse max clock skew config
-	maxClockSkewStr := getEnvOrDefault("MAX_CLOCK_SKEW", "1m")
+	maxClockSkewStr := src.getOrDefault("MAX_CLOCK_SKEW", "1m")
 	maxClockSkew, err := time.ParseDuration(maxClockSkewStr)
 	if err != nil {
 		return nil, fmt.Errorf("[ERROR] failed to parse MAX_CLOCK_SKEW: %w", err)
 	}
 	config.MaxClockSkew = maxClockSkew
+	config.MetricsAddress = src.getOrDefault("METRICS_ADDRESS", "")
+	config.HealthAddress = src.getOrDefault("HEALTH_ADDRESS", "")
+	config.ReadyIntervals, err = strconv.Atoi(src.getOrDefault("READY_INTERVALS", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse READY_INTERVALS: %w", err)
+	}
+	if config.ReadyIntervals < 1 {
+		return nil, fmt.Errorf("[ERROR] READY_INTERVALS must be at least 1, got: %d", config.ReadyIntervals)
+	}
+	config.LogLevel = strings.ToLower(src.getOrDefault("LOG_LEVEL", "info"))
+	if _, err := logging.ParseLevel(config.LogLevel); err != nil {
+		return nil, fmt.Errorf("[ERROR] invalid LOG_LEVEL value: %s", config.LogLevel)
+	}
+	config.LogFormat = strings.ToLower(src.getOrDefault("LOG_FORMAT", "text"))
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return nil, fmt.Errorf("[ERROR] invalid LOG_FORMAT value: %s", config.LogFormat)
+	}
+	config.Peers, err = config.parsePeers(src)
+	if err != nil {
+		return nil, err
+	}
+	for i := range config.Peers {
+		if err := config.validateKMSEndpoints(&config.Peers[i]); err != nil {
+			return nil, err
+		}
+		// Without PEERS, ARNIKA_PSK is optional otherwise
+		if config.Peers[i].PQCMLKEM != 0 && config.Peers[i].ArnikaPSK == "" {
+			return nil, fmt.Errorf("[ERROR] ARNIKA_PSK is required as it authenticates the ML-KEM exchange of PQC_MLKEM")
+		}
+	}
 	return config, nil
 }
 
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -24,6 +25,12 @@ func TestUsePQC(t *testing.T) {
 	if result != expected {
 		t.Errorf("Expected %t, but got %t", expected, result)
 	}
+
+	// Test case 3: Config with the ML-KEM exchange set
+	c = &Config{PQCMLKEM: 768}
+	if !c.UsePQC() {
+		t.Error("Expected PQC to be used with PQCMLKEM set")
+	}
 }
 
 func TestParse(t *testing.T) {
@@ -49,25 +56,55 @@ func TestParse(t *testing.T) {
 		ListenAddress:          "127.0.0.1:8080",
 		ServerAddress:          "127.0.0.1:8081",
 		ArnikaID:               "8080",
-		ArnikaPSK:              "", // Default value for ArnikaPSK
-		Certificate:            "", // Default value for Certificate
-		PrivateKey:             "", // Default value for PrivateKey
-		CACertificate:          "", // Default value for CACertificate
+		ArnikaPSK:              "",                     // Default value for ArnikaPSK
+		Certificate:            "",                     // Default value for Certificate
+		PrivateKey:             "",                     // Default value for PrivateKey
+		CACertificate:          "",                     // Default value for CACertificate
 		ArnikaPeerTimeout:      time.Millisecond * 500, // Actual default value for ArnikaPeerTimeout
+		ArnikaAckTimeout:       time.Second * 10,       // Actual default value for ArnikaAckTimeout
+		ActivationDelay:        time.Second * 2,        // Actual default value for ActivationDelay
 		KMSURL:                 "https://example.com",
-		KMSHTTPTimeout:         time.Second * 10,        // Actual default value for KMSHTTPTimeout
-		KMSBackoffMaxRetries:   5,                       // Actual default value for KMSBackoffMaxRetries
-		KMSBackoffBaseDelay:    time.Millisecond * 100,  // Actual default value for KMSBackoffBaseDelay
-		KMSRetryInterval:       time.Second * 5,         // Actual default value for KMSRetryInterval
-		Interval:               time.Second * 10,        // Actual default value for Interval
+		KMSHTTPTimeout:         time.Second * 10,       // Actual default value for KMSHTTPTimeout
+		KMSBackoffMaxRetries:   5,                      // Actual default value for KMSBackoffMaxRetries
+		KMSBackoffBaseDelay:    time.Millisecond * 100, // Actual default value for KMSBackoffBaseDelay
+		KMSRetryInterval:       time.Second * 5,        // Actual default value for KMSRetryInterval
+		KMSBreakerThreshold:    3,                      // Actual default value for KMSBreakerThreshold
+		KMSBreakerCooldown:     time.Second * 30,       // Actual default value for KMSBreakerCooldown
+		KMSRequestMethod:       "auto",                 // Actual default value for KMSRequestMethod
+		KMSPoolSize:            0,                      // Actual default value for KMSPoolSize
+		KMSPoolMaxKeyAge:       time.Minute * 5,        // Actual default value for KMSPoolMaxKeyAge
+		Interval:               time.Second * 10,       // Actual default value for Interval
 		WireGuardInterface:     "wg0",
 		WireguardPeerPublicKey: "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=",
 		PQCPSKFile:             "", // Default value for PQCPSKFile
 		Mode:                   "AtLeastQkdRequired",
-		RateLimit:              30,              // Real default value for RateLimit
-		RateWindow:             time.Minute,     // Real default value for RateWindow
-		MaxClockSkew:           time.Minute,     // Real default value for MaxClockSkew
+		GraceIntervals:         0,           // Real default value for GraceIntervals
+		GraceMaxPSKAge:         0,           // Real default value for GraceMaxPSKAge
+		RekeyBytes:             0,           // Real default value for RekeyBytes
+		MaxPSKAge:              0,           // Real default value for MaxPSKAge
+		StartupPolicy:          "keep",      // Real default value for StartupPolicy
+		ShutdownPolicy:         "keep",      // Real default value for ShutdownPolicy
+		RateLimit:              30,          // Real default value for RateLimit
+		RateWindow:             time.Minute, // Real default value for RateWindow
+		MaxClockSkew:           time.Minute, // Real default value for MaxClockSkew
+		ReadyIntervals:         3,           // Real default value for ReadyIntervals
+		LogLevel:               "info",      // Real default value for LogLevel
+		LogFormat:              "text",      // Real default value for LogFormat
 	}
+	expectedConfig.Peers = []Peer{{
+		ArnikaID:               "8080",
+		ServerAddress:          "127.0.0.1:8081",
+		QKDSource:              "etsi014+https://example.com",
+		KMSURL:                 "https://example.com",
+		KMSRequestMethod:       "auto",
+		Interval:               time.Second * 10,
+		KMSRetryInterval:       time.Second * 5,
+		WireGuardInterface:     "wg0",
+		WireguardPeerPublicKey: "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=",
+		Mode:                   "AtLeastQkdRequired",
+		StartupPolicy:          "keep",
+		ShutdownPolicy:         "keep",
+	}}
 	result, err := Parse()
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
@@ -146,6 +183,149 @@ func TestParse_PQCFilePermissions(t *testing.T) {
 	}
 }
 
+func TestParse_MLKEM(t *testing.T) {
+	t.Setenv("LISTEN_ADDRESS", "127.0.0.1:8080")
+	t.Setenv("SERVER_ADDRESS", "127.0.0.1:8081")
+	t.Setenv("KMS_URL", "https://example.com")
+	t.Setenv("WIREGUARD_INTERFACE", "wg0")
+	t.Setenv("WIREGUARD_PEER_PUBLIC_KEY", "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=")
+	t.Setenv("MODE", "QkdAndPqcRequired")
+	t.Setenv("PQC_MLKEM", "1024")
+
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for PQC_MLKEM without ARNIKA_PSK")
+	}
+	t.Setenv("ARNIKA_PSK", "arnika-psk")
+	cfg, err := Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.PQCMLKEM != 1024 || !cfg.Peers[0].UsePQC() {
+		t.Errorf("Expected ML-KEM-1024 as PQC key source, got %d", cfg.Peers[0].PQCMLKEM)
+	}
+	if cfg.Peers[0].PQCSource != "mlkem://peer?level=1024" {
+		t.Errorf("Expected PQC_MLKEM as key source URI, got %s", cfg.Peers[0].PQCSource)
+	}
+
+	for _, invalid := range []string{"512", "kyber"} {
+		t.Setenv("PQC_MLKEM", invalid)
+		if _, err := Parse(); err == nil {
+			t.Errorf("Expected an error for PQC_MLKEM %q", invalid)
+		}
+	}
+
+	pqcFile := t.TempDir() + "/pqc.key"
+	if err := os.WriteFile(pqcFile, []byte("dGVzdGtleQ=="), 0600); err != nil {
+		t.Fatalf("failed to create key file: %v", err)
+	}
+	t.Setenv("PQC_MLKEM", "768")
+	t.Setenv("PQC_PSK_FILE", pqcFile)
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for PQC_MLKEM together with PQC_PSK_FILE")
+	}
+}
+
+func TestParse_Sources(t *testing.T) {
+	t.Setenv("LISTEN_ADDRESS", "127.0.0.1:8080")
+	t.Setenv("SERVER_ADDRESS", "127.0.0.1:8081")
+	t.Setenv("WIREGUARD_INTERFACE", "wg0")
+	t.Setenv("WIREGUARD_PEER_PUBLIC_KEY", "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=")
+
+	// KMS_URL is not required with another QKD key source
+	t.Setenv("QKD_SOURCE", "exec+id:///usr/local/bin/qrng")
+	cfg, err := Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Peers[0].QKDSource != "exec+id:///usr/local/bin/qrng" || cfg.Peers[0].KMSURL != "" {
+		t.Errorf("Expected exec key source without KMS URL, got %s and %s", cfg.Peers[0].QKDSource, cfg.Peers[0].KMSURL)
+	}
+	// QKD_SOURCE takes precedence over KMS_URL
+	t.Setenv("KMS_URL", "https://kms.example.com")
+	t.Setenv("QKD_SOURCE", "etsi014+https://kme-a:8443/api/v1/keys/SAE, etsi014+https://kme-b:8443/api/v1/keys/SAE")
+	cfg, err = Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Peers[0].QKDSource != "etsi014+https://kme-a:8443/api/v1/keys/SAE, etsi014+https://kme-b:8443/api/v1/keys/SAE" {
+		t.Errorf("Expected QKD_SOURCE as key source, got %s", cfg.Peers[0].QKDSource)
+	}
+	for _, invalid := range []string{"/usr/local/bin/qrng", "etsi014+https://kme-a, file:///key", "://kme"} {
+		t.Setenv("QKD_SOURCE", invalid)
+		if _, err := Parse(); err == nil {
+			t.Errorf("Expected an error for QKD_SOURCE %q", invalid)
+		}
+	}
+	t.Setenv("QKD_SOURCE", "")
+
+	// PQC_PSK_FILE is a file key source
+	pqcFile := filepath.Join(t.TempDir(), "pqc.key")
+	if err := os.WriteFile(pqcFile, []byte("dGVzdGtleQ=="), 0600); err != nil {
+		t.Fatalf("failed to create key file: %v", err)
+	}
+	t.Setenv("PQC_PSK_FILE", pqcFile)
+	cfg, err = Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Peers[0].PQCSource != "file://"+pqcFile {
+		t.Errorf("Expected PQC_PSK_FILE as key source URI, got %s", cfg.Peers[0].PQCSource)
+	}
+	t.Setenv("PQC_PSK_FILE", "")
+
+	t.Setenv("PQC_SOURCE", "file://"+pqcFile)
+	cfg, err = Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Peers[0].PQCSource != "file://"+pqcFile || !cfg.Peers[0].UsePQC() {
+		t.Errorf("Expected PQC_SOURCE as key source, got %s", cfg.Peers[0].PQCSource)
+	}
+	// Key source URIs are validated by their provider, registered schemes are not special
+	t.Setenv("PQC_SOURCE", "mlkem://peer?level=1024")
+	cfg, err = Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Peers[0].PQCMLKEM != 0 || !cfg.Peers[0].UsePQC() {
+		t.Errorf("Expected PQC_SOURCE to leave PQC_MLKEM unset, got %d", cfg.Peers[0].PQCMLKEM)
+	}
+	t.Setenv("ARNIKA_PSK", "arnika-psk")
+	for _, invalid := range []string{"/run/pqc.key", "exec:///a,exec:///b"} {
+		t.Setenv("PQC_SOURCE", invalid)
+		if _, err := Parse(); err == nil {
+			t.Errorf("Expected an error for PQC_SOURCE %q", invalid)
+		}
+	}
+	t.Setenv("PQC_SOURCE", "exec:///usr/local/bin/pqc")
+
+	// Key source settings of a peer override the key source URIs of the top level
+	t.Setenv("PEERS", "spoke1,spoke2,spoke3")
+	t.Setenv("PEER_SPOKE1_ARNIKA_PSK", "psk-spoke1")
+	t.Setenv("PEER_SPOKE2_ARNIKA_PSK", "psk-spoke2")
+	t.Setenv("PEER_SPOKE2_WIREGUARD_PEER_PUBLIC_KEY", "mJNYzLNLRCl9jRRkP/Qsa74v4bem4BC+KbqQz+Ft9lQ=")
+	t.Setenv("PEER_SPOKE2_QKD_SOURCE", "exec+id:///usr/local/bin/qrng")
+	t.Setenv("PEER_SPOKE2_PQC_PSK_FILE", pqcFile)
+	t.Setenv("PEER_SPOKE3_ARNIKA_PSK", "psk-spoke3")
+	t.Setenv("PEER_SPOKE3_WIREGUARD_PEER_PUBLIC_KEY", "Q7+0eW3EGQS+W1ajNf8vF3qOtDFzA6CqUdvx3nCbSHI=")
+	t.Setenv("PEER_SPOKE3_KMS_URL", "https://kms.example.com/api/v1/keys/SPOKE3")
+	t.Setenv("PEER_SPOKE3_PQC_SOURCE", "mlkem://peer")
+	t.Setenv("QKD_SOURCE", "etsi014+https://kms.example.com/api/v1/keys")
+	cfg, err = Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, want := range []struct{ qkd, pqc string }{
+		{"etsi014+https://kms.example.com/api/v1/keys", "exec:///usr/local/bin/pqc"},
+		{"exec+id:///usr/local/bin/qrng", "file://" + pqcFile},
+		{"etsi014+https://kms.example.com/api/v1/keys/SPOKE3", "mlkem://peer"},
+	} {
+		if got := cfg.Peers[i]; got.QKDSource != want.qkd || got.PQCSource != want.pqc {
+			t.Errorf("Expected key sources %s and %s for %s, got %s and %s", want.qkd, want.pqc, got.Name, got.QKDSource, got.PQCSource)
+		}
+	}
+}
+
 func TestGetEnvOrDefault(t *testing.T) {
 	// Test case 1: environment variable exists
 	t.Setenv("TEST_KEY", "test_value")
@@ -224,26 +404,213 @@ func TestIsQKDRequired(t *testing.T) {
 
 }
 
-func TestIsPrimary(t *testing.T) {
-	psk := "shared-secret-key"
-	nodeA := &Config{ArnikaID: "9999", ArnikaPSK: psk}
-	nodeB := &Config{ArnikaID: "9998", ArnikaPSK: psk}
+func TestParse_Peers(t *testing.T) {
+	t.Setenv("LISTEN_ADDRESS", "127.0.0.1:8080")
+	t.Setenv("KMS_URL", "https://kms.example.com/api/v1/keys")
+	t.Setenv("WIREGUARD_INTERFACE", "wg0")
+	t.Setenv("INTERVAL", "2m")
+	t.Setenv("PEERS", "spoke1, spoke2")
+
+	// Peer specific values are mandatory if they have no default
+	_, err := Parse()
+	if err == nil {
+		t.Fatal("Expected an error for missing PEER_SPOKE1_SERVER_ADDRESS")
+	}
+
+	t.Setenv("PEER_SPOKE1_SERVER_ADDRESS", "10.0.0.1:9999")
+	t.Setenv("PEER_SPOKE1_WIREGUARD_PEER_PUBLIC_KEY", "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=")
+	t.Setenv("PEER_SPOKE1_ARNIKA_PSK", "psk-spoke1")
+	t.Setenv("PEER_SPOKE2_SERVER_ADDRESS", "10.0.0.2:9999")
+	t.Setenv("PEER_SPOKE2_WIREGUARD_PEER_PUBLIC_KEY", "mJNYzLNLRCl9jRRkP/Qsa74v4bem4BC+KbqQz+Ft9lQ=")
+	t.Setenv("PEER_SPOKE2_ARNIKA_PSK", "psk-spoke2")
+	t.Setenv("PEER_SPOKE2_KMS_URL", "https://kms.example.com/api/v1/keys/SPOKE2")
+	t.Setenv("PEER_SPOKE2_INTERVAL", "30s")
+	t.Setenv("PEER_SPOKE2_MODE", "EitherQkdOrPqcRequired")
+	t.Setenv("PEER_SPOKE2_KMS_REQUEST_METHOD", "get")
+	t.Setenv("PEER_SPOKE2_STARTUP_POLICY", "invalidate")
+	t.Setenv("PEER_SPOKE2_SHUTDOWN_POLICY", "invalidate")
+	t.Setenv("PEER_SPOKE2_GRACE_INTERVALS", "2")
+	t.Setenv("PEER_SPOKE2_GRACE_MAX_PSK_AGE", "10m")
+	t.Setenv("PEER_SPOKE2_MAX_PSK_AGE", "1h")
+	t.Setenv("PEER_SPOKE2_REKEY_BYTES", "512M")
+	t.Setenv("PEER_SPOKE2_PQC_MAX_KEY_AGE", "5m")
+
+	cfg, err := Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []Peer{
+		{
+			Name:                   "spoke1",
+			ArnikaID:               "8080",
+			ArnikaPSK:              "psk-spoke1",
+			ServerAddress:          "10.0.0.1:9999",
+			QKDSource:              "etsi014+https://kms.example.com/api/v1/keys",
+			KMSURL:                 "https://kms.example.com/api/v1/keys",
+			KMSRequestMethod:       "auto",
+			Interval:               2 * time.Minute,
+			KMSRetryInterval:       time.Minute,
+			WireGuardInterface:     "wg0",
+			WireguardPeerPublicKey: "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=",
+			Mode:                   "AtLeastQkdRequired",
+			StartupPolicy:          "keep",
+			ShutdownPolicy:         "keep",
+		},
+		{
+			Name:                   "spoke2",
+			ArnikaID:               "8080",
+			ArnikaPSK:              "psk-spoke2",
+			ServerAddress:          "10.0.0.2:9999",
+			QKDSource:              "etsi014+https://kms.example.com/api/v1/keys/SPOKE2",
+			KMSURL:                 "https://kms.example.com/api/v1/keys/SPOKE2",
+			KMSRequestMethod:       "get",
+			Interval:               30 * time.Second,
+			KMSRetryInterval:       15 * time.Second,
+			WireGuardInterface:     "wg0",
+			WireguardPeerPublicKey: "mJNYzLNLRCl9jRRkP/Qsa74v4bem4BC+KbqQz+Ft9lQ=",
+			Mode:                   "EitherQkdOrPqcRequired",
+			GraceIntervals:         2,
+			GraceMaxPSKAge:         10 * time.Minute,
+			RekeyBytes:             512 << 20,
+			MaxPSKAge:              time.Hour,
+			PQCMaxKeyAge:           5 * time.Minute,
+			StartupPolicy:          "invalidate",
+			ShutdownPolicy:         "invalidate",
+		},
+	}
+	if !reflect.DeepEqual(cfg.Peers, expected) {
+		t.Errorf("Expected peers %#v, but got %#v", expected, cfg.Peers)
+	}
+
+	// Peers must be distinguishable by their ARNIKA_PSK
+	t.Setenv("PEER_SPOKE2_ARNIKA_PSK", "psk-spoke1")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for peers sharing the same ARNIKA_PSK")
+	}
+	t.Setenv("PEER_SPOKE2_ARNIKA_PSK", "psk-spoke2")
+
+	// Peer modes are validated like the global MODE
+	t.Setenv("PEER_SPOKE2_MODE", "invalid")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for invalid peer MODE")
+	}
+	t.Setenv("PEER_SPOKE2_MODE", "AtLeastPqcRequired")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for PQC mode without PQC PSK file")
+	}
+	t.Setenv("PEER_SPOKE2_MODE", "EitherQkdOrPqcRequired")
+	t.Setenv("PEER_SPOKE2_KMS_REQUEST_METHOD", "put")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for invalid peer KMS_REQUEST_METHOD")
+	}
+	t.Setenv("PEER_SPOKE2_KMS_REQUEST_METHOD", "get")
+	t.Setenv("PEER_SPOKE2_SHUTDOWN_POLICY", "drop")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for invalid peer SHUTDOWN_POLICY")
+	}
+	t.Setenv("PEER_SPOKE2_SHUTDOWN_POLICY", "invalidate")
+	t.Setenv("PEER_SPOKE2_STARTUP_POLICY", "drop")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for invalid peer STARTUP_POLICY")
+	}
+	t.Setenv("PEER_SPOKE2_STARTUP_POLICY", "invalidate")
+	t.Setenv("PEER_SPOKE2_GRACE_INTERVALS", "-1")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for negative peer GRACE_INTERVALS")
+	}
+	t.Setenv("PEER_SPOKE2_GRACE_INTERVALS", "2")
+	t.Setenv("PEER_SPOKE2_MAX_PSK_AGE", "30s")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for peer MAX_PSK_AGE not longer than its INTERVAL")
+	}
+	t.Setenv("PEER_SPOKE2_MAX_PSK_AGE", "1h")
+	t.Setenv("PEER_SPOKE2_PQC_MAX_KEY_AGE", "-1m")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for negative peer PQC_MAX_KEY_AGE")
+	}
+	t.Setenv("PEER_SPOKE2_PQC_MAX_KEY_AGE", "5m")
+	t.Setenv("PEER_SPOKE2_PQC_MLKEM", "512")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for invalid peer PQC_MLKEM")
+	}
+	t.Setenv("PEER_SPOKE2_PQC_MLKEM", "768")
+	t.Setenv("PEER_SPOKE2_MODE", "AtLeastPqcRequired")
+	cfg, err = Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error for PQC mode with PQC_MLKEM: %v", err)
+	}
+	if cfg.Peers[1].PQCMLKEM != 768 || cfg.Peers[0].PQCMLKEM != 0 {
+		t.Errorf("Expected ML-KEM-768 for spoke2 only, got %d and %d", cfg.Peers[0].PQCMLKEM, cfg.Peers[1].PQCMLKEM)
+	}
+
+	t.Setenv("PEERS", "spoke1,spoke-2")
+	if _, err := Parse(); err == nil {
+		t.Error("Expected an error for invalid peer name")
+	}
+}
 
-	// For each interval, the two nodes must get opposite roles
+func TestElectPrimary(t *testing.T) {
+	// IDs sharing the lowest bits get opposite roles by rank
+	nodeA := &Peer{ArnikaID: "9999", ArnikaPSK: "shared-secret-key"}
+	nodeB := &Peer{ArnikaID: "10255", ArnikaPSK: "shared-secret-key"}
+	primaries := 0
 	for i := uint64(0); i < 100; i++ {
-		a := nodeA.IsPrimary(i)
-		b := nodeB.IsPrimary(i)
+		a := nodeA.ElectPrimary(i, true)
+		b := nodeB.ElectPrimary(i, false)
 		if a == b {
-			t.Fatalf("interval %d: both nodes got the same role (IsPrimary=%v)", i, a)
+			t.Fatalf("interval %d: both nodes got the same role (ElectPrimary=%v)", i, a)
+		}
+		if a {
+			primaries++
 		}
 	}
+	if primaries == 0 || primaries == 100 {
+		t.Fatalf("expected the PRIMARY role to alternate, node A was PRIMARY %d times", primaries)
+	}
+}
 
-	// Deterministic: same input → same output
-	for i := uint64(0); i < 50; i++ {
-		first := nodeA.IsPrimary(i)
-		second := nodeA.IsPrimary(i)
-		if first != second {
-			t.Fatalf("interval %d: IsPrimary is not deterministic", i)
+func TestEpochInterval(t *testing.T) {
+	peer := &Peer{Interval: 10 * time.Second}
+	ts := time.Unix(1769101485, 0)
+	n := peer.EpochInterval(ts)
+	if n != 176910148 {
+		t.Fatalf("expected interval 176910148, got %d", n)
+	}
+	if start := peer.IntervalStart(n); !start.Equal(time.Unix(1769101480, 0)) {
+		t.Fatalf("unexpected interval start %s", start)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for input, expected := range map[string]int64{"0": 0, "1500": 1500, "4K": 4 << 10, "512m": 512 << 20, "1G": 1 << 30, "2T": 2 << 40} {
+		if n, err := parseBytes(input); err != nil || n != expected {
+			t.Errorf("parseBytes(%q) = %d, %v, expected %d", input, n, err, expected)
 		}
 	}
+	for _, input := range []string{"", "-1", "1.5G", "G", "9000000T"} {
+		if _, err := parseBytes(input); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestKMSEndpoints(t *testing.T) {
+	cfg := &Config{Certificate: "a.crt,b.crt", PrivateKey: "client.key", CACertificate: "ca.crt"}
+	peer := &Peer{ArnikaID: "9999", QKDSource: "etsi014+https://kme-a:8443/api/v1/keys/SAE, etsi014+https://kme-b:8443/api/v1/keys/SAE"}
+
+	if err := cfg.validateKMSEndpoints(peer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []KMSEndpoint{
+		{URL: "https://kme-a:8443/api/v1/keys/SAE", Certificate: "a.crt", PrivateKey: "client.key", CACertificate: "ca.crt"},
+		{URL: "https://kme-b:8443/api/v1/keys/SAE", Certificate: "b.crt", PrivateKey: "client.key", CACertificate: "ca.crt"},
+	}
+	if endpoints := cfg.KMSEndpoints([]string{"https://kme-a:8443/api/v1/keys/SAE", "https://kme-b:8443/api/v1/keys/SAE"}); !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints %#v, but got %#v", expected, endpoints)
+	}
+
+	cfg.Certificate = "a.crt,b.crt,c.crt"
+	if err := cfg.validateKMSEndpoints(peer); err == nil {
+		t.Error("Expected an error for a certificate list not matching the KMS URLs")
+	}
 }
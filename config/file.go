@@ -0,0 +1,218 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// fileKeys lists the settings accepted in the configuration file. Keys are the
+// lower case names of the corresponding environment variables.
+var fileKeys = map[string]bool{
+	"LISTEN_ADDRESS":            true,
+	"SERVER_ADDRESS":            true,
+	"ARNIKA_ID":                 true,
+	"ARNIKA_PSK":                true,
+	"CERTIFICATE":               true,
+	"PRIVATE_KEY":               true,
+	"CA_CERTIFICATE":            true,
+	"ARNIKA_PEER_TIMEOUT":       true,
+	"ARNIKA_ACK_TIMEOUT":        true,
+	"ACTIVATION_DELAY":          true,
+	"QKD_SOURCE":                true,
+	"KMS_URL":                   true,
+	"KMS_HTTP_TIMEOUT":          true,
+	"KMS_BACKOFF_MAX_RETRIES":   true,
+	"KMS_BACKOFF_BASE_DELAY":    true,
+	"KMS_RETRY_INTERVAL":        true,
+	"KMS_BREAKER_THRESHOLD":     true,
+	"KMS_BREAKER_COOLDOWN":      true,
+	"KMS_REQUEST_METHOD":        true,
+	"KMS_POOL_SIZE":             true,
+	"KMS_POOL_MAX_KEY_AGE":      true,
+	"INTERVAL":                  true,
+	"WIREGUARD_INTERFACE":       true,
+	"WIREGUARD_PEER_PUBLIC_KEY": true,
+	"PQC_SOURCE":                true,
+	"PQC_PSK_FILE":              true,
+	"PQC_MAX_KEY_AGE":           true,
+	"PQC_MLKEM":                 true,
+	"MODE":                      true,
+	"GRACE_INTERVALS":           true,
+	"GRACE_MAX_PSK_AGE":         true,
+	"REKEY_BYTES":               true,
+	"MAX_PSK_AGE":               true,
+	"STARTUP_POLICY":            true,
+	"SHUTDOWN_POLICY":           true,
+	"RATE_LIMIT":                true,
+	"RATE_WINDOW":               true,
+	"MAX_CLOCK_SKEW":            true,
+	"METRICS_ADDRESS":           true,
+	"HEALTH_ADDRESS":            true,
+	"READY_INTERVALS":           true,
+	"LOG_LEVEL":                 true,
+	"LOG_FORMAT":                true,
+}
+
+// peerFileKeys lists the settings accepted for an entry of the peers list,
+// they map to the PEER_<NAME>_<KEY> environment variables.
+var peerFileKeys = map[string]bool{
+	"ARNIKA_PSK":                true,
+	"SERVER_ADDRESS":            true,
+	"QKD_SOURCE":                true,
+	"KMS_URL":                   true,
+	"KMS_REQUEST_METHOD":        true,
+	"INTERVAL":                  true,
+	"KMS_RETRY_INTERVAL":        true,
+	"WIREGUARD_INTERFACE":       true,
+	"WIREGUARD_PEER_PUBLIC_KEY": true,
+	"PQC_SOURCE":                true,
+	"PQC_PSK_FILE":              true,
+	"PQC_MAX_KEY_AGE":           true,
+	"PQC_MLKEM":                 true,
+	"MODE":                      true,
+	"GRACE_INTERVALS":           true,
+	"GRACE_MAX_PSK_AGE":         true,
+	"REKEY_BYTES":               true,
+	"MAX_PSK_AGE":               true,
+	"STARTUP_POLICY":            true,
+	"SHUTDOWN_POLICY":           true,
+}
+
+// source holds the values of a configuration file keyed by environment variable
+// name. Environment variables always take precedence over file values.
+type source map[string]string
+
+// getOrDefault returns the environment variable named by key, the file value
+// if the variable is not set, or defaultValue if neither is present.
+func (s source) getOrDefault(key, defaultValue string) string {
+	if v := s[key]; v != "" {
+		defaultValue = v
+	}
+	return getEnvOrDefault(key, defaultValue)
+}
+
+// get returns the environment variable or file value named by key and fails if neither is present.
+func (s source) get(key string) (string, error) {
+	if v := s.getOrDefault(key, ""); v != "" {
+		return v, nil
+	}
+	return getEnv(key)
+}
+
+// getPeer retrieves a peer specific value. The value is mandatory unless
+// multiple peers are configured, in which case it only provides the default
+// for PEER_<NAME>_<KEY>.
+func (s source) getPeer(key string, multiPeer bool) (string, error) {
+	if multiPeer {
+		return s.getOrDefault(key, ""), nil
+	}
+	return s.get(key)
+}
+
+// ParseFile parses the YAML configuration file at path and returns a Config pointer.
+// Environment variables override individual values of the file, validation is
+// identical to Parse.
+//
+// Parameters:
+// - path: the path of the YAML configuration file.
+//
+// Returns a pointer to a Config struct and an error.
+func ParseFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to read config file: %w", err)
+	}
+	src, err := parseSource(data)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to parse config file %s: %w", path, err)
+	}
+	return parse(src)
+}
+
+// parseSource flattens the YAML document into environment variable names.
+//
+// Example:
+//
+//	listen_address: 10.0.0.1:9999
+//	peers:
+//	  - name: spoke1
+//	    server_address: 10.0.1.1:9999
+//
+// results in LISTEN_ADDRESS, PEERS=spoke1 and PEER_SPOKE1_SERVER_ADDRESS.
+func parseSource(data []byte) (source, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	src := source{}
+	for key, value := range doc {
+		name := strings.ToUpper(key)
+		if name == "PEERS" {
+			if err := src.addPeers(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !fileKeys[name] {
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+		v, err := scalar(key, value)
+		if err != nil {
+			return nil, err
+		}
+		src[name] = v
+	}
+	return src, nil
+}
+
+func (s source) addPeers(value any) error {
+	entries, ok := value.([]any)
+	if !ok {
+		return fmt.Errorf("peers must be a list")
+	}
+	names := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		fields, ok := entry.(map[string]any)
+		if !ok {
+			return fmt.Errorf("peers[%d] must be a mapping", i)
+		}
+		name, err := scalar("name", fields["name"])
+		if err != nil || name == "" {
+			return fmt.Errorf("peers[%d] requires a name", i)
+		}
+		names = append(names, name)
+		prefix := "PEER_" + strings.ToUpper(name) + "_"
+		for key, value := range fields {
+			if key == "name" {
+				continue
+			}
+			if !peerFileKeys[strings.ToUpper(key)] {
+				return fmt.Errorf("unknown setting %q for peer %s", key, name)
+			}
+			v, err := scalar(key, value)
+			if err != nil {
+				return err
+			}
+			s[prefix+strings.ToUpper(key)] = v
+		}
+	}
+	s["PEERS"] = strings.Join(names, ",")
+	return nil
+}
+
+// scalar converts a YAML scalar into the string representation used by environment variables.
+func scalar(key string, value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int, bool, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("setting %q must be a scalar value", key)
+	}
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "arnika.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestParseFile(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_address: 127.0.0.1:8080
+server_address: 127.0.0.1:8081
+kms_url: https://example.com
+wireguard_interface: wg0
+wireguard_peer_public_key: H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=
+interval: 2m
+rate_limit: 10
+mode: EitherQkdOrPqcRequired
+`)
+	cfg, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.ListenAddress != "127.0.0.1:8080" || cfg.ArnikaID != "8080" {
+		t.Errorf("Unexpected listen address %s or ArnikaID %s", cfg.ListenAddress, cfg.ArnikaID)
+	}
+	if cfg.Interval != 2*time.Minute || cfg.KMSRetryInterval != time.Minute {
+		t.Errorf("Unexpected interval %s or retry interval %s", cfg.Interval, cfg.KMSRetryInterval)
+	}
+	if cfg.RateLimit != 10 || cfg.Mode != "EitherQkdOrPqcRequired" {
+		t.Errorf("Unexpected rate limit %d or mode %s", cfg.RateLimit, cfg.Mode)
+	}
+
+	// Environment variables override file values
+	t.Setenv("MODE", "AtLeastQkdRequired")
+	t.Setenv("INTERVAL", "30s")
+	cfg, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Mode != "AtLeastQkdRequired" || cfg.Interval != 30*time.Second {
+		t.Errorf("Expected environment to override file, got mode %s and interval %s", cfg.Mode, cfg.Interval)
+	}
+}
+
+func TestParseFile_Validation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing mandatory", "listen_address: 127.0.0.1:8080\n"},
+		{"unknown setting", "listen_addres: 127.0.0.1:8080\n"},
+		{"invalid mode", "listen_address: 127.0.0.1:8080\nserver_address: 127.0.0.1:8081\nkms_url: https://example.com\nwireguard_interface: wg0\nwireguard_peer_public_key: key\nmode: invalid\n"},
+		{"invalid arnika id", "listen_address: 127.0.0.1:8080\nserver_address: 127.0.0.1:8081\nkms_url: https://example.com\nwireguard_interface: wg0\nwireguard_peer_public_key: key\narnika_id: 123456\n"},
+		{"missing pqc file", "listen_address: 127.0.0.1:8080\nserver_address: 127.0.0.1:8081\nkms_url: https://example.com\nwireguard_interface: wg0\nwireguard_peer_public_key: key\nmode: AtLeastPqcRequired\n"},
+		{"peers not a list", "listen_address: 127.0.0.1:8080\npeers: spoke1\n"},
+		{"peer without name", "listen_address: 127.0.0.1:8080\npeers:\n  - server_address: 10.0.0.1:9999\n"},
+		{"unknown peer setting", "listen_address: 127.0.0.1:8080\npeers:\n  - name: spoke1\n    rate_limit: 3\n"},
+		{"invalid yaml", "listen_address: [\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseFile(writeConfigFile(t, tt.content)); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	if _, err := ParseFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected an error for missing config file")
+	}
+}
+
+func TestParseFile_PQCFilePermissions(t *testing.T) {
+	insecureFile := filepath.Join(t.TempDir(), "insecure.key")
+	if err := os.WriteFile(insecureFile, []byte("dGVzdGtleQ=="), 0644); err != nil {
+		t.Fatalf("failed to create insecure key file: %v", err)
+	}
+	path := writeConfigFile(t, `
+listen_address: 127.0.0.1:8080
+server_address: 127.0.0.1:8081
+kms_url: https://example.com
+wireguard_interface: wg0
+wireguard_peer_public_key: H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=
+pqc_psk_file: `+insecureFile+"\n")
+	if _, err := ParseFile(path); err == nil {
+		t.Error("Expected an error for insecure permissions (0644)")
+	}
+}
+
+func TestParseFile_Peers(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_address: 127.0.0.1:8080
+kms_url: https://kms.example.com/api/v1/keys
+wireguard_interface: wg0
+peers:
+  - name: spoke1
+    server_address: 10.0.0.1:9999
+    arnika_psk: psk-spoke1
+    wireguard_peer_public_key: H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=
+  - name: spoke2
+    server_address: 10.0.0.2:9999
+    arnika_psk: psk-spoke2
+    wireguard_peer_public_key: mJNYzLNLRCl9jRRkP/Qsa74v4bem4BC+KbqQz+Ft9lQ=
+    interval: 30s
+`)
+	t.Setenv("PEER_SPOKE1_KMS_URL", "https://kms.example.com/api/v1/keys/SPOKE1")
+	cfg, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cfg.Peers) != 2 || cfg.Peers[0].Name != "spoke1" || cfg.Peers[1].Name != "spoke2" {
+		t.Fatalf("Unexpected peers %#v", cfg.Peers)
+	}
+	if cfg.Peers[0].KMSURL != "https://kms.example.com/api/v1/keys/SPOKE1" {
+		t.Errorf("Expected environment to override peer KMS URL, got %s", cfg.Peers[0].KMSURL)
+	}
+	if cfg.Peers[1].KMSURL != "https://kms.example.com/api/v1/keys" || cfg.Peers[1].Interval != 30*time.Second {
+		t.Errorf("Unexpected peer spoke2 %#v", cfg.Peers[1])
+	}
+}
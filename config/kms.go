@@ -0,0 +1,65 @@
+package config
+
+import "fmt"
+
+// KMSEndpoint is a KMS base URL of a peer together with its mTLS material.
+type KMSEndpoint struct {
+	URL           string
+	Certificate   string
+	PrivateKey    string
+	CACertificate string
+}
+
+// maxKMSEndpoints is the number of KMS URLs a peer may list, the position of the
+// KMS which issued a key is sent to the BACKUP in a single byte.
+const maxKMSEndpoints = 256
+
+// KMSEndpoints returns the KMS endpoints of the ordered KMS URLs of a peer.
+// CERTIFICATE, PRIVATE_KEY and CA_CERTIFICATE are comma separated lists, the mTLS files
+// are matched to the URLs by position. A single file applies to all URLs.
+func (c *Config) KMSEndpoints(urls []string) []KMSEndpoint {
+	certs, keys, cacerts := splitList(c.Certificate), splitList(c.PrivateKey), splitList(c.CACertificate)
+	endpoints := make([]KMSEndpoint, 0, len(urls))
+	for i, url := range urls {
+		endpoints = append(endpoints, KMSEndpoint{
+			URL:           url,
+			Certificate:   listItem(certs, i),
+			PrivateKey:    listItem(keys, i),
+			CACertificate: listItem(cacerts, i),
+		})
+	}
+	return endpoints
+}
+
+// validateKMSEndpoints ensures that the mTLS files can be matched to the URIs of the
+// QKD key source of peer.
+func (c *Config) validateKMSEndpoints(peer *Peer) error {
+	uris, err := SourceURIs(peer.QKDSource)
+	if err != nil {
+		return fmt.Errorf("[ERROR] invalid QKD_SOURCE: %w", err)
+	}
+	if len(uris) > maxKMSEndpoints {
+		return fmt.Errorf("[ERROR] QKD key source of peer %s lists more than %d URIs", peer.LogName(), maxKMSEndpoints)
+	}
+	for _, list := range []struct{ key, value string }{
+		{"CERTIFICATE", c.Certificate},
+		{"PRIVATE_KEY", c.PrivateKey},
+		{"CA_CERTIFICATE", c.CACertificate},
+	} {
+		if n := len(splitList(list.value)); n > 1 && n != len(uris) {
+			return fmt.Errorf("[ERROR] %s lists %d files but the QKD key source of peer %s lists %d URIs", list.key, n, peer.LogName(), len(uris))
+		}
+	}
+	return nil
+}
+
+// listItem returns the i-th item of list, or its only item.
+func listItem(list []string, i int) string {
+	switch {
+	case len(list) == 1:
+		return list[0]
+	case i < len(list):
+		return list[i]
+	}
+	return ""
+}
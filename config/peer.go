@@ -0,0 +1,401 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// peerNamePattern restricts peer names to characters that are valid in environment variable names.
+var peerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Peer contains the per-peer configuration values. Every Peer runs its own role
+// election, UDP key exchange and PSK pipeline.
+//
+// Values that are not set for a peer are inherited from the top level Config.
+type Peer struct {
+	Name                   string        // entry of PEERS, empty for the implicit single peer
+	ArnikaID               string        // inherited from ARNIKA_ID
+	ArnikaPSK              string        // PEER_<NAME>_ARNIKA_PSK, PSK to authenticate with the peer
+	ServerAddress          string        // PEER_<NAME>_SERVER_ADDRESS, Address of the arnika peer
+	QKDSource              string        // PEER_<NAME>_QKD_SOURCE, URIs of the QKD key source, see Config.QKDSource
+	KMSURL                 string        // PEER_<NAME>_KMS_URL, URL of the KMS SAE for this peer
+	KMSRequestMethod       string        // PEER_<NAME>_KMS_REQUEST_METHOD, HTTP method for enc_keys and dec_keys of all KMS URLs of the peer
+	Interval               time.Duration // PEER_<NAME>_INTERVAL, Interval between key updates
+	KMSRetryInterval       time.Duration // PEER_<NAME>_KMS_RETRY_INTERVAL, Interval between KMS request retries
+	WireGuardInterface     string        // PEER_<NAME>_WIREGUARD_INTERFACE, Name of the WireGuard interface
+	WireguardPeerPublicKey string        // PEER_<NAME>_WIREGUARD_PEER_PUBLIC_KEY, Public key of the WireGuard peer
+	PQCSource              string        // PEER_<NAME>_PQC_SOURCE, URI of the PQC key source, see Config.PQCSource
+	PQCPSKFile             string        // PEER_<NAME>_PQC_PSK_FILE, Path to the PQC PSK file
+	PQCMaxKeyAge           time.Duration // PEER_<NAME>_PQC_MAX_KEY_AGE, Maximum time the PQC key file may stay unchanged
+	PQCMLKEM               int           // PEER_<NAME>_PQC_MLKEM, ML-KEM parameter set of the built-in PQC key exchange
+	Mode                   string        // PEER_<NAME>_MODE, Operation mode
+	GraceIntervals         int           // PEER_<NAME>_GRACE_INTERVALS, Consecutive failed intervals tolerated before invalidation
+	GraceMaxPSKAge         time.Duration // PEER_<NAME>_GRACE_MAX_PSK_AGE, Maximum age of the PSK kept during the grace period
+	RekeyBytes             int64         // PEER_<NAME>_REKEY_BYTES, Traffic volume after which the PSK is rotated early
+	MaxPSKAge              time.Duration // PEER_<NAME>_MAX_PSK_AGE, Maximum age of the installed PSK before invalidation
+	StartupPolicy          string        // PEER_<NAME>_STARTUP_POLICY, PSK handling on startup
+	ShutdownPolicy         string        // PEER_<NAME>_SHUTDOWN_POLICY, PSK handling on shutdown
+}
+
+// Values of STARTUP_POLICY and SHUTDOWN_POLICY. PolicyKeep leaves the installed PSK
+// untouched, so the tunnel keeps working while Arnika is restarted. PolicyInvalidate
+// replaces it with a random PSK.
+const (
+	PolicyKeep       = "keep"
+	PolicyInvalidate = "invalidate"
+)
+
+// UsePQC returns true if a PQC key source is configured for the peer.
+func (p *Peer) UsePQC() bool {
+	return p.PQCSource != "" || p.PQCPSKFile != "" || p.PQCMLKEM != 0
+}
+
+func (p *Peer) IsPQCRequired() bool {
+	return isPQCRequired(p.Mode)
+}
+
+func (p *Peer) IsQKDRequired() bool {
+	return isQKDRequired(p.Mode)
+}
+
+// ElectPrimary computes the role of this node for the given interval once both nodes
+// know each others rank. HMAC-SHA256(ArnikaPSK, intervalNum) selects whether the lower
+// or the higher ranked node is PRIMARY, so exactly one of both nodes is PRIMARY.
+func (p *Peer) ElectPrimary(intervalNum uint64, lowerRank bool) bool {
+	return (electionHash(p.ArnikaPSK, intervalNum)[0]&1 == 0) == lowerRank
+}
+
+// EpochInterval returns the number of the interval t falls into, counted from the
+// unix epoch. Nodes with synchronized clocks agree on it, also across restarts.
+func (p *Peer) EpochInterval(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(p.Interval))
+}
+
+// IntervalStart returns the start time of the epoch interval intervalNum.
+func (p *Peer) IntervalStart(intervalNum uint64) time.Time {
+	return time.Unix(0, int64(intervalNum)*int64(p.Interval))
+}
+
+// LogName returns the identifier used in log prefixes, e.g. "9999" or "9999/spoke1".
+func (p *Peer) LogName() string {
+	if p.Name == "" {
+		return p.ArnikaID
+	}
+	return p.ArnikaID + "/" + p.Name
+}
+
+func isPQCRequired(mode string) bool {
+	return mode == "QkdAndPqcRequired" || mode == "AtLeastPqcRequired"
+}
+
+func isQKDRequired(mode string) bool {
+	return mode == "QkdAndPqcRequired" || mode == "AtLeastQkdRequired"
+}
+
+// electionHash returns HMAC-SHA256(psk, intervalNum).
+func electionHash(psk string, intervalNum uint64) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], intervalNum)
+	mac.Write(buf[:])
+	return mac.Sum(nil)
+}
+
+func validateMode(mode string) error {
+	if mode != "QkdAndPqcRequired" && mode != "AtLeastQkdRequired" && mode != "AtLeastPqcRequired" && mode != "EitherQkdOrPqcRequired" {
+		return fmt.Errorf("[ERROR] invalid MODE value: %s", mode)
+	}
+	return nil
+}
+
+// validateMaxPSKAge checks that MAX_PSK_AGE leaves room for at least one rotation.
+func validateMaxPSKAge(maxAge, interval time.Duration) error {
+	if maxAge < 0 {
+		return fmt.Errorf("[ERROR] MAX_PSK_AGE must not be negative, got: %s", maxAge)
+	}
+	if maxAge > 0 && maxAge <= interval {
+		return fmt.Errorf("[ERROR] MAX_PSK_AGE %s must be longer than INTERVAL %s", maxAge, interval)
+	}
+	return nil
+}
+
+// validateMLKEM checks the ML-KEM parameter set of PQC_MLKEM. The exchange replaces the
+// PQC PSK file, so only one of them may be set.
+func validateMLKEM(level int, pqcFile string) error {
+	if level != 0 && level != 768 && level != 1024 {
+		return fmt.Errorf("[ERROR] invalid PQC_MLKEM value: %d, must be 768 or 1024", level)
+	}
+	if level != 0 && pqcFile != "" {
+		return fmt.Errorf("[ERROR] PQC_PSK_FILE and PQC_MLKEM must not be set both")
+	}
+	return nil
+}
+
+// validatePolicy checks the value of STARTUP_POLICY or SHUTDOWN_POLICY named by key.
+func validatePolicy(key, policy string) error {
+	if policy != PolicyKeep && policy != PolicyInvalidate {
+		return fmt.Errorf("[ERROR] invalid %s value: %s", key, policy)
+	}
+	return nil
+}
+
+func validateKMSRequestMethod(method string) error {
+	if method != "auto" && method != "post" && method != "get" {
+		return fmt.Errorf("[ERROR] invalid KMS_REQUEST_METHOD value: %s", method)
+	}
+	return nil
+}
+
+// ValidatePQCFile checks that the PQC PSK file exists and is not accessible by group or others.
+func ValidatePQCFile(path string) error {
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("[ERROR] failed to open PQC PSK file: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("[ERROR] failed to stat PQC PSK file: %w", err)
+	}
+	perms := fileInfo.Mode().Perm()
+	if perms&0077 != 0 {
+		return fmt.Errorf("[ERROR] PQC PSK file has insecure permissions %o: must be 0600 or stricter", perms)
+	}
+	return nil
+}
+
+// defaultPeer returns the implicit single peer built from the top level Config.
+func (c *Config) defaultPeer() Peer {
+	return Peer{
+		ArnikaID:               c.ArnikaID,
+		ArnikaPSK:              c.ArnikaPSK,
+		ServerAddress:          c.ServerAddress,
+		QKDSource:              c.QKDSource,
+		KMSURL:                 c.KMSURL,
+		KMSRequestMethod:       c.KMSRequestMethod,
+		Interval:               c.Interval,
+		KMSRetryInterval:       c.KMSRetryInterval,
+		WireGuardInterface:     c.WireGuardInterface,
+		WireguardPeerPublicKey: c.WireguardPeerPublicKey,
+		PQCSource:              c.PQCSource,
+		PQCPSKFile:             c.PQCPSKFile,
+		PQCMaxKeyAge:           c.PQCMaxKeyAge,
+		PQCMLKEM:               c.PQCMLKEM,
+		Mode:                   c.Mode,
+		GraceIntervals:         c.GraceIntervals,
+		GraceMaxPSKAge:         c.GraceMaxPSKAge,
+		RekeyBytes:             c.RekeyBytes,
+		MaxPSKAge:              c.MaxPSKAge,
+		StartupPolicy:          c.StartupPolicy,
+		ShutdownPolicy:         c.ShutdownPolicy,
+	}
+}
+
+// parsePeers reads the peers listed in PEERS from PEER_<NAME>_* environment variables.
+// Without PEERS the top level configuration is used as the only peer.
+func (c *Config) parsePeers(src source) ([]Peer, error) {
+	names := splitList(src.getOrDefault("PEERS", ""))
+	if len(names) == 0 {
+		peer := c.defaultPeer()
+		if err := peer.resolveSources(); err != nil {
+			return nil, err
+		}
+		return []Peer{peer}, nil
+	}
+	peers := make([]Peer, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !peerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("[ERROR] invalid peer name %q in PEERS", name)
+		}
+		if seen[strings.ToUpper(name)] {
+			return nil, fmt.Errorf("[ERROR] duplicate peer name %q in PEERS", name)
+		}
+		seen[strings.ToUpper(name)] = true
+		peer, err := c.parsePeer(src, name)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+	if err := validatePeers(peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+func (c *Config) parsePeer(src source, name string) (Peer, error) {
+	prefix := "PEER_" + strings.ToUpper(name) + "_"
+	peer := c.defaultPeer()
+	peer.Name = name
+	peer.ArnikaPSK = src.getOrDefault(prefix+"ARNIKA_PSK", c.ArnikaPSK)
+	peer.ServerAddress = src.getOrDefault(prefix+"SERVER_ADDRESS", c.ServerAddress)
+	peer.KMSURL = src.getOrDefault(prefix+"KMS_URL", c.KMSURL)
+	// A key source setting of the peer overrides the key source URI of the top level
+	peer.QKDSource = src.getOrDefault(prefix+"QKD_SOURCE", "")
+	if peer.QKDSource == "" && src.getOrDefault(prefix+"KMS_URL", "") == "" {
+		peer.QKDSource = c.QKDSource
+	}
+	peer.KMSRequestMethod = src.getOrDefault(prefix+"KMS_REQUEST_METHOD", c.KMSRequestMethod)
+	peer.WireGuardInterface = src.getOrDefault(prefix+"WIREGUARD_INTERFACE", c.WireGuardInterface)
+	peer.WireguardPeerPublicKey = src.getOrDefault(prefix+"WIREGUARD_PEER_PUBLIC_KEY", c.WireguardPeerPublicKey)
+	peer.PQCPSKFile = src.getOrDefault(prefix+"PQC_PSK_FILE", c.PQCPSKFile)
+	peer.PQCSource = src.getOrDefault(prefix+"PQC_SOURCE", "")
+	if peer.PQCSource == "" && src.getOrDefault(prefix+"PQC_PSK_FILE", "") == "" && src.getOrDefault(prefix+"PQC_MLKEM", "") == "" {
+		peer.PQCSource = c.PQCSource
+	}
+	peer.Mode = src.getOrDefault(prefix+"MODE", c.Mode)
+	peer.StartupPolicy = src.getOrDefault(prefix+"STARTUP_POLICY", c.StartupPolicy)
+	peer.ShutdownPolicy = src.getOrDefault(prefix+"SHUTDOWN_POLICY", c.ShutdownPolicy)
+	var err error
+	peer.Interval, err = time.ParseDuration(src.getOrDefault(prefix+"INTERVAL", c.Interval.String()))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sINTERVAL: %w", prefix, err)
+	}
+	retryDefault := c.KMSRetryInterval.String()
+	if src.getOrDefault("KMS_RETRY_INTERVAL", "") == "" {
+		retryDefault = (peer.Interval / 2).String()
+	}
+	peer.KMSRetryInterval, err = time.ParseDuration(src.getOrDefault(prefix+"KMS_RETRY_INTERVAL", retryDefault))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sKMS_RETRY_INTERVAL: %w", prefix, err)
+	}
+	peer.PQCMaxKeyAge, err = time.ParseDuration(src.getOrDefault(prefix+"PQC_MAX_KEY_AGE", c.PQCMaxKeyAge.String()))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sPQC_MAX_KEY_AGE: %w", prefix, err)
+	}
+	if peer.PQCMaxKeyAge < 0 {
+		return Peer{}, fmt.Errorf("[ERROR] %sPQC_MAX_KEY_AGE must not be negative, got: %s", prefix, peer.PQCMaxKeyAge)
+	}
+	peer.PQCMLKEM, err = strconv.Atoi(src.getOrDefault(prefix+"PQC_MLKEM", strconv.Itoa(c.PQCMLKEM)))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sPQC_MLKEM: %w", prefix, err)
+	}
+	if err := validateMLKEM(peer.PQCMLKEM, peer.PQCPSKFile); err != nil {
+		return Peer{}, fmt.Errorf("%w for peer %s", err, name)
+	}
+	if err := peer.resolveSources(); err != nil {
+		return Peer{}, fmt.Errorf("%w for peer %s", err, name)
+	}
+	peer.GraceIntervals, err = strconv.Atoi(src.getOrDefault(prefix+"GRACE_INTERVALS", strconv.Itoa(c.GraceIntervals)))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sGRACE_INTERVALS: %w", prefix, err)
+	}
+	if peer.GraceIntervals < 0 {
+		return Peer{}, fmt.Errorf("[ERROR] %sGRACE_INTERVALS must not be negative, got: %d", prefix, peer.GraceIntervals)
+	}
+	peer.GraceMaxPSKAge, err = time.ParseDuration(src.getOrDefault(prefix+"GRACE_MAX_PSK_AGE", c.GraceMaxPSKAge.String()))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sGRACE_MAX_PSK_AGE: %w", prefix, err)
+	}
+	if peer.GraceMaxPSKAge < 0 {
+		return Peer{}, fmt.Errorf("[ERROR] %sGRACE_MAX_PSK_AGE must not be negative, got: %s", prefix, peer.GraceMaxPSKAge)
+	}
+	peer.RekeyBytes, err = parseBytes(src.getOrDefault(prefix+"REKEY_BYTES", strconv.FormatInt(c.RekeyBytes, 10)))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sREKEY_BYTES: %w", prefix, err)
+	}
+	peer.MaxPSKAge, err = time.ParseDuration(src.getOrDefault(prefix+"MAX_PSK_AGE", c.MaxPSKAge.String()))
+	if err != nil {
+		return Peer{}, fmt.Errorf("[ERROR] failed to parse %sMAX_PSK_AGE: %w", prefix, err)
+	}
+	if err := validateMaxPSKAge(peer.MaxPSKAge, peer.Interval); err != nil {
+		return Peer{}, fmt.Errorf("%w for peer %s", err, name)
+	}
+	for _, required := range []struct{ key, value string }{
+		{"SERVER_ADDRESS", peer.ServerAddress},
+		{"KMS_URL", peer.QKDSource},
+		{"WIREGUARD_INTERFACE", peer.WireGuardInterface},
+		{"WIREGUARD_PEER_PUBLIC_KEY", peer.WireguardPeerPublicKey},
+	} {
+		if required.value == "" {
+			return Peer{}, fmt.Errorf("[ERROR] failed to get environment variable: %s%s", prefix, required.key)
+		}
+	}
+	if err := validateMode(peer.Mode); err != nil {
+		return Peer{}, err
+	}
+	if err := validateKMSRequestMethod(peer.KMSRequestMethod); err != nil {
+		return Peer{}, err
+	}
+	if err := validatePolicy("STARTUP_POLICY", peer.StartupPolicy); err != nil {
+		return Peer{}, err
+	}
+	if err := validatePolicy("SHUTDOWN_POLICY", peer.ShutdownPolicy); err != nil {
+		return Peer{}, err
+	}
+	if peer.PQCPSKFile != "" && peer.PQCPSKFile != c.PQCPSKFile {
+		if err := ValidatePQCFile(peer.PQCPSKFile); err != nil {
+			return Peer{}, err
+		}
+	}
+	if !peer.UsePQC() && peer.IsPQCRequired() {
+		return Peer{}, fmt.Errorf("[ERROR] PQC PSK file missing for peer %s as MODE is %s", name, peer.Mode)
+	}
+	return peer, nil
+}
+
+// validatePeers ensures that incoming packets can be attributed to exactly one peer
+// and that no two peers manage the same WireGuard peer.
+func validatePeers(peers []Peer) error {
+	psks := make(map[string]string)
+	wgPeers := make(map[string]string)
+	for _, peer := range peers {
+		if peer.ArnikaPSK == "" {
+			return fmt.Errorf("[ERROR] ARNIKA_PSK is required for peer %s when multiple peers are configured", peer.Name)
+		}
+		if other, ok := psks[peer.ArnikaPSK]; ok {
+			return fmt.Errorf("[ERROR] peers %s and %s share the same ARNIKA_PSK", other, peer.Name)
+		}
+		psks[peer.ArnikaPSK] = peer.Name
+		wgPeer := peer.WireGuardInterface + "/" + peer.WireguardPeerPublicKey
+		if other, ok := wgPeers[wgPeer]; ok {
+			return fmt.Errorf("[ERROR] peers %s and %s manage the same WireGuard peer", other, peer.Name)
+		}
+		wgPeers[wgPeer] = peer.Name
+	}
+	return nil
+}
+
+// byteUnits are the binary multiples accepted as suffix of a byte size.
+var byteUnits = []struct {
+	suffix string
+	factor int64
+}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}}
+
+// parseBytes parses a non-negative byte size with an optional K, M, G or T suffix
+// (binary multiples), e.g. "512M" or "1073741824".
+func parseBytes(s string) (int64, error) {
+	factor := int64(1)
+	for _, unit := range byteUnits {
+		if rest, ok := strings.CutSuffix(strings.ToUpper(s), unit.suffix); ok {
+			s, factor = rest, unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64/factor {
+		return 0, fmt.Errorf("byte size out of range: %s", s)
+	}
+	return n * factor, nil
+}
+
+// splitList splits a comma separated list and drops empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
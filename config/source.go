@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Schemes of the key sources the dedicated settings KMS_URL, PQC_PSK_FILE and PQC_MLKEM
+// are mapped to. Key source URIs are interpreted by the provider registry only.
+const (
+	SchemeETSI014     = "etsi014+https"
+	SchemeETSI014HTTP = "etsi014+http"
+	SchemeFile        = "file"
+	SchemeMLKEM       = "mlkem"
+)
+
+// etsi014Prefix turns a KMS URL into an ETSI 014 key source URI.
+const etsi014Prefix = "etsi014+"
+
+// SourceURIs parses a comma separated list of key source URIs. All URIs must have the
+// same scheme.
+func SourceURIs(source string) ([]*url.URL, error) {
+	var uris []*url.URL
+	for _, item := range splitList(source) {
+		uri, err := url.Parse(item)
+		if err != nil {
+			return nil, err
+		}
+		if uri.Scheme == "" {
+			return nil, fmt.Errorf("missing scheme in %q", item)
+		}
+		if len(uris) > 0 && uri.Scheme != uris[0].Scheme {
+			return nil, fmt.Errorf("key sources of different schemes %s and %s", uris[0].Scheme, uri.Scheme)
+		}
+		uris = append(uris, uri)
+	}
+	return uris, nil
+}
+
+// resolveSources sets the key source URIs of the peer. QKD_SOURCE and PQC_SOURCE take
+// precedence, otherwise they are derived from KMS_URL and from PQC_PSK_FILE or
+// PQC_MLKEM. The URIs are only checked for syntax here, their provider validates them
+// once the key source is opened.
+func (p *Peer) resolveSources() error {
+	if p.QKDSource == "" {
+		var sources []string
+		for _, kmsURL := range splitList(p.KMSURL) {
+			sources = append(sources, etsi014Prefix+kmsURL)
+		}
+		p.QKDSource = strings.Join(sources, ",")
+	} else if _, err := SourceURIs(p.QKDSource); err != nil {
+		return fmt.Errorf("[ERROR] invalid QKD_SOURCE: %w", err)
+	}
+	if p.PQCSource == "" {
+		switch {
+		case p.PQCMLKEM != 0:
+			p.PQCSource = mlkemURI(p.PQCMLKEM)
+		case p.PQCPSKFile != "":
+			path, err := filepath.Abs(p.PQCPSKFile)
+			if err != nil {
+				return fmt.Errorf("[ERROR] invalid PQC_PSK_FILE: %w", err)
+			}
+			p.PQCSource = (&url.URL{Scheme: SchemeFile, Path: path}).String()
+		}
+		return nil
+	}
+	uris, err := SourceURIs(p.PQCSource)
+	if err != nil {
+		return fmt.Errorf("[ERROR] invalid PQC_SOURCE: %w", err)
+	}
+	if len(uris) != 1 {
+		return fmt.Errorf("[ERROR] PQC_SOURCE must be a single URI, got: %s", p.PQCSource)
+	}
+	return nil
+}
+
+// mlkemURI returns the ML-KEM key source URI of PQC_MLKEM.
+func mlkemURI(level int) string {
+	return fmt.Sprintf("%s://peer?level=%d", SchemeMLKEM, level)
+}
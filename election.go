@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/arnika-project/arnika/auth"
+)
+
+// rank orders the two nodes of a peering for the role election. The nonce is chosen
+// at startup and breaks the tie between equal Arnika IDs, a restarted node gets a new rank.
+type rank struct {
+	id    uint64
+	nonce uint64
+}
+
+func (a rank) less(b rank) bool {
+	if a.id != b.id {
+		return a.id < b.id
+	}
+	return a.nonce < b.nonce
+}
+
+// parseRank builds the rank received in a HELLO packet.
+func parseRank(arnikaID string, nonce uint64) (rank, error) {
+	id, err := strconv.ParseUint(arnikaID, 10, 64)
+	if err != nil {
+		return rank{}, fmt.Errorf("invalid Arnika ID %q", arnikaID)
+	}
+	return rank{id: id, nonce: nonce}, nil
+}
+
+// election holds the ranks of both nodes of a peering. As long as the remote rank is
+// unknown this node stays BACKUP. After the remote node left
+// with a BYE this node takes over the PRIMARY role until the remote node is back.
+type election struct {
+	arnikaID string
+	self     rank
+
+	mu     sync.Mutex
+	remote rank
+	known  bool
+	left   bool
+}
+
+func newElection(arnikaID string) (*election, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate election nonce: %w", err)
+	}
+	self, err := parseRank(arnikaID, binary.BigEndian.Uint64(buf[:]))
+	if err != nil {
+		return nil, err
+	}
+	return &election{arnikaID: arnikaID, self: self}, nil
+}
+
+// hello returns the plaintext of the HELLO packet announcing our rank.
+func (e *election) hello() []byte {
+	return auth.EncodeHello(e.arnikaID, e.self.nonce)
+}
+
+// nonce returns the election nonce of this node, which identifies it as sender of
+// DATA and KEM packets.
+func (e *election) nonce() uint64 {
+	return e.self.nonce
+}
+
+// isSelf reports whether remote is the rank of this node, i.e. a packet of this node
+// was reflected back to it.
+func (e *election) isSelf(remote rank) bool {
+	return remote == e.self
+}
+
+// bye returns the plaintext of the BYE packet announcing that this node shuts down.
+func (e *election) bye(invalidated bool) []byte {
+	return auth.EncodeBye(&auth.Bye{ArnikaID: e.arnikaID, Nonce: e.self.nonce, Invalidated: invalidated})
+}
+
+// learn records the rank of the remote node and reports whether it changed. Our own
+// rank is ignored.
+func (e *election) learn(remote rank) bool {
+	if e.isSelf(remote) {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	changed := !e.known || e.remote != remote
+	e.remote = remote
+	e.known = true
+	e.left = false
+	return changed
+}
+
+// leave records that the remote node with rank remote shut down. The BYE is bound to
+// the nonce the remote node announced in its HELLO, so it is ignored while the remote
+// rank is unknown, e.g. a BYE replayed to a restarted node, if it was sent by another
+// instance than the known one, and if it is our own.
+func (e *election) leave(remote rank) bool {
+	if e.isSelf(remote) {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.known || e.remote != remote {
+		return false
+	}
+	e.known = false
+	e.left = true
+	return true
+}
+
+// remoteLeft reports whether the remote node left and has not been seen since.
+func (e *election) remoteLeft() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.left
+}
+
+// forget drops the remote rank so that it is exchanged again.
+func (e *election) forget() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.known = false
+}
+
+// lowerRank reports whether this node has the lower rank and whether the remote rank is known.
+func (e *election) lowerRank() (bool, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.self.less(e.remote), e.known
+}
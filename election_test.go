@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// testElection returns an election with a fixed rank.
+func testElection(id, nonce uint64) *election {
+	return &election{self: rank{id: id, nonce: nonce}}
+}
+
+func TestRank_Less(t *testing.T) {
+	tests := []struct {
+		a, b rank
+		want bool
+	}{
+		{rank{1, 9}, rank{2, 0}, true},
+		{rank{2, 0}, rank{1, 9}, false},
+		{rank{1, 1}, rank{1, 2}, true},
+		{rank{1, 2}, rank{1, 1}, false},
+		{rank{1, 1}, rank{1, 1}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.less(tt.b); got != tt.want {
+			t.Errorf("%v.less(%v) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseRank(t *testing.T) {
+	r, err := parseRank("9999", 7)
+	if err != nil || r != (rank{9999, 7}) {
+		t.Fatalf("unexpected rank %v, error %v", r, err)
+	}
+	for _, id := range []string{"", "peer-a", "-1"} {
+		if _, err := parseRank(id, 1); err == nil {
+			t.Errorf("expected Arnika ID %q to be rejected", id)
+		}
+	}
+}
+
+// TestElection_ExactlyOnePrimary checks that two nodes which know each others rank never
+// take the same role, also if they share the Arnika ID.
+func TestElection_ExactlyOnePrimary(t *testing.T) {
+	peer := &config.Peer{ArnikaPSK: "psk"}
+	tests := []struct {
+		name string
+		a, b rank
+	}{
+		{"different IDs", rank{1000, 5}, rank{2000, 1}},
+		{"equal IDs", rank{1000, 5}, rank{1000, 6}},
+	}
+	for _, tt := range tests {
+		a, b := testElection(tt.a.id, tt.a.nonce), testElection(tt.b.id, tt.b.nonce)
+		a.learn(tt.b)
+		b.learn(tt.a)
+		lowerA, knownA := a.lowerRank()
+		lowerB, knownB := b.lowerRank()
+		if !knownA || !knownB || lowerA == lowerB {
+			t.Fatalf("%s: expected exactly one node with the lower rank", tt.name)
+		}
+		for interval := uint64(0); interval < 64; interval++ {
+			if peer.ElectPrimary(interval, lowerA) == peer.ElectPrimary(interval, lowerB) {
+				t.Fatalf("%s: both nodes took the same role in interval %d", tt.name, interval)
+			}
+		}
+	}
+}
+
+func TestElection_Transitions(t *testing.T) {
+	self := rank{1000, 5}
+	remote := rank{2000, 1}
+	restarted := rank{2000, 2}
+	tests := []struct {
+		name  string
+		steps func(e *election) bool
+		want  bool // result of the last step
+		known bool
+		left  bool
+		lower bool
+	}{
+		{
+			name:  "learn unknown rank",
+			steps: func(e *election) bool { return e.learn(remote) },
+			want:  true, known: true, lower: true,
+		},
+		{
+			name:  "learn known rank again",
+			steps: func(e *election) bool { e.learn(remote); return e.learn(remote) },
+			want:  false, known: true, lower: true,
+		},
+		{
+			name:  "learn rank of restarted node",
+			steps: func(e *election) bool { e.learn(remote); return e.learn(restarted) },
+			want:  true, known: true, lower: true,
+		},
+		{
+			name:  "learn own rank",
+			steps: func(e *election) bool { return e.learn(self) },
+			want:  false,
+		},
+		{
+			name:  "leave known node",
+			steps: func(e *election) bool { e.learn(remote); return e.leave(remote) },
+			want:  true, left: true,
+		},
+		{
+			name:  "leave unknown node",
+			steps: func(e *election) bool { return e.leave(remote) },
+			want:  false,
+		},
+		{
+			name:  "leave after forget",
+			steps: func(e *election) bool { e.learn(remote); e.forget(); return e.leave(remote) },
+			want:  false,
+		},
+		{
+			name:  "leave twice",
+			steps: func(e *election) bool { e.learn(remote); e.leave(remote); return e.leave(remote) },
+			want:  false, left: true,
+		},
+		{
+			name:  "leave earlier instance",
+			steps: func(e *election) bool { e.learn(restarted); return e.leave(remote) },
+			want:  false, known: true, lower: true,
+		},
+		{
+			name:  "leave with own rank",
+			steps: func(e *election) bool { e.learn(remote); return e.leave(self) },
+			want:  false, known: true, lower: true,
+		},
+		{
+			name:  "learn after leave",
+			steps: func(e *election) bool { e.learn(remote); e.leave(remote); return e.learn(restarted) },
+			want:  true, known: true, lower: true,
+		},
+		{
+			name:  "forget",
+			steps: func(e *election) bool { e.learn(remote); e.forget(); return e.learn(remote) },
+			want:  true, known: true, lower: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testElection(self.id, self.nonce)
+			if got := tt.steps(e); got != tt.want {
+				t.Errorf("last step returned %t, want %t", got, tt.want)
+			}
+			lower, known := e.lowerRank()
+			if known != tt.known {
+				t.Errorf("remote rank known %t, want %t", known, tt.known)
+			}
+			if known && lower != tt.lower {
+				t.Errorf("lower rank %t, want %t", lower, tt.lower)
+			}
+			if e.remoteLeft() != tt.left {
+				t.Errorf("remote left %t, want %t", e.remoteLeft(), tt.left)
+			}
+		})
+	}
+}
+
+// testRunner returns a peer runner with just enough state for the role election.
+func testRunner() *peerRunner {
+	return &peerRunner{
+		peer:     &config.Peer{ArnikaID: "1000", ArnikaPSK: "psk", Interval: time.Minute},
+		log:      slog.New(slog.DiscardHandler),
+		election: testElection(1000, 5),
+		skip:     make(chan bool, 1),
+	}
+}
+
+func TestIsPrimary(t *testing.T) {
+	r := testRunner()
+	for interval := uint64(0); interval < 16; interval++ {
+		if r.isPrimary(interval) {
+			t.Fatalf("expected BACKUP role in interval %d without remote rank", interval)
+		}
+	}
+	r.election.learn(rank{2000, 1})
+	for interval := uint64(0); interval < 16; interval++ {
+		if r.isPrimary(interval) != r.peer.ElectPrimary(interval, true) {
+			t.Fatalf("expected rank election in interval %d", interval)
+		}
+	}
+	r.election.leave(rank{2000, 1})
+	for interval := uint64(0); interval < 16; interval++ {
+		if !r.isPrimary(interval) {
+			t.Fatalf("expected PRIMARY role in interval %d after the remote node left", interval)
+		}
+	}
+}
+
+func TestSplitBrain_BothPrimary(t *testing.T) {
+	r := testRunner()
+	r.election.learn(rank{2000, 1})
+	r.exchanging.Store(true)
+	var class auth.ErrorClass = auth.ErrorNone
+	r.handleRequest(t.Context(), keyRequest{keyID: "key-1", reply: func(c auth.ErrorClass, _ []byte) { class = c }})
+	if class != auth.ErrorConflict {
+		t.Fatalf("expected NACK of class conflict, got %s", class)
+	}
+	if _, known := r.election.lowerRank(); known {
+		t.Fatal("expected the remote rank to be forgotten after a split brain")
+	}
+}
+
+func TestSplitBrain_NoLeader(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		role     string
+		skipped  bool // the ticker loop missed an interval
+		received bool // a key ID arrived in the previous interval
+		conflict bool
+	}{
+		{name: "BACKUP without key ID", role: metrics.RoleBackup, conflict: true},
+		{name: "BACKUP with key ID", role: metrics.RoleBackup, received: true},
+		{name: "PRIMARY", role: metrics.RolePrimary},
+		{name: "interval skipped", role: metrics.RoleBackup, skipped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner()
+			r.election.learn(rank{2000, 1})
+			prev := r.peer.EpochInterval(now)
+			if tt.skipped {
+				r.state.tick(prev-1, tt.role)
+			} else {
+				r.state.tick(prev, tt.role)
+			}
+			if tt.received {
+				r.lastRequest.Store(now.UnixNano())
+			}
+			r.detectNoLeader(prev+1, r.log)
+			if _, known := r.election.lowerRank(); known == tt.conflict {
+				t.Fatalf("expected conflict %t", tt.conflict)
+			}
+		})
+	}
+}
+
+// TestUDPPeer_Bye checks that only the BYE of the known remote instance hands the
+// PRIMARY role to this node.
+func TestUDPPeer_Bye(t *testing.T) {
+	remote := rank{2000, 1}
+	tests := []struct {
+		name  string
+		known *rank // remote rank learned from a HELLO, none if nil
+		bye   rank
+		left  bool
+	}{
+		{name: "BYE of known node", known: &remote, bye: remote, left: true},
+		{name: "BYE replayed to restarted node", bye: remote},
+		{name: "BYE of earlier instance", known: &rank{2000, 2}, bye: remote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner()
+			r.left = make(chan bool, 1)
+			if tt.known != nil {
+				r.election.learn(*tt.known)
+			}
+			var before [16]bool
+			for interval := range before {
+				before[interval] = r.isPrimary(uint64(interval))
+			}
+			p := r.udpPeer()
+			p.bye(&net.UDPAddr{}, auth.EncodeBye(&auth.Bye{ArnikaID: "2000", Nonce: tt.bye.nonce, Invalidated: true}))
+			if left := len(r.left) > 0; left != tt.left {
+				t.Fatalf("BYE handed to leftLoop %t, want %t", left, tt.left)
+			}
+			// An ignored BYE leaves the roles unchanged
+			for interval := range before {
+				want := tt.left || before[interval]
+				if r.isPrimary(uint64(interval)) != want {
+					t.Fatalf("PRIMARY %t in interval %d, want %t", !want, interval, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLeftLoop(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		invalidated bool // the remote node invalidated its PSK
+		want        int
+	}{
+		{name: "keep", policy: config.PolicyKeep},
+		{name: "remote invalidated", policy: config.PolicyKeep, invalidated: true, want: 1},
+		{name: "invalidate", policy: config.PolicyInvalidate, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner()
+			r.peer.ShutdownPolicy = tt.policy
+			r.left = make(chan bool, 1)
+			w := withWriter(r)
+			ctx, cancel := context.WithCancel(t.Context())
+			var wg sync.WaitGroup
+			wg.Go(func() { r.leftLoop(ctx) })
+			r.peerLeft(tt.invalidated)
+			if !waitFor(time.Second, func() bool { return len(r.left) == 0 }) {
+				t.Fatal("expected leftLoop to pick up the BYE")
+			}
+			// The BYE is handled completely once leftLoop returned
+			cancel()
+			wg.Wait()
+			if got := w.invalidations(); got != tt.want {
+				t.Fatalf("expected %d invalidations, got %d", tt.want, got)
+			}
+		})
+	}
+}
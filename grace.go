@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// Decisions of the grace policy, exported as label of metrics.GraceDecisions.
+const (
+	graceTolerate   = "tolerate"
+	graceInvalidate = "invalidate"
+)
+
+// grace counts the intervals in which the key exchange failed since the last PSK
+// installation. The tunnel keeps running on the previous PSK for GRACE_INTERVALS failed
+// intervals and as long as that PSK is younger than GRACE_MAX_PSK_AGE. The previous PSK
+// was derived under the configured MODE, so the grace period never lets a PSK from
+// other key sources into the tunnel.
+type grace struct {
+	mu         sync.Mutex
+	failed     int    // failed intervals since the last PSK installation
+	lastFailed uint64 // interval of the last failure
+}
+
+// fail records a failure in the epoch interval and returns the number of failed intervals.
+func (g *grace) fail(interval uint64) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failed == 0 || g.lastFailed != interval {
+		g.failed++
+		g.lastFailed = interval
+	}
+	return g.failed
+}
+
+// reset clears the failed intervals after a PSK installation.
+func (g *grace) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failed = 0
+}
+
+// graceFailed applies the grace policy to a failed key exchange, after which the nodes
+// do not share a new PSK. It either keeps the previous PSK or invalidates the tunnel.
+func (r *peerRunner) graceFailed(ctx context.Context, logger *slog.Logger, err error) {
+	name := r.peer.LogName()
+	failed := r.grace.fail(r.peer.EpochInterval(time.Now()))
+	metrics.GraceFailedIntervals.Set(float64(failed), name)
+	age, keyed := r.state.pskAge()
+	reason := ""
+	switch {
+	case isMismatch(err):
+		// Diverging PSKs point to diverging key material, they are never tolerated
+		reason = "psk_mismatch"
+	case failed > r.peer.GraceIntervals:
+		reason = "failed_intervals"
+	case r.peer.GraceMaxPSKAge > 0 && (!keyed || age > r.peer.GraceMaxPSKAge):
+		// The age of a PSK not installed by this process is unknown
+		reason = "psk_age"
+	}
+	logger = logger.With("failed_intervals", failed, "grace_intervals", r.peer.GraceIntervals)
+	if keyed {
+		logger = logger.With("psk_age", age.Truncate(time.Second))
+	}
+	if reason == "" {
+		metrics.GraceDecisions.Inc(name, graceTolerate)
+		logger.Warn("keeping previous PSK within grace period", "decision", graceTolerate)
+		return
+	}
+	metrics.GraceDecisions.Inc(name, graceInvalidate)
+	logger.Warn("grace period exhausted", "decision", graceInvalidate, "reason", reason)
+	r.invalidateTunnel(ctx, logger)
+}
+
+// isMismatch reports whether err is caused by diverging PSKs on both nodes.
+func isMismatch(err error) bool {
+	var nack *auth.NackError
+	if errors.As(err, &nack) {
+		return nack.Class == auth.ErrorMismatch
+	}
+	return errors.Is(err, errPSKMismatch) || errorClass(err) == auth.ErrorMismatch
+}
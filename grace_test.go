@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/models"
+	"github.com/arnika-project/arnika/services"
+)
+
+// fakeWriter records the PSKs and invalidations of a WireGuard peer and reports its
+// byte counters.
+type fakeWriter struct {
+	mu          sync.Mutex
+	psks        []string
+	setErr      error // returned by SetPSK
+	checkErr    error // returned by Check
+	invalidated int
+	traffic     models.Traffic
+}
+
+func (w *fakeWriter) InvalidateTunnel(context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.invalidated++
+	return nil
+}
+
+func (w *fakeWriter) SetPSK(_ context.Context, psk string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.setErr != nil {
+		return w.setErr
+	}
+	w.psks = append(w.psks, psk)
+	return nil
+}
+
+func (w *fakeWriter) installed() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.psks)
+}
+
+func (w *fakeWriter) Check(context.Context) error { return w.checkErr }
+
+func (w *fakeWriter) Traffic(context.Context) (*models.Traffic, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t := w.traffic
+	return &t, nil
+}
+
+// setTraffic sets the byte counters of the WireGuard peer.
+func (w *fakeWriter) setTraffic(receive, transmit int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.traffic = models.Traffic{ReceiveBytes: receive, TransmitBytes: transmit}
+}
+
+func (w *fakeWriter) invalidations() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.invalidated
+}
+
+// withWriter attaches a fake WireGuard peer to r.
+func withWriter(r *peerRunner) *fakeWriter {
+	w := &fakeWriter{}
+	r.keyWriter = services.NewKeyWriterService(w)
+	return w
+}
+
+func TestGrace_Fail(t *testing.T) {
+	var g grace
+	steps := []struct {
+		interval uint64
+		want     int
+	}{
+		{5, 1},
+		{5, 1}, // a retry in the same interval is not counted again
+		{6, 2},
+		{8, 3}, // skipped intervals are not counted
+		{8, 3},
+	}
+	for _, step := range steps {
+		if got := g.fail(step.interval); got != step.want {
+			t.Fatalf("fail(%d) = %d, want %d", step.interval, got, step.want)
+		}
+	}
+	g.reset()
+	if got := g.fail(8); got != 1 {
+		t.Fatalf("expected the count to restart after reset, got %d", got)
+	}
+}
+
+func TestGraceFailed(t *testing.T) {
+	errKMS := &pskError{auth.ErrorKMS, errors.New("KMS unavailable")}
+	tests := []struct {
+		name       string
+		previous   int           // failed intervals before the current one
+		pskAge     time.Duration // age of the installed PSK, none if zero
+		maxAge     time.Duration
+		err        error
+		invalidate bool
+	}{
+		{name: "first failure", pskAge: time.Minute, err: errKMS},
+		{name: "within grace intervals", previous: 1, pskAge: time.Minute, err: errKMS},
+		{name: "grace intervals exhausted", previous: 2, pskAge: time.Minute, err: errKMS, invalidate: true},
+		{name: "PSK younger than max age", pskAge: time.Minute, maxAge: time.Hour, err: errKMS},
+		{name: "PSK older than max age", pskAge: 2 * time.Hour, maxAge: time.Hour, err: errKMS, invalidate: true},
+		{name: "PSK of unknown age with max age", maxAge: time.Hour, err: errKMS, invalidate: true},
+		{name: "PSK of unknown age without max age", err: errKMS},
+		{name: "NACK mismatch", pskAge: time.Minute, err: &auth.NackError{Class: auth.ErrorMismatch}, invalidate: true},
+		{name: "ACK mismatch", pskAge: time.Minute, err: fmt.Errorf("exchange failed: %w", errPSKMismatch), invalidate: true},
+		{name: "local mismatch", pskAge: time.Minute, err: &pskError{auth.ErrorMismatch, errPSKMismatch}, invalidate: true},
+		{name: "other NACK", pskAge: time.Minute, err: &auth.NackError{Class: auth.ErrorKMS}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner()
+			r.peer.GraceIntervals = 2
+			r.peer.GraceMaxPSKAge = tt.maxAge
+			w := withWriter(r)
+			if tt.pskAge > 0 {
+				r.state.pskInstalled("key-0")
+				r.state.lastSuccess = time.Now().Add(-tt.pskAge)
+			}
+			current := r.peer.EpochInterval(time.Now())
+			for i := tt.previous; i > 0; i-- {
+				r.grace.fail(current - uint64(i))
+			}
+			r.graceFailed(t.Context(), r.log, tt.err)
+			if invalidated := w.invalidations() > 0; invalidated != tt.invalidate {
+				t.Fatalf("tunnel invalidated %t, want %t", invalidated, tt.invalidate)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arnika-project/arnika/config"
+)
+
+// udpServerRunning is true while the udpServer read loop is active.
+var udpServerRunning atomic.Bool
+
+// peerState tracks the runtime state of a peerRunner for the health endpoints.
+type peerState struct {
+	mu              sync.Mutex
+	role            string
+	intervalCounter uint64
+	lastTick        time.Time
+	lastSuccess     time.Time
+	lastKeyID       string
+	lastError       string
+	expired         bool // the PSK exceeded MAX_PSK_AGE
+}
+
+// tick records a new interval of the ticker loop.
+func (s *peerState) tick(intervalCounter uint64, role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intervalCounter = intervalCounter
+	s.role = role
+	s.lastTick = time.Now()
+}
+
+// current returns the role and interval of the last tick and whether there was one.
+func (s *peerState) current() (string, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.role, s.intervalCounter, !s.lastTick.IsZero()
+}
+
+// pskInstalled records a successful PSK installation.
+func (s *peerState) pskInstalled(keyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSuccess = time.Now()
+	s.lastKeyID = keyID
+	s.lastError = ""
+}
+
+// pskAge returns the time since the last PSK installation and whether there was one.
+func (s *peerState) pskAge() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSuccess), !s.lastSuccess.IsZero()
+}
+
+// setExpired records whether the PSK exceeded MAX_PSK_AGE and returns the previous state.
+func (s *peerState) setExpired(expired bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.expired
+	s.expired = expired
+	return prev
+}
+
+// setError records the last error of the PSK pipeline.
+func (s *peerState) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+}
+
+// peerStatus is the JSON representation of a peer in the health responses.
+type peerStatus struct {
+	Peer        string            `json:"peer"`
+	Mode        string            `json:"mode"`
+	Role        string            `json:"role"`
+	Interval    uint64            `json:"interval"`
+	Keyed       bool              `json:"keyed"`
+	PSKExpired  bool              `json:"psk_expired,omitempty"`
+	LastSuccess *time.Time        `json:"last_success,omitempty"`
+	LastKeyID   string            `json:"last_key_id,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	Checks      map[string]string `json:"checks"`
+}
+
+// healthResponse is the JSON body of /healthz and /readyz.
+type healthResponse struct {
+	Status string       `json:"status"`
+	Peers  []peerStatus `json:"peers"`
+}
+
+// status returns the current state of the peer, checks are filled by the caller.
+func (r *peerRunner) status() peerStatus {
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+	st := peerStatus{
+		Peer:       r.peer.LogName(),
+		Mode:       r.peer.Mode,
+		Role:       r.state.role,
+		Interval:   r.state.intervalCounter,
+		Keyed:      !r.state.lastSuccess.IsZero(),
+		PSKExpired: r.state.expired,
+		LastKeyID:  r.state.lastKeyID,
+		LastError:  r.state.lastError,
+		Checks:     make(map[string]string),
+	}
+	if !r.state.lastSuccess.IsZero() {
+		lastSuccess := r.state.lastSuccess
+		st.LastSuccess = &lastSuccess
+	}
+	return st
+}
+
+// liveness checks that the ticker loop of the peer is still making progress.
+// A tick may be delayed by a KMS request exhausting all its retries.
+func (r *peerRunner) liveness() error {
+	r.state.mu.Lock()
+	lastTick := r.state.lastTick
+	r.state.mu.Unlock()
+	maxDelay := 2*r.peer.Interval + r.cfg.KMSHTTPTimeout*time.Duration(r.cfg.KMSBackoffMaxRetries+1)
+	if lastTick.IsZero() || time.Since(lastTick) > maxDelay {
+		return fmt.Errorf("ticker loop stalled since %s", lastTick.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// readiness checks that the peer has recently been keyed, that the KMS is
+// reachable and that the WireGuard device is present.
+func (r *peerRunner) readiness(ctx context.Context) map[string]error {
+	if r.setupErr != nil {
+		return map[string]error{"setup": r.setupErr}
+	}
+	r.state.mu.Lock()
+	lastSuccess, expired := r.state.lastSuccess, r.state.expired
+	r.state.mu.Unlock()
+	checks := make(map[string]error)
+	if r.peer.MaxPSKAge > 0 {
+		checks["max_psk_age"] = nil
+		if expired {
+			checks["max_psk_age"] = fmt.Errorf("PSK exceeded MAX_PSK_AGE %s, tunnel invalidated", r.peer.MaxPSKAge)
+		}
+	}
+	maxAge := time.Duration(r.cfg.ReadyIntervals) * r.peer.Interval
+	if lastSuccess.IsZero() && r.peer.StartupPolicy == config.PolicyInvalidate {
+		checks["psk"] = fmt.Errorf("not yet keyed, tunnel runs on a random PSK")
+	} else if lastSuccess.IsZero() {
+		checks["psk"] = fmt.Errorf("not yet keyed")
+	} else if age := time.Since(lastSuccess); age > maxAge {
+		checks["psk"] = fmt.Errorf("last PSK installed %s ago", age.Truncate(time.Second))
+	} else {
+		checks["psk"] = nil
+	}
+	checks["kms"] = r.qkd.Check(ctx)
+	checks["wireguard"] = r.keyWriter.Check(ctx)
+	return checks
+}
+
+// healthHandler reports whether the UDP server and all ticker loops are running.
+func healthHandler(runners []*peerRunner) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		resp := healthResponse{Status: "ok"}
+		for _, r := range runners {
+			st := r.status()
+			if udpServerRunning.Load() {
+				st.Checks["udp_server"] = "ok"
+			} else {
+				st.Checks["udp_server"] = "not running"
+				resp.Status = "unhealthy"
+			}
+			if r.setupErr != nil {
+				st.Checks["setup"] = r.setupErr.Error()
+				resp.Status = "unhealthy"
+			} else if err := r.liveness(); err != nil {
+				st.Checks["ticker"] = err.Error()
+				resp.Status = "unhealthy"
+			} else {
+				st.Checks["ticker"] = "ok"
+			}
+			resp.Peers = append(resp.Peers, st)
+		}
+		writeHealth(w, resp)
+	}
+}
+
+// readyHandler reports whether all peers are keyed and their dependencies are reachable.
+func readyHandler(runners []*peerRunner) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		resp := healthResponse{Status: "ok"}
+		for _, r := range runners {
+			st := r.status()
+			for name, err := range r.readiness(req.Context()) {
+				if err != nil {
+					st.Checks[name] = err.Error()
+					resp.Status = "not ready"
+				} else {
+					st.Checks[name] = "ok"
+				}
+			}
+			resp.Peers = append(resp.Peers, st)
+		}
+		writeHealth(w, resp)
+	}
+}
+
+func writeHealth(w http.ResponseWriter, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/services"
+)
+
+// checkedKMS is a staticKMS whose reachability check returns err.
+type checkedKMS struct {
+	staticKMS
+	err error
+}
+
+func (k checkedKMS) Check(context.Context) error { return k.err }
+
+// healthRunner returns a keyed runner with a running ticker loop, a reachable KMS and a
+// present WireGuard peer.
+func healthRunner() (*peerRunner, *checkedKMS, *fakeWriter) {
+	r := testRunner()
+	r.cfg = &config.Config{ReadyIntervals: 3, KMSHTTPTimeout: time.Second, KMSBackoffMaxRetries: 2}
+	kms := &checkedKMS{}
+	r.qkd = services.NewManagedKeyReaderService(kms)
+	w := withWriter(r)
+	r.state.tick(1, "PRIMARY")
+	r.state.pskInstalled("key-1")
+	return r, kms, w
+}
+
+// serveHealth calls handler and returns the status code and the checks of the first peer.
+func serveHealth(t *testing.T, handler http.Handler) (int, map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var resp healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Peers) != 1 {
+		t.Fatalf("expected a single peer, got %d", len(resp.Peers))
+	}
+	return rec.Code, resp.Peers[0].Checks
+}
+
+// withUDPServer sets udpServerRunning for the duration of the test.
+func withUDPServer(t *testing.T, running bool) {
+	prev := udpServerRunning.Load()
+	udpServerRunning.Store(running)
+	t.Cleanup(func() { udpServerRunning.Store(prev) })
+}
+
+func TestLiveness(t *testing.T) {
+	tests := []struct {
+		name    string
+		tick    time.Duration // age of the last tick, none if zero
+		wantErr bool
+	}{
+		{name: "no tick", wantErr: true},
+		{name: "recent tick", tick: time.Minute},
+		{name: "tick delayed by KMS retries", tick: 2*time.Minute + 2*time.Second},
+		{name: "ticker stalled", tick: 2*time.Minute + 4*time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, _ := healthRunner()
+			r.state.lastTick = time.Time{}
+			if tt.tick > 0 {
+				r.state.lastTick = time.Now().Add(-tt.tick)
+			}
+			if err := r.liveness(); (err != nil) != tt.wantErr {
+				t.Fatalf("liveness() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(r *peerRunner)
+		udp    bool
+		failed string // failing check, none if empty
+	}{
+		{name: "healthy", udp: true},
+		{name: "UDP server stopped", failed: "udp_server"},
+		{name: "ticker stalled", udp: true, setup: func(r *peerRunner) {
+			r.state.lastTick = time.Now().Add(-time.Hour)
+		}, failed: "ticker"},
+		{name: "setup failed", udp: true, setup: func(r *peerRunner) {
+			r.setupErr = errors.New("no such device")
+		}, failed: "setup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUDPServer(t, tt.udp)
+			r, _, _ := healthRunner()
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			code, checks := serveHealth(t, healthHandler([]*peerRunner{r}))
+			expectHealth(t, code, checks, tt.failed)
+		})
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(r *peerRunner, kms *checkedKMS, w *fakeWriter)
+		failed string // failing check, none if empty
+	}{
+		{name: "ready"},
+		{name: "not yet keyed", setup: func(r *peerRunner, _ *checkedKMS, _ *fakeWriter) {
+			r.state.lastSuccess = time.Time{}
+		}, failed: "psk"},
+		{name: "PSK older than the ready intervals", setup: func(r *peerRunner, _ *checkedKMS, _ *fakeWriter) {
+			r.state.lastSuccess = time.Now().Add(-4 * time.Minute)
+		}, failed: "psk"},
+		{name: "PSK within max age", setup: func(r *peerRunner, _ *checkedKMS, _ *fakeWriter) {
+			r.peer.MaxPSKAge = time.Hour
+		}},
+		{name: "PSK expired", setup: func(r *peerRunner, _ *checkedKMS, _ *fakeWriter) {
+			r.peer.MaxPSKAge = time.Hour
+			r.state.setExpired(true)
+		}, failed: "max_psk_age"},
+		{name: "KMS unreachable", setup: func(_ *peerRunner, kms *checkedKMS, _ *fakeWriter) {
+			kms.err = errors.New("connection refused")
+		}, failed: "kms"},
+		{name: "WireGuard peer missing", setup: func(_ *peerRunner, _ *checkedKMS, w *fakeWriter) {
+			w.checkErr = errors.New("peer not found")
+		}, failed: "wireguard"},
+		{name: "setup failed", setup: func(r *peerRunner, _ *checkedKMS, _ *fakeWriter) {
+			r.setupErr = errors.New("no such device")
+		}, failed: "setup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, kms, w := healthRunner()
+			if tt.setup != nil {
+				tt.setup(r, kms, w)
+			}
+			code, checks := serveHealth(t, readyHandler([]*peerRunner{r}))
+			expectHealth(t, code, checks, tt.failed)
+		})
+	}
+}
+
+// expectHealth checks that only the failed check, if any, is reported and maps to 503.
+func expectHealth(t *testing.T, code int, checks map[string]string, failed string) {
+	t.Helper()
+	want := http.StatusOK
+	if failed != "" {
+		want = http.StatusServiceUnavailable
+	}
+	if code != want {
+		t.Fatalf("expected status %d, got %d with checks %v", want, code, checks)
+	}
+	for name, result := range checks {
+		if (result != "ok") != (name == failed) {
+			t.Fatalf("unexpected result %q of check %s, checks %v", result, name, checks)
+		}
+	}
+	if failed != "" && checks[failed] == "" {
+		t.Fatalf("expected check %s to be reported, got %v", failed, checks)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// httpShutdownTimeout bounds the time requests in flight may take on shutdown.
+const httpShutdownTimeout = 5 * time.Second
+
+// httpListeners binds the addresses of the metrics and health endpoints, so that an
+// address in use fails the startup. Endpoints configured with the same address share a
+// single listener.
+func httpListeners(cfg *config.Config) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	for _, address := range []string{cfg.MetricsAddress, cfg.HealthAddress} {
+		if address == "" || listeners[address] != nil {
+			continue
+		}
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, ln := range listeners {
+				_ = ln.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+		}
+		listeners[address] = ln
+	}
+	return listeners, nil
+}
+
+// httpServers serves the metrics and health endpoints on the listeners of httpListeners
+// in the background.
+func httpServers(cfg *config.Config, listeners map[string]net.Listener, runners []*peerRunner) []*http.Server {
+	servers := make([]*http.Server, 0, len(listeners))
+	for address, ln := range listeners {
+		mux := http.NewServeMux()
+		if address == cfg.MetricsAddress {
+			mux.Handle("/metrics", metrics.Handler())
+		}
+		if address == cfg.HealthAddress {
+			mux.Handle("/healthz", healthHandler(runners))
+			mux.Handle("/readyz", readyHandler(runners))
+		}
+		server := &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		servers = append(servers, server)
+		go httpServer(server, ln)
+	}
+	return servers
+}
+
+func httpServer(server *http.Server, ln net.Listener) {
+	slog.Info("HTTP server started", "address", ln.Addr().String())
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "address", ln.Addr().String(), logging.KeyError, err)
+	}
+}
+
+// shutdownHTTP stops the HTTP servers and waits up to httpShutdownTimeout for requests
+// in flight.
+func shutdownHTTP(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("HTTP server shutdown failed", logging.KeyError, err)
+		}
+	}
+}
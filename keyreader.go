@@ -1,20 +1,35 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/arnika-project/arnika/config"
-	"github.com/arnika-project/arnika/repositories"
+	"github.com/arnika-project/arnika/providers"
 	"github.com/arnika-project/arnika/services"
 )
 
-func getQKDService(cfg *config.Config) *services.KeyReaderService {
-	kmsAuth := repositories.NewKMSClientCertificateAuth(cfg.Certificate, cfg.PrivateKey, cfg.CACertificate)
-	kmsRepo := repositories.NewHTTPKMSRepository(cfg.KMSURL, cfg.KMSHTTPTimeout, cfg.KMSBackoffMaxRetries, cfg.KMSBackoffBaseDelay, kmsAuth)
-	var managed services.KeyReaderManaged = kmsRepo
-	return services.NewKeyReaderService(&managed)
+// getQKDService returns the service of the QKD key source of the peer. The BACKUP
+// requests the key of the PRIMARY by its ID, so the key source must have key IDs.
+func getQKDService(cfg *config.Config, peer *config.Peer) (*services.KeyReaderService, error) {
+	qkd, err := providers.Open(providers.Env{Config: cfg, Peer: peer}, peer.QKDSource)
+	if err != nil {
+		return nil, fmt.Errorf("QKD key source: %w", err)
+	}
+	if !qkd.IsManaged() {
+		_ = qkd.Close()
+		return nil, fmt.Errorf("QKD key source %s has no key IDs", peer.QKDSource)
+	}
+	return qkd, nil
 }
 
-func getPQCService(cfg *config.Config) *services.KeyReaderService {
-	pqcRepo := repositories.NewFilePQCRepository(cfg.PQCPSKFile)
-	var unmanaged services.KeyReaderUnmanaged = pqcRepo
-	return services.NewKeyReaderService(&unmanaged)
+// getPQCService returns the service of the PQC key source of the peer, nil if there is none.
+func getPQCService(cfg *config.Config, peer *config.Peer) (*services.KeyReaderService, error) {
+	if peer.PQCSource == "" {
+		return nil, nil
+	}
+	pqc, err := providers.Open(providers.Env{Config: cfg, Peer: peer}, peer.PQCSource)
+	if err != nil {
+		return nil, fmt.Errorf("PQC key source: %w", err)
+	}
+	return pqc, nil
 }
@@ -0,0 +1,199 @@
+// Package logging configures the structured log/slog logger used by arnika.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Common attribute keys used across arnika log records.
+const (
+	KeyPeer     = "peer"
+	KeyRole     = "role"
+	KeyInterval = "interval"
+	KeyKeyID    = "key_id"
+	KeyError    = "error"
+)
+
+// ANSI colour codes used by the colour text handler.
+const (
+	colorReset   = "\033[0m"
+	colorRed     = "\033[31m"
+	colorYellow  = "\033[33m"
+	colorGreen   = "\033[32m"
+	colorGray    = "\033[90m"
+	colorMagenta = "\033[35m"
+	colorCyan    = "\033[36m"
+)
+
+// Options configures the logger returned by New.
+type Options struct {
+	Level  string // "debug", "info", "warn" or "error"
+	Format string // "text" or "json"
+	Color  bool   // colourize text output, ignored for json
+}
+
+// ParseLevel converts a level name into a slog.Level.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level: %s", level)
+}
+
+// New creates a logger writing to w.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(opts.Format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	case "text", "":
+		if opts.Color {
+			return slog.New(newColorHandler(w, level)), nil
+		}
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format: %s", opts.Format)
+}
+
+// IsTerminal reports whether f is connected to a terminal.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorHandler is a slog.Handler writing human readable, colourized lines:
+//
+//	2026/01/22 18:04:40.628630 INFO PSK configured peer=9999 role=PRIMARY key_id=...
+type colorHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	attrs  []byte // preformatted attributes added with WithAttrs
+	prefix string // group prefix added with WithGroup
+}
+
+func newColorHandler(w io.Writer, level slog.Leveler) *colorHandler {
+	return &colorHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *colorHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]byte(nil), h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = appendAttr(h2.attrs, h.prefix, a)
+	}
+	return &h2
+}
+
+func (h *colorHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+func (h *colorHandler) Handle(_ context.Context, r slog.Record) error {
+	buf := make([]byte, 0, 256)
+	buf = r.Time.AppendFormat(buf, "2006/01/02 15:04:05.000000")
+	buf = append(buf, ' ')
+	buf = append(buf, levelColor(r.Level)...)
+	buf = append(buf, r.Level.String()...)
+	buf = append(buf, colorReset...)
+	buf = append(buf, ' ')
+	buf = append(buf, r.Message...)
+	buf = append(buf, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		buf = appendAttr(buf, h.prefix, a)
+		return true
+	})
+	buf = append(buf, '\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return colorRed
+	case level >= slog.LevelWarn:
+		return colorYellow
+	case level >= slog.LevelInfo:
+		return colorGreen
+	}
+	return colorGray
+}
+
+func appendAttr(buf []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			buf = appendAttr(buf, groupPrefix, ga)
+		}
+		return buf
+	}
+	buf = append(buf, ' ')
+	buf = append(buf, prefix...)
+	buf = append(buf, a.Key...)
+	buf = append(buf, '=')
+	value := a.Value.String()
+	if a.Key == KeyRole {
+		color := colorCyan
+		if value == "PRIMARY" {
+			color = colorMagenta
+		}
+		return append(append(append(buf, color...), value...), colorReset...)
+	}
+	if needsQuoting(value) {
+		return strconv.AppendQuote(buf, value)
+	}
+	return append(buf, value...)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"INFO", slog.LevelInfo},
+		{"", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.in)
+		if err != nil {
+			t.Fatalf("ParseLevel(%q) failed: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
+
+func TestNewRejectsInvalidFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, Options{Format: "xml"}); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Level: "info", Format: "json"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logger.With(KeyPeer, "9999").Info("PSK configured", KeyRole, "PRIMARY", KeyKeyID, "abc", KeyInterval, 7)
+	logger.Debug("filtered")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]any{"msg": "PSK configured", KeyPeer: "9999", KeyRole: "PRIMARY", KeyKeyID: "abc", KeyInterval: float64(7)} {
+		if record[key] != want {
+			t.Errorf("expected %s=%v, got %v", key, want, record[key])
+		}
+	}
+}
+
+func TestTextOutputWithoutColor(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Format: "text"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logger.Error("failed", KeyError, errors.New("boom"), KeyRole, "BACKUP")
+	out := buf.String()
+	if strings.Contains(out, "\033[") {
+		t.Errorf("expected no colour codes, got %q", out)
+	}
+	if !strings.Contains(out, "error=boom") || !strings.Contains(out, "role=BACKUP") {
+		t.Errorf("expected error and role attributes, got %q", out)
+	}
+}
+
+func TestColorHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Level: "debug", Format: "text", Color: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logger.With(KeyPeer, "9999/spoke1").WithGroup("kms").Warn("retry", "url", "http://kms/a b", KeyRole, "PRIMARY")
+	out := buf.String()
+	for _, want := range []string{
+		colorYellow + "WARN" + colorReset + " retry",
+		" peer=9999/spoke1",
+		` kms.url="http://kms/a b"`,
+		" kms.role=" + colorMagenta + "PRIMARY" + colorReset,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\n") {
+		t.Error("expected trailing newline")
+	}
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-
+	"log/slog"
 	"os"
-
+	"os/signal"
 	"runtime/secret"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/arnika-project/arnika/auth"
 	"github.com/arnika-project/arnika/config"
 	"github.com/arnika-project/arnika/kdf"
-	"github.com/arnika-project/arnika/services"
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+	"github.com/arnika-project/arnika/models"
 )
 
 var (
@@ -21,44 +27,38 @@ var (
 	Version string
 	// allows to overwrite app name on build.
 	APPName string
-	// Prefix variables initialized after config is parsed
-	PRIMARYLOGPREFIX string
-	BACKUPLOGPREFIX  string
-	ARNIKALOGPREFIX  string
 )
 
-func setPSK(keyWriter *services.KeyWriterService, pqc *services.KeyReaderService, qkd []byte, cfg *config.Config, logPrefix string) {
-	var psk []byte
+// preparePSK derives the PSK from the QKD key and, if configured, the PQC key and checks
+// that the WireGuard peer is present. Failures are returned as *pskError, the returned
+// PSK must be cleared by the caller.
+// The BACKUP passes the generation of the PQC key combined by the PRIMARY as pqcID, the
+// PRIMARY passes an empty pqcID and gets the generation of the current PQC key.
+func (r *peerRunner) preparePSK(ctx context.Context, qkd []byte, pqcID string, logger *slog.Logger) (psk []byte, usedPQCID string, failure error) {
+	cfg := r.peer
 	if qkd != nil {
 		psk = make([]byte, len(qkd))
 		copy(psk, qkd)
 	}
-	msg := ""
 	defer func() {
-		clear(psk)
-		if msg != "" {
-			log.Println(msg)
-			log.Printf("[ERROR] %s [STOP] configure random PSK to invalidate WireGuard session", logPrefix)
-			if err := keyWriter.InvalidateTunnel(); err != nil {
-				log.Printf("[ERROR] %s failed to configure random PSK: %v", logPrefix, err)
-			}
+		if failure != nil {
+			clear(psk)
+			psk = nil
 		}
 	}()
 	if len(qkd) == 0 {
 		if cfg.IsQKDRequired() {
-			msg = fmt.Sprintf("[ERROR] %s mode set to %s but no QKD key received", logPrefix, cfg.Mode)
-			return
+			return nil, "", &pskError{auth.ErrorKMS, fmt.Errorf("mode set to %s but no QKD key received", cfg.Mode)}
 		}
-		log.Printf("[WARNING] %s failed to retrieve QKD key, switching to PQC key since mode is set to %s", logPrefix, cfg.Mode)
+		logger.Warn("failed to retrieve QKD key, switching to PQC key", "mode", cfg.Mode)
 	}
 	if cfg.UsePQC() {
-		pqcKey, err := pqc.GetNewKey()
+		pqcKey, err := r.pqcKey(ctx, pqcID)
 		if err != nil {
 			if cfg.IsPQCRequired() {
-				msg = fmt.Sprintf("[ERROR] %s failed to retrieve PQC key: %v. Abort since mode is set to %s", logPrefix, err, cfg.Mode)
-				return
+				return psk, "", &pskError{auth.ErrorPQC, fmt.Errorf("failed to retrieve PQC key: %w. Abort since mode is set to %s", err, cfg.Mode)}
 			}
-			log.Printf("[WARNING] %s failed to retrieve PQC key, switching to QKD key since mode is set to %s", logPrefix, cfg.Mode)
+			logger.Warn("failed to retrieve PQC key, switching to QKD key", "mode", cfg.Mode, logging.KeyError, err)
 		} else {
 			defer pqcKey.Zero()
 			var derivedKey []byte
@@ -66,32 +66,94 @@ func setPSK(keyWriter *services.KeyWriterService, pqc *services.KeyReaderService
 				derivedKey, err = kdf.DeriveKey(psk, pqcKey.Key)
 			})
 			if err != nil {
-				msg = fmt.Sprintf("[ERROR] %s failed to derive key: %v. Abort since mode is set to %s", logPrefix, err, cfg.Mode)
-				return
+				return psk, "", &pskError{auth.ErrorInternal, fmt.Errorf("failed to derive key: %w. Abort since mode is set to %s", err, cfg.Mode)}
 			}
 			clear(psk)
 			psk = derivedKey
-			log.Printf("[INFO] %s [OK] HKDF derivation completed for QKD+PQC key", logPrefix)
+			if pqcKey.IsManaged() {
+				usedPQCID = *pqcKey.ID
+			}
+			logger.Info("HKDF derivation completed for QKD+PQC key", "pqc_id", usedPQCID)
 		}
 	}
 	if len(psk) == 0 {
-		msg = fmt.Sprintf("[ERROR] %s no PSK available", logPrefix)
-		return
+		return psk, "", &pskError{auth.ErrorInternal, errors.New("no PSK available")}
+	}
+	if err := r.keyWriter.Check(ctx); err != nil {
+		return psk, "", &pskError{auth.ErrorWireGuard, err}
+	}
+	return psk, usedPQCID, nil
+}
+
+// pqcKey returns the PQC key of generation pqcID, or the current PQC key if pqcID is
+// empty or the PQC key source has no generations.
+func (r *peerRunner) pqcKey(ctx context.Context, pqcID string) (*models.Key, error) {
+	if pqcID != "" && r.pqc.IsManaged() {
+		return r.pqc.GetKeyByID(ctx, &pqcID)
+	}
+	return r.pqc.GetNewKey(ctx)
+}
+
+// installPSK configures the PSK on the WireGuard peer at the activation time agreed with
+// the peer, or immediately if it has already passed. The PSK is cleared afterwards, it
+// is not installed if ctx is done before the activation time. A failure is left to the
+// caller, which knows whether the peer switches to the PSK as well.
+func (r *peerRunner) installPSK(ctx context.Context, keyID string, psk []byte, role string, activation time.Time) error {
+	defer clear(psk)
+	cfg := r.peer
+	logger := r.log.With(logging.KeyRole, role, logging.KeyKeyID, keyID)
+	if wait := time.Until(activation); wait > 0 {
+		if err := sleep(ctx, wait); err != nil {
+			return &pskError{auth.ErrorInternal, fmt.Errorf("PSK not installed before activation: %w", err)}
+		}
+	} else {
+		logger.Warn("activation time already passed, installing PSK immediately", "late", -wait)
 	}
 	// Encode to base64 for WireGuard interface (requires string)
 	pskStr := base64.StdEncoding.EncodeToString(psk)
-	if err := keyWriter.SetPSK(pskStr); err != nil {
-		msg = fmt.Sprintf("[ERROR] %s failed to configure PSK on WireGuard interface: %v", logPrefix, err)
-		return
+	if err := r.keyWriter.SetPSK(ctx, pskStr); err != nil {
+		return &pskError{auth.ErrorWireGuard, fmt.Errorf("failed to configure PSK on WireGuard interface: %w", err)}
+	}
+	logger.Info("PSK configured on WireGuard interface", "interface", cfg.WireGuardInterface, "wireguard_peer", cfg.WireguardPeerPublicKey)
+	r.state.pskInstalled(keyID)
+	r.grace.reset()
+	r.rebaseTraffic(ctx)
+	now := time.Now()
+	metrics.Rotations.Inc(cfg.LogName(), role)
+	metrics.PSKLastSuccess.Set(float64(now.Unix()), cfg.LogName())
+	metrics.PSKAge.Reset(now, cfg.LogName())
+	metrics.PSKKeyed.Set(1, cfg.LogName())
+	metrics.GraceFailedIntervals.Set(0, cfg.LogName())
+	metrics.TunnelInvalidated.Set(0, cfg.LogName())
+	return nil
+}
+
+// pskFailed records a failure of the PSK pipeline and applies the grace policy, which
+// invalidates the tunnel with a random PSK once the grace period is exhausted.
+func (r *peerRunner) pskFailed(ctx context.Context, logger *slog.Logger, err error) {
+	logger.Error("failed to configure PSK", logging.KeyError, err)
+	r.state.setError(err)
+	r.graceFailed(ctx, logger, err)
+}
+
+// sleep pauses for d or until ctx is done, in which case it returns the error of ctx.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	log.Printf("[INFO] %s [OK] PSK configured on WireGuard interface: %s for peer: %s", logPrefix, cfg.WireGuardInterface, cfg.WireguardPeerPublicKey)
 }
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	versionLong := flag.Bool("version", false, "print version and exit")
 	versionShort := flag.Bool("v", false, "alias for version")
 	help := flag.Bool("help", false, "print usage and exit")
+	configFile := flag.String("config", "", "path to YAML config file, environment variables override its values")
+	flag.Parse()
 	switch {
 	case *versionLong || *versionShort:
 		fmt.Printf("%s version %s\n", APPName, Version)
@@ -100,99 +162,80 @@ func main() {
 		flag.Usage()
 		os.Exit(0)
 	}
-	cfg, err := config.Parse()
+	var cfg *config.Config
+	var err error
+	if *configFile != "" {
+		cfg, err = config.ParseFile(*configFile)
+	} else {
+		cfg, err = config.Parse()
+	}
 	if err != nil {
-		log.Fatalf("[ERROR] failed to parse config: %v", err)
+		fmt.Fprintf(os.Stderr, "[ERROR] failed to parse config: %v\n", err)
+		os.Exit(1)
 	}
+	logger, err := logging.New(os.Stderr, logging.Options{
+		Level:  cfg.LogLevel,
+		Format: cfg.LogFormat,
+		Color:  logging.IsTerminal(os.Stderr),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] failed to configure logging: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger.With("arnika_id", cfg.ArnikaID))
 	cfg.PrintStartupConfig()
-	var colorStart, colorEnd string
-	arnikaIDInt := 0
-	if _, err := fmt.Sscanf(cfg.ArnikaID, "%d", &arnikaIDInt); err != nil {
-		log.Printf("[WARN] failed to parse ArnikaID %q as integer: %v", cfg.ArnikaID, err)
+	listeners, err := httpListeners(cfg)
+	if err != nil {
+		slog.Error("failed to start HTTP server", logging.KeyError, err)
+		os.Exit(1)
 	}
-	if arnikaIDInt%2 == 0 {
-		colorStart = "\033[35m"
-	} else {
-		colorStart = "\033[36m"
-	}
-	colorEnd = "\033[0m"
-	PRIMARYLOGPREFIX = fmt.Sprintf("%sPRIMARY[%s]%s", colorStart, cfg.ArnikaID, colorEnd)
-	BACKUPLOGPREFIX = fmt.Sprintf("%sBACKUP[%s]%s", colorStart, cfg.ArnikaID, colorEnd)
-	ARNIKALOGPREFIX = fmt.Sprintf("ARNIKA[%s]", cfg.ArnikaID)
-	interval := cfg.Interval
-	done := make(chan bool)
-	skip := make(chan bool, 1)
-	result := make(chan string)
-	qkd := getQKDService(cfg)
-	pqc := getPQCService(cfg)
-	keyWriter, err := getKeyWriterService(cfg)
+	conn, err := udpListener(cfg.ListenAddress)
 	if err != nil {
-		log.Panicf("[ERROR] [STOP] Failed to create WireGuard repository: %v", err)
-	}
-	go udpServer(cfg.ListenAddress, []byte(cfg.ArnikaPSK), result, done, cfg.RateLimit, cfg.RateWindow, cfg.MaxClockSkew)
-	go func() {
-		for {
-			r := <-result
-			select {
-			case skip <- true:
-			default:
-			}
-			log.Printf("[INFO] %s [REQ] request QKD key for key_id %s from %s\n", BACKUPLOGPREFIX, r, cfg.KMSURL)
-			key, err := qkd.GetKeyByID(&r)
-			if err != nil {
-				log.Printf("[ERROR] %s failed to retrieve QKD key for key_id %s from %s, %v", BACKUPLOGPREFIX, r, cfg.KMSURL, err)
-				continue
+		slog.Error("failed to start UDP server", logging.KeyError, err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	runners := make([]*peerRunner, 0, len(cfg.Peers))
+	udpPeers := make([]*udpPeer, 0, len(cfg.Peers))
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		runner, err := newPeerRunner(cfg, peer)
+		if err == nil {
+			if err = runner.startup(ctx); err != nil {
+				runner.close()
 			}
-			setPSK(keyWriter, pqc, key.Key, cfg, BACKUPLOGPREFIX)
 		}
-	}()
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		var intervalCounter uint64
-		for {
-			ticker.Reset(interval)
-			if !cfg.IsPrimary(intervalCounter) {
-				select {
-				case <-skip:
-				default:
-					log.Printf("[INFO] %s [REQ] BACKUP for interval %d, waiting for key_id from peer\n", BACKUPLOGPREFIX, intervalCounter)
-				}
-			} else {
-				select {
-				case <-skip:
-				default:
-				}
-				log.Printf("[INFO] %s [REQ] request QKD key from %s\n", PRIMARYLOGPREFIX, cfg.KMSURL)
-				key, err := qkd.GetNewKey()
-				if err != nil {
-					log.Printf("[ERROR] %s failed to retrieve QKD key from %s, %v", PRIMARYLOGPREFIX, cfg.KMSURL, err)
-					ticker.Reset(cfg.KMSRetryInterval)
-				} else {
-					// Wait until the next full second (e.g., 12:34:57.000)
-					now := time.Now()
-					nextTick := now.Truncate(time.Second).Add(time.Second)
-					log.Printf("[INFO] %s [REQ] PRIMARY for interval %d\n", PRIMARYLOGPREFIX, intervalCounter)
-					time.Sleep(nextTick.Sub(now))
-					select {
-					case <-skip:
-					default:
-						if !key.IsManaged() && key.ID == nil {
-							log.Printf("[ERROR] %s received empty key_id from KMS, skipping this interval", PRIMARYLOGPREFIX)
-							continue
-						}
-						log.Printf("[INFO] %s [SND] send key_id %s to %s\n", PRIMARYLOGPREFIX, *key.ID, cfg.ServerAddress)
-						err = udpClient(cfg.ServerAddress, []byte(cfg.ArnikaPSK), *key.ID, cfg.ArnikaPeerTimeout, cfg.MaxClockSkew)
-						if err != nil {
-							log.Printf("[ERROR] %s failed to send key_id %s to %s: %v", PRIMARYLOGPREFIX, *key.ID, cfg.ServerAddress, err)
-						}
-						setPSK(keyWriter, pqc, key.Key, cfg, PRIMARYLOGPREFIX)
-					}
-				}
-			}
-			intervalCounter++
-			<-ticker.C
+		if err != nil {
+			// A failing peer must not stall the others, it is reported as unhealthy
+			slog.Error("failed to set up peer", logging.KeyPeer, peer.LogName(), logging.KeyError, err)
+			runners = append(runners, failedRunner(cfg, peer, err))
+			continue
 		}
-	}()
-	<-done
+		runners = append(runners, runner)
+		udpPeers = append(udpPeers, runner.udpPeer())
+	}
+	if len(udpPeers) == 0 {
+		slog.Error("no peer could be set up")
+		os.Exit(1)
+	}
+	servers := httpServers(cfg, listeners, runners)
+	var wg sync.WaitGroup
+	wg.Go(func() { udpServer(ctx, conn, udpPeers, cfg.RateLimit, cfg.RateWindow, cfg.MaxClockSkew) })
+	for _, runner := range runners {
+		if runner.setupErr == nil {
+			runner.run(ctx, &wg)
+		}
+	}
+	<-ctx.Done()
+	slog.Info("shutdown triggered, canceling in-flight key rotations")
+	shutdownHTTP(servers)
+	wg.Wait()
+	for _, runner := range runners {
+		if runner.setupErr != nil {
+			continue
+		}
+		runner.shutdown(context.Background())
+		runner.close()
+	}
 }
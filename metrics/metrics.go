@@ -0,0 +1,348 @@
+// Package metrics provides the Prometheus metrics exported by arnika.
+//
+// The metrics are rendered in the Prometheus text exposition format without
+// pulling in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role labels used for per role metrics.
+const (
+	RolePrimary = "PRIMARY"
+	RoleBackup  = "BACKUP"
+)
+
+var (
+	// Rotations counts successful PSK rotations per peer and role.
+	Rotations = NewCounterVec("arnika_rotations_total", "Successful PSK rotations.", "peer", "role")
+	// KMSRequestDuration observes the duration of KMS requests including retries.
+	KMSRequestDuration = NewHistogramVec("arnika_kms_request_duration_seconds", "Duration of KMS requests including retries.", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "operation")
+	// KMSEndpointUp reports 1 while the circuit breaker of a KMS endpoint is closed.
+	KMSEndpointUp = NewGaugeVec("arnika_kms_endpoint_up", "1 while the circuit breaker of a KMS endpoint is closed.", "kms")
+	// KMSFailovers counts requests moved on from a failing KMS endpoint to the next one.
+	KMSFailovers = NewCounterVec("arnika_kms_failovers_total", "Requests moved on from a failing KMS endpoint to the next one.", "kms")
+	// KMSPoolKeys reports the number of prefetched keys per KMS.
+	KMSPoolKeys = NewGaugeVec("arnika_kms_pool_keys", "Prefetched keys in the KMS key pool.", "kms")
+	// KMSErrors counts failed KMS request attempts by the kind of the ETSI 014 error.
+	KMSErrors = NewCounterVec("arnika_kms_errors_total", "Failed KMS request attempts by error kind.", "operation", "kind")
+	// KMSRetries counts retried KMS requests.
+	KMSRetries = NewCounterVec("arnika_kms_request_retries_total", "Retried KMS requests.", "operation")
+	// UDPRejected counts rejected UDP packets per reason.
+	UDPRejected = NewCounterVec("arnika_udp_packets_rejected_total", "Rejected UDP packets.", "reason")
+	// RateLimited counts UDP packets dropped by the rate limiter.
+	RateLimited = NewCounterVec("arnika_udp_rate_limited_total", "UDP packets dropped by the rate limiter.")
+	// PeerNacks counts key IDs the BACKUP rejected with a NACK per peer and error class.
+	PeerNacks = NewCounterVec("arnika_peer_nacks_total", "Key IDs rejected by the peer with a NACK.", "peer", "class")
+	// RoleConflicts counts detected role conflicts per peer and kind (split_brain, no_leader).
+	RoleConflicts = NewCounterVec("arnika_role_conflicts_total", "Detected role election conflicts.", "peer", "kind")
+	// PSKMismatches counts key exchanges in which both nodes derived different PSKs.
+	PSKMismatches = NewCounterVec("arnika_psk_mismatches_total", "Key exchanges whose PSK confirmation did not match.", "peer")
+	// TunnelInvalidations counts InvalidateTunnel calls per peer.
+	TunnelInvalidations = NewCounterVec("arnika_tunnel_invalidations_total", "Tunnels invalidated with a random PSK.", "peer")
+	// TunnelInvalidated is 1 while the WireGuard peer is configured with a random PSK.
+	TunnelInvalidated = NewGaugeVec("arnika_tunnel_invalidated", "1 if the tunnel currently runs on a random PSK.", "peer")
+	// GraceFailedIntervals holds the failed intervals since the last SetPSK per peer.
+	GraceFailedIntervals = NewGaugeVec("arnika_grace_failed_intervals", "Intervals with a failed key exchange since the last PSK installation.", "peer")
+	// GraceDecisions counts the decisions of the grace policy per peer.
+	GraceDecisions = NewCounterVec("arnika_grace_decisions_total", "Failed key exchanges by grace policy decision.", "peer", "decision")
+	// PSKExpired is 1 while the PSK of a peer is older than MAX_PSK_AGE.
+	PSKExpired = NewGaugeVec("arnika_psk_expired", "1 if the PSK exceeded MAX_PSK_AGE and the tunnel was invalidated.", "peer")
+	// TrafficBytes holds the bytes transferred by the WireGuard peer since the last SetPSK.
+	TrafficBytes = NewGaugeVec("arnika_traffic_bytes", "Bytes received and transmitted by the WireGuard peer since the last PSK installation.", "peer")
+	// VolumeRekeys counts early rotations requested because of REKEY_BYTES.
+	VolumeRekeys = NewCounterVec("arnika_volume_rekeys_total", "Early PSK rotations requested after REKEY_BYTES were transferred.", "peer")
+	// PQCGeneration holds the local number of the current generation of the PQC key file per peer.
+	PQCGeneration = NewGaugeVec("arnika_pqc_generation", "Generation of the PQC key file, incremented whenever the key changes.", "peer")
+	// MLKEMExchanges counts the ML-KEM key exchanges of PQC_MLKEM per peer.
+	MLKEMExchanges = NewCounterVec("arnika_mlkem_exchanges_total", "ML-KEM key exchanges by role and result.", "peer", "role", "result")
+	// PSKKeyed is 0 until the first successful SetPSK per peer since startup.
+	PSKKeyed = NewGaugeVec("arnika_psk_keyed", "1 once a PSK has been installed since startup.", "peer")
+	// PSKLastSuccess holds the unix timestamp of the last successful SetPSK per peer.
+	PSKLastSuccess = NewGaugeVec("arnika_psk_last_success_timestamp_seconds", "Unix timestamp of the last successful PSK installation.", "peer")
+	// PSKAge reports the time since the last successful SetPSK per peer.
+	PSKAge = NewAgeVec("arnika_psk_age_seconds", "Seconds since the last successful PSK installation.", "peer")
+)
+
+// collector is implemented by all metric types.
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// Handler returns an http.Handler serving all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// WriteTo writes all metrics in the Prometheus text format to w.
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// desc holds the name, help text and label names of a metric.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, typ)
+}
+
+// key joins label values into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelValueEscaper escapes label values as required by the text exposition format,
+// which only knows the escape sequences \\, \" and \n.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats the label set of a series, extra is appended as is (e.g. le="0.5").
+func (d *desc) labelString(key string, extra string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+labelValueEscaper.Replace(v)+`"`)
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a monotonically increasing counter partitioned by labels.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a CounterVec.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, labels: labels}, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increments the counter for the given label values by v.
+func (c *CounterVec) Add(v float64, labels ...string) {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// Value returns the current value for the given label values.
+func (c *CounterVec) Value(labels ...string) float64 {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, k := range sortedKeys(c.values) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(k, ""), formatFloat(c.values[k]))
+	}
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGaugeVec creates and registers a GaugeVec.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: desc{name: name, help: help, labels: labels}, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values to v.
+func (g *GaugeVec) Set(v float64, labels ...string) {
+	key := g.key(labels)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+// Value returns the current value for the given label values.
+func (g *GaugeVec) Value(labels ...string) float64 {
+	key := g.key(labels)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[key]
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w, "gauge")
+	for _, k := range sortedKeys(g.values) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(k, ""), formatFloat(g.values[k]))
+	}
+}
+
+// AgeVec is a gauge reporting the seconds elapsed since a point in time, evaluated on scrape.
+type AgeVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]time.Time
+}
+
+// NewAgeVec creates and registers an AgeVec.
+func NewAgeVec(name, help string, labels ...string) *AgeVec {
+	a := &AgeVec{desc: desc{name: name, help: help, labels: labels}, values: make(map[string]time.Time)}
+	register(a)
+	return a
+}
+
+// Reset restarts the age for the given label values at t.
+func (a *AgeVec) Reset(t time.Time, labels ...string) {
+	key := a.key(labels)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.values[key] = t
+}
+
+func (a *AgeVec) write(w io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.header(w, "gauge")
+	now := time.Now()
+	for _, k := range sortedKeys(a.values) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", a.name, a.labelString(k, ""), formatFloat(now.Sub(a.values[k]).Seconds()))
+	}
+}
+
+// HistogramVec counts observations in configurable buckets, partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // cumulative count per bucket
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a HistogramVec with the given upper bucket bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name: name, help: help, labels: labels}, buckets: buckets, values: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+// Observe adds a single observation for the given label values.
+func (h *HistogramVec) Observe(v float64, labels ...string) {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// Count returns the number of observations for the given label values.
+func (h *HistogramVec) Count(labels ...string) uint64 {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hist, ok := h.values[key]; ok {
+		return hist.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range sortedKeys(h.values) {
+		hist := h.values[k]
+		for i, upper := range h.buckets {
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, `le="`+formatFloat(upper)+`"`), hist.counts[i])
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, `le="+Inf"`), hist.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(k, ""), formatFloat(hist.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(k, ""), hist.count)
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "Test counter.", "peer", "role")
+	c.Inc("spoke1", RolePrimary)
+	c.Add(2, "spoke1", RolePrimary)
+	c.Inc("spoke2", RoleBackup)
+
+	if v := c.Value("spoke1", RolePrimary); v != 3 {
+		t.Fatalf("expected 3, got %v", v)
+	}
+	out := scrape(t)
+	for _, line := range []string{
+		"# TYPE test_counter_total counter",
+		`test_counter_total{peer="spoke1",role="PRIMARY"} 3`,
+		`test_counter_total{peer="spoke2",role="BACKUP"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected line %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestCounterVecPanicsOnLabelMismatch(t *testing.T) {
+	c := NewCounterVec("test_label_mismatch_total", "Test counter.", "peer")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for wrong number of label values")
+		}
+	}()
+	c.Inc()
+}
+
+func TestGaugeVecAndAgeVec(t *testing.T) {
+	g := NewGaugeVec("test_gauge", "Test gauge.")
+	g.Set(1)
+	a := NewAgeVec("test_age_seconds", "Test age.", "peer")
+	a.Reset(time.Now().Add(-time.Hour), "spoke1")
+
+	out := scrape(t)
+	if !strings.Contains(out, "test_gauge 1\n") {
+		t.Errorf("expected gauge without labels in output:\n%s", out)
+	}
+	if !strings.Contains(out, `test_age_seconds{peer="spoke1"} 3600`) {
+		t.Errorf("expected age of one hour in output:\n%s", out)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Test histogram.", []float64{0.1, 1}, "operation")
+	h.Observe(0.05, "enc_keys")
+	h.Observe(0.5, "enc_keys")
+	h.Observe(5, "enc_keys")
+
+	if c := h.Count("enc_keys"); c != 3 {
+		t.Fatalf("expected 3 observations, got %d", c)
+	}
+	out := scrape(t)
+	for _, line := range []string{
+		`test_duration_seconds_bucket{operation="enc_keys",le="0.1"} 1`,
+		`test_duration_seconds_bucket{operation="enc_keys",le="1"} 2`,
+		`test_duration_seconds_bucket{operation="enc_keys",le="+Inf"} 3`,
+		`test_duration_seconds_sum{operation="enc_keys"} 5.55`,
+		`test_duration_seconds_count{operation="enc_keys"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected line %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	c := NewCounterVec("test_escape_total", "Test counter.", "peer")
+	tests := []struct {
+		value, want string
+	}{
+		{`a"b`, `peer="a\"b"`},
+		{`a\b`, `peer="a\\b"`},
+		{"a\nb", `peer="a\nb"`},
+		// Only backslash, double quote and line feed are escaped
+		{"a\tb", "peer=\"a\tb\""},
+		{"spöke", `peer="spöke"`},
+	}
+	for _, tt := range tests {
+		c.Inc(tt.value)
+	}
+	out := scrape(t)
+	for _, tt := range tests {
+		if !strings.Contains(out, "test_escape_total{"+tt.want+"} 1\n") {
+			t.Errorf("expected label %s for value %q in output:\n%s", tt.want, tt.value, out)
+		}
+	}
+}
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	return w.Body.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// kemLoop establishes the ML-KEM keys of PQC_MLKEM. The key of interval g is exchanged
+// halfway through interval g-1 by the PRIMARY of interval g, so that it is in place on
+// both nodes before the rotations of g start. The key of the current interval is
+// exchanged on startup and whenever a new instance of the remote node joined.
+func (r *peerRunner) kemLoop(ctx context.Context) {
+	if r.kem == nil {
+		return
+	}
+	current := r.peer.EpochInterval(time.Now())
+	r.establishMLKEM(ctx, current)
+	next := current + 1
+	for {
+		if current := r.peer.EpochInterval(time.Now()); next <= current {
+			next = current + 1
+		}
+		timer := time.NewTimer(time.Until(r.peer.IntervalStart(next).Add(-r.peer.Interval / 2)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-r.joined:
+			// The remote node lost its keys, the key of the next interval is exchanged
+			// again as well once its time has come
+			timer.Stop()
+			current := r.peer.EpochInterval(time.Now())
+			r.establishMLKEM(ctx, current)
+			next = current + 1
+			continue
+		case <-timer.C:
+		}
+		r.establishMLKEM(ctx, next)
+		next++
+	}
+}
+
+// peerJoined is called once a new instance of the remote node completed the role
+// handshake.
+func (r *peerRunner) peerJoined() {
+	select {
+	case r.joined <- struct{}{}:
+	default:
+	}
+}
+
+// establishMLKEM runs the ML-KEM exchange of the key of interval generation if this node
+// is its PRIMARY. A failed exchange is repeated after ARNIKA_ACK_TIMEOUT until the
+// current interval ends, afterwards the nodes keep using the key of the previous interval.
+func (r *peerRunner) establishMLKEM(ctx context.Context, generation uint64) {
+	if !r.isPrimary(generation) || r.election.remoteLeft() {
+		return
+	}
+	logger := r.log.With(logging.KeyRole, metrics.RolePrimary, logging.KeyInterval, generation)
+	ctx, cancel := context.WithDeadline(ctx, r.peer.IntervalStart(r.peer.EpochInterval(time.Now())+1))
+	defer cancel()
+	for {
+		err := r.exchangeMLKEM(ctx, generation)
+		if err == nil {
+			metrics.MLKEMExchanges.Inc(r.peer.LogName(), metrics.RolePrimary, "success")
+			logger.Info("ML-KEM key established", "level", r.kem.Level())
+			return
+		}
+		if canceled(ctx) {
+			return
+		}
+		metrics.MLKEMExchanges.Inc(r.peer.LogName(), metrics.RolePrimary, "failure")
+		logger.Warn("ML-KEM exchange failed", "address", r.peer.ServerAddress, logging.KeyError, err)
+		if sleep(ctx, r.cfg.ArnikaAckTimeout) != nil {
+			if !canceled(ctx) {
+				logger.Error("no ML-KEM key established for interval, keeping the previous key")
+			}
+			return
+		}
+	}
+}
+
+// exchangeMLKEM sends the encapsulation key of a fresh decapsulation key to the peer and
+// stores the key derived from the ciphertext it answers with.
+func (r *peerRunner) exchangeMLKEM(ctx context.Context, generation uint64) error {
+	dk, err := r.kem.Initiate()
+	if err != nil {
+		return err
+	}
+	req := &auth.KEM{Sender: r.election.nonce(), Generation: generation, Data: dk.Encapsulator().Bytes()}
+	ciphertext, err := udpKEM(ctx, r.peer.ServerAddress, []byte(r.peer.ArnikaPSK), req, r.cfg.ArnikaPeerTimeout, r.cfg.MaxClockSkew)
+	if err != nil {
+		return err
+	}
+	return r.kem.Complete(dk, generation, ciphertext)
+}
+
+// respondMLKEM answers an ML-KEM exchange started by the PRIMARY of interval generation.
+func (r *peerRunner) respondMLKEM(generation uint64, encapsulationKey []byte) ([]byte, error) {
+	ciphertext, err := r.kem.Respond(generation, encapsulationKey)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.MLKEMExchanges.Inc(r.peer.LogName(), metrics.RoleBackup, result)
+	return ciphertext, err
+}
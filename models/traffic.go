@@ -0,0 +1,17 @@
+package models
+
+// Traffic holds the byte counters of a WireGuard peer.
+type Traffic struct {
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// Since returns the bytes received and transmitted since base was taken. Counters
+// lower than base were reset, e.g. because the peer was reconfigured, so all bytes
+// counted since the reset are returned.
+func (t Traffic) Since(base Traffic) int64 {
+	if t.ReceiveBytes < base.ReceiveBytes || t.TransmitBytes < base.TransmitBytes {
+		return t.ReceiveBytes + t.TransmitBytes
+	}
+	return t.ReceiveBytes - base.ReceiveBytes + t.TransmitBytes - base.TransmitBytes
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+	"github.com/arnika-project/arnika/repositories"
+	"github.com/arnika-project/arnika/services"
+)
+
+// peerRunner drives the key rotation for a single Arnika peer. Every peer has
+// its own role election, UDP exchange and PSK pipeline so that a failing peer
+// does not stall the others.
+type peerRunner struct {
+	cfg       *config.Config
+	peer      *config.Peer
+	qkd       *services.KeyReaderService
+	pqc       *services.KeyReaderService
+	keyWriter *services.KeyWriterService
+	result    chan keyRequest
+	skip      chan bool
+	rekey     chan struct{}
+	log       *slog.Logger
+	state     peerState
+	election  *election
+	grace     grace
+	volume    volume
+	// kem is the ML-KEM exchange of an ML-KEM PQC key source, nil if not configured
+	kem    *repositories.MLKEMRepository
+	joined chan struct{}
+	// pool is the KMS key pool of the QKD key source, nil if not configured
+	pool *repositories.KMSKeyPool
+	// left carries the BYE of the remote node to leftLoop, true if it invalidated its PSK
+	left chan bool
+	// exchanging is true while the PRIMARY waits for the reply to its key ID
+	exchanging atomic.Bool
+	// lastRequest is the unix time in nanoseconds the BACKUP last received a key ID
+	lastRequest atomic.Int64
+	// setupErr is set if the peer could not be set up, the runner is not started then
+	setupErr error
+}
+
+func newPeerRunner(cfg *config.Config, peer *config.Peer) (*peerRunner, error) {
+	keyWriter, err := getKeyWriterService(peer)
+	if err != nil {
+		return nil, err
+	}
+	election, err := newElection(peer.ArnikaID)
+	if err != nil {
+		return nil, err
+	}
+	qkd, err := getQKDService(cfg, peer)
+	if err != nil {
+		return nil, err
+	}
+	pqc, err := getPQCService(cfg, peer)
+	if err != nil {
+		_ = qkd.Close()
+		return nil, err
+	}
+	var kem *repositories.MLKEMRepository
+	if pqc != nil {
+		kem, _ = pqc.Repository().(*repositories.MLKEMRepository)
+	}
+	pool, _ := qkd.Repository().(*repositories.KMSKeyPool)
+	return &peerRunner{
+		cfg:       cfg,
+		peer:      peer,
+		qkd:       qkd,
+		pqc:       pqc,
+		keyWriter: keyWriter,
+		result:    make(chan keyRequest, 1),
+		skip:      make(chan bool, 1),
+		rekey:     make(chan struct{}, 1),
+		log:       slog.With(logging.KeyPeer, peer.LogName()),
+		election:  election,
+		kem:       kem,
+		joined:    make(chan struct{}, 1),
+		pool:      pool,
+		left:      make(chan bool, 1),
+	}, nil
+}
+
+// failedRunner returns the runner of a peer that could not be set up. It is only
+// reported by the health endpoints, so the other peers keep running.
+func failedRunner(cfg *config.Config, peer *config.Peer, err error) *peerRunner {
+	r := &peerRunner{
+		cfg:      cfg,
+		peer:     peer,
+		log:      slog.With(logging.KeyPeer, peer.LogName()),
+		setupErr: err,
+	}
+	r.state.setError(err)
+	return r
+}
+
+// close releases the key sources of the runner.
+func (r *peerRunner) close() {
+	if err := r.qkd.Close(); err != nil {
+		r.log.Warn("failed to close QKD key reader", logging.KeyError, err)
+	}
+	if r.pqc != nil {
+		if err := r.pqc.Close(); err != nil {
+			r.log.Warn("failed to close PQC key reader", logging.KeyError, err)
+		}
+	}
+}
+
+// pskError attaches the error class reported to the PRIMARY in a NACK to a
+// failure of the PSK pipeline.
+type pskError struct {
+	class auth.ErrorClass
+	err   error
+}
+
+func (e *pskError) Error() string { return e.err.Error() }
+
+func (e *pskError) Unwrap() error { return e.err }
+
+// errorClass returns the NACK error class for a failure of the PSK pipeline.
+func errorClass(err error) auth.ErrorClass {
+	if err == nil {
+		return auth.ErrorNone
+	}
+	var pe *pskError
+	if errors.As(err, &pe) {
+		return pe.class
+	}
+	return auth.ErrorInternal
+}
+
+// kmsFailed logs a failed KMS request. Errors the KMS answers the same way until the
+// configuration is fixed carry a hint.
+func (r *peerRunner) kmsFailed(logger *slog.Logger, msg string, err error) {
+	r.state.setError(err)
+	switch {
+	case errors.Is(err, repositories.ErrSAEUnauthorized):
+		logger = logger.With("hint", "check the client certificate and the SAE ID in KMS_URL")
+	case errors.Is(err, repositories.ErrEndpointNotFound):
+		logger = logger.With("hint", "check the URL and the SAE ID in KMS_URL")
+	case errors.Is(err, repositories.ErrBadRequest):
+		logger = logger.With("hint", "check the SAE ID in KMS_URL")
+	case errors.Is(err, repositories.ErrKeyNotFound):
+		logger = logger.With("hint", "check that both nodes list paired KMEs in KMS_URL in the same order")
+	case errors.Is(err, repositories.ErrKeyExhausted):
+		logger = logger.With("hint", "the KMS ran out of keys, retrying after KMS_RETRY_INTERVAL")
+	}
+	logger.Error(msg, "qkd_source", r.peer.QKDSource, logging.KeyError, err)
+}
+
+// invalidateTunnel configures a random PSK on the WireGuard peer.
+func (r *peerRunner) invalidateTunnel(ctx context.Context, logger *slog.Logger) {
+	logger.Error("configure random PSK to invalidate WireGuard session")
+	// The tunnel is invalidated even if the deadline of the failed rotation expired.
+	if err := r.randomPSK(context.WithoutCancel(ctx)); err != nil {
+		logger.Error("failed to configure random PSK", logging.KeyError, err)
+	}
+}
+
+// randomPSK replaces the PSK of the WireGuard peer with a random one.
+func (r *peerRunner) randomPSK(ctx context.Context) error {
+	metrics.TunnelInvalidations.Inc(r.peer.LogName())
+	if err := r.keyWriter.InvalidateTunnel(ctx); err != nil {
+		return err
+	}
+	metrics.TunnelInvalidated.Set(1, r.peer.LogName())
+	return nil
+}
+
+// startup applies the STARTUP_POLICY before the first rotation. With PolicyInvalidate
+// the PSK left on the WireGuard peer, which Arnika can not vouch for, is replaced until
+// the first key exchange succeeds.
+func (r *peerRunner) startup(ctx context.Context) error {
+	metrics.PSKKeyed.Set(0, r.peer.LogName())
+	if r.peer.StartupPolicy != config.PolicyInvalidate {
+		return nil
+	}
+	r.log.Info("configure random PSK until the first key exchange", "policy", r.peer.StartupPolicy)
+	if err := r.randomPSK(ctx); err != nil {
+		return fmt.Errorf("failed to configure random PSK on startup: %w", err)
+	}
+	return nil
+}
+
+// udpPeer returns the binding used by udpServer to hand key IDs to this runner.
+func (r *peerRunner) udpPeer() *udpPeer {
+	p := &udpPeer{
+		psk:      []byte(r.peer.ArnikaPSK),
+		result:   r.result,
+		election: r.election,
+		log:      r.log.With(logging.KeyRole, metrics.RoleBackup),
+		left:     r.peerLeft,
+		joined:   r.peerJoined,
+	}
+	if r.kem != nil {
+		p.kem = r.respondMLKEM
+	}
+	return p
+}
+
+// peerLeft is called by the UDP server once the remote node shut down. The BYE is
+// handed to leftLoop, a pending one is merged so that an invalidation is not lost.
+func (r *peerRunner) peerLeft(invalidated bool) {
+	for {
+		select {
+		case r.left <- invalidated:
+			return
+		case pending := <-r.left:
+			invalidated = invalidated || pending
+		}
+	}
+}
+
+// leftLoop applies the SHUTDOWN_POLICY after the remote node shut down. If the remote
+// node invalidated its PSK the tunnel is broken anyway, so it is invalidated here as well.
+func (r *peerRunner) leftLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case invalidated := <-r.left:
+			if invalidated || r.peer.ShutdownPolicy == config.PolicyInvalidate {
+				r.invalidateTunnel(ctx, r.log)
+			}
+		}
+	}
+}
+
+// shutdown applies the SHUTDOWN_POLICY and tells the remote node with a BYE that this
+// node leaves. It is called once the loops of the runner have stopped.
+func (r *peerRunner) shutdown(ctx context.Context) {
+	invalidated := false
+	if r.peer.ShutdownPolicy == config.PolicyInvalidate {
+		r.log.Info("configure random PSK on shutdown", "policy", r.peer.ShutdownPolicy)
+		if err := r.randomPSK(ctx); err != nil {
+			r.log.Error("failed to configure random PSK", logging.KeyError, err)
+		} else {
+			invalidated = true
+		}
+	}
+	if err := udpBye(r.peer.ServerAddress, []byte(r.peer.ArnikaPSK), r.election.bye(invalidated)); err != nil {
+		r.log.Warn("failed to send BYE", "address", r.peer.ServerAddress, logging.KeyError, err)
+	}
+}
+
+// run starts the BACKUP receiver, the PRIMARY ticker loop, the PSK age watchdog, the
+// traffic volume trigger, the ML-KEM exchange, the PQC key source watcher and the
+// shutdown handler of the remote node in the background, all of them stop once ctx is
+// done.
+func (r *peerRunner) run(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() { r.backupLoop(ctx) })
+	wg.Go(func() { r.tickerLoop(ctx) })
+	wg.Go(func() { r.watchdog(ctx) })
+	wg.Go(func() { r.trafficLoop(ctx) })
+	wg.Go(func() { r.kemLoop(ctx) })
+	wg.Go(func() { r.watchPQC(ctx) })
+	wg.Go(func() { r.leftLoop(ctx) })
+}
+
+func (r *peerRunner) backupLoop(ctx context.Context) {
+	for {
+		var req keyRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req = <-r.result:
+		}
+		// The key of a request must be installed within an interval, afterwards
+		// the PRIMARY has already moved on to the next key.
+		rctx, cancel := context.WithTimeout(ctx, r.peer.Interval)
+		r.handleRequest(rctx, req)
+		cancel()
+	}
+}
+
+// handleRequest retrieves, confirms and installs the key of a request of the PRIMARY.
+func (r *peerRunner) handleRequest(ctx context.Context, req keyRequest) {
+	logger := r.log.With(logging.KeyRole, metrics.RoleBackup, logging.KeyKeyID, req.keyID)
+	if r.exchanging.Load() {
+		r.roleConflict(logger, "split_brain")
+		req.reply(auth.ErrorConflict, nil)
+		return
+	}
+	r.lastRequest.Store(time.Now().UnixNano())
+	select {
+	case r.skip <- true:
+	default:
+	}
+	logger.Info("request QKD key for key_id", "qkd_source", r.peer.QKDSource)
+	key, err := r.qkd.GetKeyByID(ctx, &req.keyID)
+	if err != nil {
+		if !canceled(ctx) {
+			r.kmsFailed(logger, "failed to retrieve QKD key for key_id", err)
+		}
+		req.reply(auth.ErrorKMS, nil)
+		return
+	}
+	psk, _, err := r.preparePSK(ctx, key.Key, req.pqcID, logger)
+	if err == nil && !auth.VerifyConfirmation(psk, req.keyID, req.confirmation) {
+		clear(psk)
+		metrics.PSKMismatches.Inc(r.peer.LogName())
+		err = &pskError{auth.ErrorMismatch, errPSKMismatch}
+	}
+	if err != nil {
+		if !canceled(ctx) {
+			r.pskFailed(ctx, logger, err)
+		}
+		req.reply(errorClass(err), nil)
+		return
+	}
+	// The PRIMARY only installs the PSK if the ACK arrives before the activation time
+	if !time.Now().Before(req.activation) {
+		clear(psk)
+		err = &pskError{auth.ErrorInternal, errors.New("PSK not ready before activation")}
+		r.pskFailed(ctx, logger, err)
+		req.reply(errorClass(err), nil)
+		return
+	}
+	// The ACK promises the installation, only SetPSK is left once it is sent
+	req.reply(auth.ErrorNone, auth.Confirmation(psk, req.keyID))
+	r.installAcknowledged(ctx, req.keyID, psk, metrics.RoleBackup, req.activation, logger)
+}
+
+// canceled reports whether ctx has been canceled by a shutdown. Failures caused by
+// the shutdown are not reported, an expired rotation deadline is a regular failure.
+func canceled(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// tickerLoop runs once per epoch interval, see config.Peer.EpochInterval, once more
+// after KMS_RETRY_INTERVAL if the PRIMARY failed to rotate the key, and whenever
+// trafficLoop requests an early rotation.
+// Each rotation has to finish before the next interval starts.
+func (r *peerRunner) tickerLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		if _, known := r.election.lowerRank(); !known {
+			r.handshake(ctx)
+		}
+		intervalNum := r.peer.EpochInterval(time.Now())
+		wake := r.peer.IntervalStart(intervalNum + 1)
+		primary := r.isPrimary(intervalNum)
+		role := metrics.RoleBackup
+		if primary {
+			role = metrics.RolePrimary
+		}
+		logger := r.log.With(logging.KeyRole, role, logging.KeyInterval, intervalNum)
+		r.detectNoLeader(intervalNum, logger)
+		r.state.tick(intervalNum, role)
+		if r.pool != nil {
+			// Keys are prefetched ahead of the intervals this node is PRIMARY of
+			r.pool.SetActive(primary || r.isPrimary(intervalNum+1))
+		}
+		if !primary {
+			select {
+			case <-r.skip:
+			default:
+				logger.Info("BACKUP for interval, waiting for key_id from peer")
+			}
+		} else {
+			select {
+			case <-r.skip:
+			default:
+			}
+			if r.election.remoteLeft() {
+				// Without the remote node the key exchange fails and would invalidate the tunnel
+				logger.Info("peer shut down, skipping rotation until it returns")
+			} else if !r.rotate(ctx, wake, logger) {
+				wake = time.Now().Add(r.peer.KMSRetryInterval)
+			}
+			// A request for an early rotation is answered by the rotation just done
+			select {
+			case <-r.rekey:
+			default:
+			}
+		}
+		if !r.wait(ctx, wake) {
+			return
+		}
+	}
+}
+
+// rotate fetches a new key as PRIMARY and exchanges it with the BACKUP before deadline.
+// It reports whether the rotation succeeded; on false the caller retries after
+// KMS_RETRY_INTERVAL.
+func (r *peerRunner) rotate(ctx context.Context, deadline time.Time, logger *slog.Logger) bool {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	logger.Info("request QKD key", "qkd_source", r.peer.QKDSource)
+	key, err := r.qkd.GetNewKey(ctx)
+	if err != nil {
+		if !canceled(ctx) {
+			r.kmsFailed(logger, "failed to retrieve QKD key", err)
+		}
+		return false
+	}
+	logger.Info("PRIMARY for interval")
+	select {
+	case <-r.skip:
+		return true
+	default:
+	}
+	if !key.IsManaged() && key.ID == nil {
+		logger.Error("received empty key_id from KMS, skipping this interval")
+		return true
+	}
+	return r.exchangeKey(ctx, *key.ID, key.Key, logger.With(logging.KeyKeyID, *key.ID))
+}
+
+// isPrimary returns the role of this node for the epoch interval intervalNum. Until
+// the rank of the remote node is known this node stays BACKUP, as a role derived from
+// the Arnika IDs alone may make both nodes PRIMARY.
+func (r *peerRunner) isPrimary(intervalNum uint64) bool {
+	if r.election.remoteLeft() {
+		return true
+	}
+	lower, known := r.election.lowerRank()
+	return known && r.peer.ElectPrimary(intervalNum, lower)
+}
+
+// handshake exchanges the election rank with the remote node.
+func (r *peerRunner) handshake(ctx context.Context) {
+	remote, err := udpHello(ctx, r.peer.ServerAddress, []byte(r.peer.ArnikaPSK), r.election.hello(), r.cfg.ArnikaPeerTimeout, r.cfg.MaxClockSkew)
+	if err != nil {
+		r.log.Warn("role handshake failed, staying BACKUP", "address", r.peer.ServerAddress, logging.KeyError, err)
+		return
+	}
+	if r.election.isSelf(remote) {
+		r.log.Warn("role handshake answered with our own rank, staying BACKUP", "address", r.peer.ServerAddress)
+		return
+	}
+	if r.election.learn(remote) {
+		r.log.Info("role handshake completed", "remote_id", remote.id)
+		r.peerJoined()
+	}
+}
+
+// detectNoLeader reports a conflict if this node was BACKUP for the previous interval
+// but did not receive a key ID, i.e. both nodes considered themselves BACKUP. Without
+// the remote rank this node is BACKUP anyway and the handshake is repeated every tick.
+func (r *peerRunner) detectNoLeader(intervalNum uint64, logger *slog.Logger) {
+	role, prev, ticked := r.state.current()
+	if !ticked || role != metrics.RoleBackup || prev+1 != intervalNum {
+		return
+	}
+	if _, known := r.election.lowerRank(); !known {
+		return
+	}
+	if r.lastRequest.Load() < r.peer.IntervalStart(prev).UnixNano() {
+		r.roleConflict(logger, "no_leader")
+	}
+}
+
+// roleConflict records that both nodes took the same role and forces a new handshake.
+func (r *peerRunner) roleConflict(logger *slog.Logger, kind string) {
+	logger.Warn("role conflict detected, repeating role handshake", "conflict", kind)
+	metrics.RoleConflicts.Inc(r.peer.LogName(), kind)
+	r.election.forget()
+}
+
+// exchangeKey sends the key ID to the BACKUP together with the activation time and the
+// confirmation of the derived PSK. The BACKUP acknowledges it with the confirmation of
+// the same PSK before the activation time, at which both nodes install the PSK. Without
+// the confirmation of the BACKUP by then the PSK is not installed. It reports whether
+// the PSK was installed.
+func (r *peerRunner) exchangeKey(ctx context.Context, keyID string, qkd []byte, logger *slog.Logger) bool {
+	activation := time.Now().Add(r.cfg.ActivationDelay)
+	psk, pqcID, err := r.preparePSK(ctx, qkd, "", logger)
+	if err != nil {
+		if !canceled(ctx) {
+			r.pskFailed(ctx, logger, err)
+		}
+		return false
+	}
+	payload := &auth.KeyPayload{Sender: r.election.nonce(), KeyID: keyID, Activation: activation, Confirmation: auth.Confirmation(psk, keyID), PQCID: pqcID}
+	logger.Info("send key_id to peer", "address", r.peer.ServerAddress, "activation", activation)
+	r.exchanging.Store(true)
+	ackTimeout := min(time.Until(activation), r.cfg.ArnikaAckTimeout)
+	err = udpClient(ctx, r.peer.ServerAddress, []byte(r.peer.ArnikaPSK), payload, r.cfg.ArnikaPeerTimeout, ackTimeout, r.cfg.MaxClockSkew, logger)
+	r.exchanging.Store(false)
+	if err != nil {
+		clear(psk)
+		if !canceled(ctx) {
+			r.peerFailed(ctx, logger, err)
+		}
+		return false
+	}
+	return r.installAcknowledged(ctx, keyID, psk, metrics.RolePrimary, activation, logger)
+}
+
+// installAcknowledged installs an acknowledged PSK in the given role. The other node
+// switches to the new PSK at the same time, keeping the previous one would leave both
+// nodes with different PSKs, so a failure invalidates the tunnel regardless of the grace
+// period.
+func (r *peerRunner) installAcknowledged(ctx context.Context, keyID string, psk []byte, role string, activation time.Time, logger *slog.Logger) bool {
+	if err := r.installPSK(ctx, keyID, psk, role, activation); err != nil {
+		if !canceled(ctx) {
+			logger.Error("failed to configure PSK acknowledged by peer", logging.KeyError, err)
+			r.state.setError(err)
+			r.invalidateTunnel(ctx, logger)
+		}
+		return false
+	}
+	return true
+}
+
+// peerFailed handles a key ID the BACKUP did not confirm. If the BACKUP could not
+// retrieve the key both sides still share the current PSK and the exchange is retried
+// with a new key. Otherwise the BACKUP state is unknown or its tunnel already
+// invalidated, so the tunnel is invalidated here as well.
+func (r *peerRunner) peerFailed(ctx context.Context, logger *slog.Logger, err error) {
+	r.state.setError(err)
+	if errors.Is(err, errPSKMismatch) {
+		metrics.PSKMismatches.Inc(r.peer.LogName())
+	}
+	var nack *auth.NackError
+	if errors.As(err, &nack) {
+		metrics.PeerNacks.Inc(r.peer.LogName(), nack.Class.String())
+		if nack.Class == auth.ErrorKMS || nack.Class == auth.ErrorSuperseded || nack.Class == auth.ErrorConflict {
+			logger.Warn("peer did not install key_id, retrying with a new key", "class", nack.Class.String())
+			return
+		}
+	}
+	logger.Error("peer did not confirm key_id", "address", r.peer.ServerAddress, logging.KeyError, err)
+	r.graceFailed(ctx, logger, err)
+}
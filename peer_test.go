@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/metrics"
+	"github.com/arnika-project/arnika/services"
+)
+
+// staticKMS returns the same QKD key for every key ID.
+type staticKMS struct{ key []byte }
+
+func (k staticKMS) GetNewKey(context.Context) (string, []byte, error) {
+	return "key-1", append([]byte(nil), k.key...), nil
+}
+
+func (k staticKMS) GetKeyByID(context.Context, *string) ([]byte, error) {
+	return append([]byte(nil), k.key...), nil
+}
+
+// reply records the answer of the BACKUP and whether the PSK was installed by then.
+type reply struct {
+	class     auth.ErrorClass
+	installed int
+	at        time.Time
+}
+
+func TestHandleRequest_AckBeforeActivation(t *testing.T) {
+	qkd := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name        string
+		delay       time.Duration // activation time relative to the request
+		setErr      error
+		want        auth.ErrorClass
+		installed   int
+		invalidated bool // the acknowledged PSK could not be installed
+	}{
+		{name: "activation ahead", delay: 50 * time.Millisecond, want: auth.ErrorNone, installed: 1},
+		{name: "activation passed", delay: -time.Millisecond, want: auth.ErrorInternal},
+		{name: "SetPSK failed", delay: 50 * time.Millisecond, setErr: errors.New("no such device"), want: auth.ErrorNone, invalidated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRunner()
+			r.peer.Mode = "AtLeastQkdRequired"
+			r.peer.GraceIntervals = 1
+			r.qkd = services.NewManagedKeyReaderService(staticKMS{key: qkd})
+			w := withWriter(r)
+			w.setErr = tt.setErr
+			activation := time.Now().Add(tt.delay)
+			var got []reply
+			r.handleRequest(t.Context(), keyRequest{
+				keyID:        "key-1",
+				activation:   activation,
+				confirmation: auth.Confirmation(qkd, "key-1"),
+				reply: func(class auth.ErrorClass, _ []byte) {
+					got = append(got, reply{class, w.installed(), time.Now()})
+				},
+			})
+			if len(got) != 1 {
+				t.Fatalf("expected a single reply, got %d", len(got))
+			}
+			if got[0].class != tt.want || got[0].installed != 0 {
+				t.Fatalf("expected reply %s before the installation, got %s after %d", tt.want, got[0].class, got[0].installed)
+			}
+			if tt.want == auth.ErrorNone && !got[0].at.Before(activation) {
+				t.Fatal("expected the ACK before the activation time")
+			}
+			if w.installed() != tt.installed {
+				t.Fatalf("expected %d installations, got %d", tt.installed, w.installed())
+			}
+			if tt.installed > 0 && time.Now().Before(activation) {
+				t.Fatal("expected the PSK not to be installed before the activation time")
+			}
+			if invalidated := w.invalidations() > 0; invalidated != tt.invalidated {
+				t.Fatalf("tunnel invalidated %t, want %t", invalidated, tt.invalidated)
+			}
+		})
+	}
+}
+
+func TestExchangeKey_NoConfirmation(t *testing.T) {
+	// Nobody answers on the address of the peer
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testRunner()
+	r.cfg = &config.Config{ArnikaPeerTimeout: 20 * time.Millisecond, ArnikaAckTimeout: time.Second, ActivationDelay: 100 * time.Millisecond, MaxClockSkew: time.Minute}
+	r.peer.Mode = "AtLeastQkdRequired"
+	r.peer.GraceIntervals = 1
+	r.peer.ServerAddress = conn.LocalAddr().String()
+	w := withWriter(r)
+	start := time.Now()
+	if r.exchangeKey(t.Context(), "key-1", []byte("0123456789abcdef0123456789abcdef"), r.log) {
+		t.Fatal("expected the exchange to fail without confirmation")
+	}
+	_ = conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the PRIMARY to give up at the activation time, waited %s", elapsed)
+	}
+	if w.installed() != 0 {
+		t.Fatal("expected the PSK not to be installed without confirmation")
+	}
+	if w.invalidations() != 0 {
+		t.Fatal("expected the failure to be tolerated within the grace period")
+	}
+	if r.grace.failed != 1 {
+		t.Fatal("expected the failure to be counted by the grace policy")
+	}
+}
+
+func TestInstallAcknowledged(t *testing.T) {
+	for _, role := range []string{metrics.RolePrimary, metrics.RoleBackup} {
+		t.Run(role, func(t *testing.T) {
+			r := testRunner()
+			r.peer.GraceIntervals = 10
+			w := withWriter(r)
+			activation := time.Now()
+			if !r.installAcknowledged(t.Context(), "key-1", []byte("psk"), role, activation, r.log) {
+				t.Fatal("expected the PSK to be installed")
+			}
+			if w.installed() != 1 || w.invalidations() != 0 {
+				t.Fatalf("expected one installation without invalidation, got %d and %d", w.installed(), w.invalidations())
+			}
+
+			// Failing to install a PSK the other node switches to is never tolerated
+			w.setErr = errors.New("no such device")
+			if r.installAcknowledged(t.Context(), "key-2", []byte("psk"), role, activation, r.log) {
+				t.Fatal("expected the installation to fail")
+			}
+			if w.invalidations() != 1 {
+				t.Fatal("expected the tunnel to be invalidated within the grace period")
+			}
+		})
+	}
+}
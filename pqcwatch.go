@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// watchPQC watches the PQC key source, e.g. the PQC key file, until ctx is done. If the
+// key source can not be watched, e.g. because the directory of the file is missing, it
+// is still read at every rotation.
+func (r *peerRunner) watchPQC(ctx context.Context) {
+	if r.pqc == nil {
+		return
+	}
+	if err := r.pqc.Watch(ctx, r.pqcChanged); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		r.log.Warn("failed to watch PQC key source, reading it at every rotation only", "pqc_source", r.peer.PQCSource, logging.KeyError, err)
+	}
+}
+
+// pqcChanged is called with the generation number and ID once the key of the PQC key
+// source changed. Both nodes see the new key, so only the PRIMARY of the current
+// interval rotates the PSK right away instead of waiting for the next interval.
+func (r *peerRunner) pqcChanged(number uint64, id string) {
+	metrics.PQCGeneration.Set(float64(number), r.peer.LogName())
+	r.log.Info("PQC key changed", "pqc_generation", number, "pqc_id", id)
+	if r.election.remoteLeft() || !r.isPrimary(r.peer.EpochInterval(time.Now())) {
+		return
+	}
+	select {
+	case r.rekey <- struct{}{}:
+		r.log.Info("rotating PSK early for the new PQC key", "pqc_id", id)
+	default:
+	}
+}
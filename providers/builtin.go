@@ -0,0 +1,183 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/repositories"
+)
+
+// Schemes of the key providers run as executable, see repositories.ExecRepository.
+const (
+	schemeExec        = "exec"
+	schemeExecManaged = "exec+id"
+)
+
+// execTimeout is the time a key provider executable may run unless the URI sets timeout.
+const execTimeout = 10 * time.Second
+
+// TLS material of a single ETSI 014 URI, it takes precedence over CERTIFICATE,
+// PRIVATE_KEY and CA_CERTIFICATE.
+const (
+	paramCertificate   = "cert"
+	paramPrivateKey    = "key"
+	paramCACertificate = "cacert"
+)
+
+// newETSI014 requests keys from the KMS endpoints of etsi014+https and etsi014+http URIs
+// in order of preference, optionally through a key pool.
+func newETSI014(env Env, uris []*url.URL) (any, error) {
+	cfg, peer := env.Config, env.Peer
+	var endpoints []repositories.KMSEndpoint
+	for _, endpoint := range kmsEndpoints(cfg, uris) {
+		endpoints = append(endpoints, repositories.KMSEndpoint{
+			URL:  endpoint.URL,
+			Auth: repositories.NewKMSClientCertificateAuth(endpoint.Certificate, endpoint.PrivateKey, endpoint.CACertificate),
+		})
+	}
+	kmsRepo := repositories.NewHTTPKMSRepository(endpoints, peer.KMSRequestMethod, cfg.KMSHTTPTimeout, cfg.KMSBackoffMaxRetries, cfg.KMSBackoffBaseDelay, cfg.KMSBreakerThreshold, cfg.KMSBreakerCooldown)
+	if cfg.KMSPoolSize > 0 {
+		pool := repositories.NewKMSKeyPool(kmsRepo, cfg.KMSPoolSize, cfg.KMSPoolMaxKeyAge, peer.KMSRetryInterval)
+		pool.Start()
+		return pool, nil
+	}
+	return kmsRepo, nil
+}
+
+// kmsEndpoints returns the KMS endpoints of etsi014+https and etsi014+http URIs. The mTLS files are taken
+// from the cert, key and cacert query parameters of a URI, which are not sent to the
+// KMS, or matched to the URIs by position otherwise, see config.Config.KMSEndpoints.
+func kmsEndpoints(cfg *config.Config, uris []*url.URL) []config.KMSEndpoint {
+	urls := make([]string, 0, len(uris))
+	params := make([]url.Values, 0, len(uris))
+	for _, uri := range uris {
+		kmsURL := *uri
+		kmsURL.Scheme = strings.TrimPrefix(uri.Scheme, "etsi014+")
+		query := uri.Query()
+		if query.Has(paramCertificate) || query.Has(paramPrivateKey) || query.Has(paramCACertificate) {
+			params = append(params, url.Values{
+				paramCertificate:   query[paramCertificate],
+				paramPrivateKey:    query[paramPrivateKey],
+				paramCACertificate: query[paramCACertificate],
+			})
+			query.Del(paramCertificate)
+			query.Del(paramPrivateKey)
+			query.Del(paramCACertificate)
+			kmsURL.RawQuery = query.Encode()
+		} else {
+			params = append(params, nil)
+		}
+		urls = append(urls, kmsURL.String())
+	}
+	endpoints := cfg.KMSEndpoints(urls)
+	for i, p := range params {
+		if v := p.Get(paramCertificate); v != "" {
+			endpoints[i].Certificate = v
+		}
+		if v := p.Get(paramPrivateKey); v != "" {
+			endpoints[i].PrivateKey = v
+		}
+		if v := p.Get(paramCACertificate); v != "" {
+			endpoints[i].CACertificate = v
+		}
+	}
+	return endpoints
+}
+
+// newFile reads the PQC key file of a file:///path URI. Its key IDs are the generations
+// of the file.
+func newFile(env Env, uris []*url.URL) (any, error) {
+	uri, err := single(uris)
+	if err != nil {
+		return nil, err
+	}
+	if (uri.Host != "" && uri.Host != "localhost") || !filepath.IsAbs(uri.Path) {
+		return nil, fmt.Errorf("file key source requires an absolute path, got: %s", uri)
+	}
+	if err := config.ValidatePQCFile(uri.Path); err != nil {
+		return nil, err
+	}
+	return repositories.NewFilePQCRepository(uri.Path, env.Peer.PQCMaxKeyAge), nil
+}
+
+// newMLKEM establishes keys with the ML-KEM exchange of a mlkem://peer?level=768 URI.
+// Its key IDs are the generations of the keys.
+func newMLKEM(env Env, uris []*url.URL) (any, error) {
+	uri, err := single(uris)
+	if err != nil {
+		return nil, err
+	}
+	level, err := mlkemLevel(uri)
+	if err != nil {
+		return nil, err
+	}
+	peer := env.Peer
+	if peer.ArnikaPSK == "" {
+		return nil, errors.New("ARNIKA_PSK is required as it authenticates the ML-KEM exchange")
+	}
+	return repositories.NewMLKEMRepository(level, func() uint64 {
+		return peer.EpochInterval(time.Now())
+	})
+}
+
+// mlkemLevel returns the ML-KEM parameter set of an ML-KEM key source URI, 768 if not
+// set. The key is exchanged with the Arnika peer, so peer is the only host.
+func mlkemLevel(uri *url.URL) (int, error) {
+	if uri.Host != "peer" {
+		return 0, fmt.Errorf("ML-KEM key source must be %s://peer, got: %s", uri.Scheme, uri)
+	}
+	level := 768
+	if v := uri.Query().Get("level"); v != "" {
+		var err error
+		if level, err = strconv.Atoi(v); err != nil {
+			return 0, fmt.Errorf("failed to parse ML-KEM level: %w", err)
+		}
+	}
+	if level != 768 && level != 1024 {
+		return 0, fmt.Errorf("ML-KEM level must be 768 or 1024, got: %d", level)
+	}
+	return level, nil
+}
+
+// newExec runs the executable of an exec:///path?arg=...&timeout=10s URI, a key ID
+// written by the executable is ignored.
+func newExec(env Env, uris []*url.URL) (any, error) {
+	repo, err := newExecRepository(uris)
+	if err != nil {
+		return nil, err
+	}
+	return repo.Unmanaged(), nil
+}
+
+// newExecManaged runs the executable of an exec+id:///path URI, which has to write the
+// key ID along with the key, see newExec.
+func newExecManaged(env Env, uris []*url.URL) (any, error) {
+	return newExecRepository(uris)
+}
+
+func newExecRepository(uris []*url.URL) (*repositories.ExecRepository, error) {
+	uri, err := single(uris)
+	if err != nil {
+		return nil, err
+	}
+	if uri.Host != "" || !filepath.IsAbs(uri.Path) {
+		return nil, fmt.Errorf("exec key source requires an absolute path, got: %s", uri)
+	}
+	query := uri.Query()
+	timeout := execTimeout
+	if v := query.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("failed to parse timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be positive, got: %s", timeout)
+		}
+	}
+	return repositories.NewExecRepository(uri.Path, query["arg"], timeout), nil
+}
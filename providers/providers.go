@@ -0,0 +1,118 @@
+// Package providers creates the key readers of key sources configured as URIs, e.g.
+// QKD_SOURCE and PQC_SOURCE. Every URI scheme is served by a registered Provider.
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/arnika-project/arnika/config"
+	"github.com/arnika-project/arnika/services"
+)
+
+// ErrUnknownScheme is returned by Open for a URI scheme without a registered provider.
+var ErrUnknownScheme = errors.New("unknown key source scheme")
+
+// Env holds the configuration a provider creates the key reader of a peer from. The URI
+// selects the key source, settings shared by all key sources are taken from Env.
+type Env struct {
+	Config *config.Config
+	Peer   *config.Peer
+}
+
+// Provider creates the key readers of a URI scheme.
+type Provider struct {
+	// Managed is set if the keys of the key source have IDs. The BACKUP requests the
+	// key of the PRIMARY by its ID, so the QKD key source must be managed.
+	Managed bool
+	// New returns the repository of the key source configured by uris, all of them of
+	// the scheme of the provider. The repository implements services.KeyReaderManaged
+	// if Managed is set, services.KeyReaderUnmanaged otherwise.
+	New func(env Env, uris []*url.URL) (any, error)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{
+		config.SchemeETSI014:     {Managed: true, New: newETSI014},
+		config.SchemeETSI014HTTP: {Managed: true, New: newETSI014},
+		config.SchemeFile:        {Managed: true, New: newFile},
+		config.SchemeMLKEM:       {Managed: true, New: newMLKEM},
+		schemeExec:               {Managed: false, New: newExec},
+		schemeExecManaged:        {Managed: true, New: newExecManaged},
+	}
+)
+
+// Register adds the provider of scheme. A scheme can only be registered once.
+func Register(scheme string, p Provider) error {
+	if scheme == "" || p.New == nil {
+		return fmt.Errorf("invalid provider for scheme %q", scheme)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := providers[scheme]; ok {
+		return fmt.Errorf("provider for scheme %q already registered", scheme)
+	}
+	providers[scheme] = p
+	return nil
+}
+
+// Lookup returns the provider of scheme.
+func Lookup(scheme string) (Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[scheme]
+	return p, ok
+}
+
+// Schemes returns the registered URI schemes in alphabetical order.
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(providers))
+	for scheme := range providers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the key reader service of the key source configured as comma separated
+// URIs in source.
+func Open(env Env, source string) (*services.KeyReaderService, error) {
+	uris, err := config.SourceURIs(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key source: %w", err)
+	}
+	if len(uris) == 0 {
+		return nil, errors.New("no key source configured")
+	}
+	scheme := uris[0].Scheme
+	p, ok := Lookup(scheme)
+	if !ok {
+		return nil, fmt.Errorf("%w %q, known schemes: %v", ErrUnknownScheme, scheme, Schemes())
+	}
+	repo, err := p.New(env, uris)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s key source: %w", scheme, err)
+	}
+	if p.Managed {
+		if managed, ok := repo.(services.KeyReaderManaged); ok {
+			return services.NewManagedKeyReaderService(managed), nil
+		}
+	} else if unmanaged, ok := repo.(services.KeyReaderUnmanaged); ok {
+		return services.NewUnmanagedKeyReaderService(unmanaged), nil
+	}
+	return nil, fmt.Errorf("provider of %s returned %T, which does not match its managed declaration %t", scheme, repo, p.Managed)
+}
+
+// single returns the only URI of a key source which does not support failover.
+func single(uris []*url.URL) (*url.URL, error) {
+	if len(uris) != 1 {
+		return nil, fmt.Errorf("%s key source takes a single URI, got %d", uris[0].Scheme, len(uris))
+	}
+	return uris[0], nil
+}
@@ -0,0 +1,172 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/arnika-project/arnika/config"
+)
+
+// unmanagedRepo is a key reader without key IDs.
+type unmanagedRepo struct{}
+
+func (unmanagedRepo) GetNewKey(context.Context) ([]byte, error) { return []byte("key"), nil }
+
+func testEnv() Env {
+	cfg := &config.Config{KMSHTTPTimeout: time.Second, KMSBreakerThreshold: 1, KMSBreakerCooldown: time.Second}
+	return Env{Config: cfg, Peer: &config.Peer{ArnikaPSK: "psk", Interval: time.Minute, KMSRequestMethod: "auto"}}
+}
+
+func TestOpen_BuiltinSchemes(t *testing.T) {
+	dir := t.TempDir()
+	provider := filepath.Join(dir, "provider.sh")
+	if err := os.WriteFile(provider, []byte("#!/bin/sh\necho dGVzdGtleQ==\necho key-1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	pqcFile := filepath.Join(dir, "pqc.key")
+	if err := os.WriteFile(pqcFile, []byte("dGVzdGtleQ=="), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source  string
+		managed bool
+	}{
+		{"etsi014+https://kms.example.com/api/v1/keys/SAE", true},
+		{"etsi014+http://localhost:8080/api/v1/keys/SAE", true},
+		{"file://" + pqcFile, true},
+		{"mlkem://peer?level=1024", true},
+		{"exec://" + provider + "?timeout=5s", false},
+		{"exec+id://" + provider, true},
+	}
+	for _, tt := range tests {
+		svc, err := Open(testEnv(), tt.source)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.source, err)
+		}
+		if svc.IsManaged() != tt.managed {
+			t.Errorf("%s: expected managed %t", tt.source, tt.managed)
+		}
+		_ = svc.Close()
+	}
+
+	svc, err := Open(testEnv(), "exec+id://"+provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := svc.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *key.ID != "key-1" || string(key.Key) != "testkey" {
+		t.Errorf("unexpected key %q with ID %q", key.Key, *key.ID)
+	}
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	if _, err := Open(testEnv(), "qrng://device"); !errors.Is(err, ErrUnknownScheme) {
+		t.Errorf("expected ErrUnknownScheme, got %v", err)
+	}
+	for _, source := range []string{
+		"",
+		"/usr/local/bin/qrng",
+		"file://pqc.key",
+		"file:///a,file:///b",
+		"file:///nonexistent/pqc.key",
+		"mlkem://peer?level=512",
+		"mlkem://other",
+		"exec://usr/local/bin/qrng",
+		"exec:///usr/local/bin/qrng?timeout=-1s",
+		"etsi014+https://kme-a, exec:///usr/local/bin/qrng",
+	} {
+		if _, err := Open(testEnv(), source); err == nil {
+			t.Errorf("expected an error for key source %q", source)
+		}
+	}
+}
+
+// TestOpen_KMSURL checks that the key sources derived from KMS_URL can be opened, also
+// for a KMS without TLS.
+func TestOpen_KMSURL(t *testing.T) {
+	t.Setenv("LISTEN_ADDRESS", "127.0.0.1:9999")
+	t.Setenv("SERVER_ADDRESS", "127.0.0.1:9998")
+	t.Setenv("WIREGUARD_INTERFACE", "wg0")
+	t.Setenv("WIREGUARD_PEER_PUBLIC_KEY", "H9adDtDHXhVzSI4QMScbftvQM49wGjmBT1g6dgynsHc=")
+	for _, kmsURL := range []string{"http://localhost:8080/api/v1/keys/CONSA", "https://kms.example.com/api/v1/keys/SAE"} {
+		t.Setenv("KMS_URL", kmsURL)
+		cfg, err := config.Parse()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", kmsURL, err)
+		}
+		svc, err := Open(Env{Config: cfg, Peer: &cfg.Peers[0]}, cfg.Peers[0].QKDSource)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", kmsURL, err)
+		}
+		if !svc.IsManaged() {
+			t.Errorf("%s: expected a managed key source", kmsURL)
+		}
+		_ = svc.Close()
+	}
+}
+
+func TestOpen_MLKEMRequiresArnikaPSK(t *testing.T) {
+	env := testEnv()
+	env.Peer.ArnikaPSK = ""
+	if _, err := Open(env, "mlkem://peer"); err == nil {
+		t.Error("expected an error for an ML-KEM key source without ARNIKA_PSK")
+	}
+}
+
+func TestKMSEndpoints(t *testing.T) {
+	cfg := &config.Config{Certificate: "a.crt,b.crt", PrivateKey: "client.key"}
+	uris, err := config.SourceURIs("etsi014+https://kme-a:8443/api/v1/keys/SAE?cert=/etc/kme-a.crt&cacert=/etc/ca.crt, etsi014+https://kme-b:8443/api/v1/keys/SAE?foo=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []config.KMSEndpoint{
+		{URL: "https://kme-a:8443/api/v1/keys/SAE", Certificate: "/etc/kme-a.crt", PrivateKey: "client.key", CACertificate: "/etc/ca.crt"},
+		{URL: "https://kme-b:8443/api/v1/keys/SAE?foo=bar", Certificate: "b.crt", PrivateKey: "client.key"},
+	}
+	if endpoints := kmsEndpoints(cfg, uris); !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("expected endpoints %#v, got %#v", expected, endpoints)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	newRepo := func(Env, []*url.URL) (any, error) { return unmanagedRepo{}, nil }
+	if err := Register("test+unmanaged", Provider{New: newRepo}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Register("test+unmanaged", Provider{New: newRepo}); err == nil {
+		t.Error("expected an error for a scheme registered twice")
+	}
+	if err := Register(config.SchemeFile, Provider{Managed: true, New: newRepo}); err == nil {
+		t.Error("expected an error for overriding a built-in scheme")
+	}
+	if err := Register("test+nil", Provider{}); err == nil {
+		t.Error("expected an error for a provider without constructor")
+	}
+	svc, err := Open(testEnv(), "test+unmanaged://source")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svc.IsManaged() {
+		t.Error("expected unmanaged key source")
+	}
+	if _, err := svc.GetKeyByID(context.Background(), new(string)); err == nil {
+		t.Error("expected GetKeyByID to fail for an unmanaged key source")
+	}
+
+	// A provider must return the kind of key reader it declares
+	if err := Register("test+mismatch", Provider{Managed: true, New: newRepo}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(testEnv(), "test+mismatch://source"); err == nil {
+		t.Error("expected an error for a provider returning an unmanaged key reader as managed")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+	"github.com/arnika-project/arnika/models"
+)
+
+// trafficPoll is the interval in which the byte counters of the WireGuard peer are read.
+const trafficPoll = 5 * time.Second
+
+// volume holds the byte counters of the WireGuard peer at the last PSK installation.
+type volume struct {
+	mu        sync.Mutex
+	base      models.Traffic
+	known     bool
+	triggered time.Time // last early rotation requested
+}
+
+// rebase records the counters at a PSK installation.
+func (v *volume) rebase(t models.Traffic) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.base = t
+	v.known = true
+}
+
+// since returns the bytes transferred since the last PSK installation. Without a known
+// installation the first reading becomes the base.
+func (v *volume) since(t models.Traffic) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.known {
+		v.base = t
+		v.known = true
+	}
+	return t.Since(v.base)
+}
+
+// trigger reports whether an early rotation may be requested, at most one per backoff.
+func (v *volume) trigger(backoff time.Duration) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.triggered) < backoff {
+		return false
+	}
+	v.triggered = time.Now()
+	return true
+}
+
+// rebaseTraffic records the counters of the WireGuard peer after a PSK installation.
+func (r *peerRunner) rebaseTraffic(ctx context.Context) {
+	if r.peer.RekeyBytes == 0 {
+		return
+	}
+	traffic, err := r.keyWriter.Traffic(ctx)
+	if err != nil {
+		r.log.Warn("failed to read WireGuard traffic counters", logging.KeyError, err)
+		return
+	}
+	r.volume.rebase(*traffic)
+	metrics.TrafficBytes.Set(0, r.peer.LogName())
+}
+
+// trafficLoop asks the ticker loop for an early rotation once more than REKEY_BYTES
+// have been transferred under the current PSK. Both nodes count about the same traffic,
+// so only the PRIMARY of the current interval asks. A failed early rotation is repeated
+// after KMS_RETRY_INTERVAL at the earliest.
+func (r *peerRunner) trafficLoop(ctx context.Context) {
+	if r.peer.RekeyBytes == 0 {
+		return
+	}
+	for sleep(ctx, trafficPoll) == nil {
+		r.checkTraffic(ctx)
+	}
+}
+
+// checkTraffic reads the byte counters of the WireGuard peer once and asks for an early
+// rotation if REKEY_BYTES is reached, see trafficLoop.
+func (r *peerRunner) checkTraffic(ctx context.Context) {
+	name := r.peer.LogName()
+	traffic, err := r.keyWriter.Traffic(ctx)
+	if err != nil {
+		r.log.Debug("failed to read WireGuard traffic counters", logging.KeyError, err)
+		return
+	}
+	bytes := r.volume.since(*traffic)
+	metrics.TrafficBytes.Set(float64(bytes), name)
+	if bytes < r.peer.RekeyBytes || !r.isPrimary(r.peer.EpochInterval(time.Now())) {
+		return
+	}
+	if !r.volume.trigger(r.peer.KMSRetryInterval) {
+		return
+	}
+	select {
+	case r.rekey <- struct{}{}:
+		metrics.VolumeRekeys.Inc(name)
+		r.log.Info("traffic volume reached REKEY_BYTES, rotating PSK early", "bytes", bytes, "rekey_bytes", r.peer.RekeyBytes)
+	default:
+	}
+}
+
+// wait pauses the ticker loop until wake or until an early rotation is requested.
+// It returns false once ctx is done.
+func (r *peerRunner) wait(ctx context.Context, wake time.Time) bool {
+	timer := time.NewTimer(time.Until(wake))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	case <-r.rekey:
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arnika-project/arnika/models"
+)
+
+func TestVolume_Since(t *testing.T) {
+	var v volume
+	steps := []struct {
+		name     string
+		rebase   bool // a PSK was installed at this reading
+		receive  int64
+		transmit int64
+		want     int64
+	}{
+		{name: "first reading becomes the base", receive: 1000, transmit: 500, want: 0},
+		{name: "bytes in both directions", receive: 1400, transmit: 700, want: 600},
+		{name: "counters unchanged", receive: 1400, transmit: 700, want: 600},
+		{name: "PSK installed", rebase: true, receive: 1500, transmit: 800, want: 0},
+		{name: "bytes since installation", receive: 1600, transmit: 850, want: 150},
+		{name: "receive counter reset", receive: 40, transmit: 900, want: 940},
+		{name: "PSK installed after reset", rebase: true, receive: 50, transmit: 900, want: 0},
+		{name: "transmit counter reset", receive: 60, transmit: 10, want: 70},
+	}
+	for _, step := range steps {
+		traffic := models.Traffic{ReceiveBytes: step.receive, TransmitBytes: step.transmit}
+		if step.rebase {
+			v.rebase(traffic)
+		}
+		if got := v.since(traffic); got != step.want {
+			t.Fatalf("%s: since = %d, want %d", step.name, got, step.want)
+		}
+	}
+}
+
+func TestVolume_Trigger(t *testing.T) {
+	var v volume
+	if !v.trigger(time.Hour) {
+		t.Fatal("expected the first early rotation to be requested")
+	}
+	if v.trigger(time.Hour) {
+		t.Fatal("expected a second early rotation within the backoff to be suppressed")
+	}
+	if !v.trigger(0) {
+		t.Fatal("expected an early rotation after the backoff")
+	}
+}
+
+// rekeyRequested reports whether the ticker loop was asked for an early rotation.
+func rekeyRequested(r *peerRunner) bool {
+	select {
+	case <-r.rekey:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCheckTraffic(t *testing.T) {
+	r := testRunner()
+	r.peer.RekeyBytes = 1000
+	r.peer.KMSRetryInterval = time.Hour
+	r.rekey = make(chan struct{}, 1)
+	w := withWriter(r)
+	// The remote node left, so this node is PRIMARY in every interval
+	r.election.learn(rank{2000, 1})
+	r.election.leave(rank{2000, 1})
+
+	w.setTraffic(5000, 5000)
+	r.rebaseTraffic(t.Context())
+	w.setTraffic(5400, 5500)
+	r.checkTraffic(t.Context())
+	if rekeyRequested(r) {
+		t.Fatal("expected no early rotation below REKEY_BYTES")
+	}
+	w.setTraffic(5600, 5500)
+	r.checkTraffic(t.Context())
+	if !rekeyRequested(r) {
+		t.Fatal("expected an early rotation at REKEY_BYTES")
+	}
+	w.setTraffic(6000, 6000)
+	r.checkTraffic(t.Context())
+	if rekeyRequested(r) {
+		t.Fatal("expected a failed early rotation to be repeated after KMS_RETRY_INTERVAL only")
+	}
+
+	// The counters start over once the PSK is installed
+	r.volume.triggered = time.Time{}
+	r.rebaseTraffic(t.Context())
+	r.checkTraffic(t.Context())
+	if rekeyRequested(r) {
+		t.Fatal("expected no early rotation after the PSK was installed")
+	}
+}
+
+func TestCheckTraffic_Backup(t *testing.T) {
+	r := testRunner()
+	r.peer.RekeyBytes = 1000
+	r.rekey = make(chan struct{}, 1)
+	w := withWriter(r)
+	// Take the BACKUP role of the current interval
+	r.election.learn(rank{2000, 1})
+	if r.isPrimary(r.peer.EpochInterval(time.Now())) {
+		r.election.learn(rank{1, 1})
+	}
+
+	r.rebaseTraffic(t.Context())
+	w.setTraffic(2000, 2000)
+	r.checkTraffic(t.Context())
+	if rekeyRequested(r) {
+		t.Fatal("expected only the PRIMARY to ask for an early rotation")
+	}
+}
@@ -0,0 +1,188 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime/secret"
+	"strings"
+	"time"
+)
+
+const (
+	// execMaxOutput bounds the stdout of a key provider, a key with its ID is far smaller.
+	execMaxOutput = 64 << 10
+	// execMaxStderr bounds the stderr of a key provider kept for the error message.
+	execMaxStderr = 1 << 10
+	// execMaxKeyID bounds the key ID, it has to fit the length byte of the DATA packet.
+	execMaxKeyID = 255
+	// execWaitDelay bounds the time the output of a killed provider is drained, e.g.
+	// if a child process it spawned still holds stdout.
+	execWaitDelay = time.Second
+)
+
+// execPath is the only environment variable passed to a key provider besides
+// ARNIKA_KEY_ID.
+const execPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// ErrExecKeyProvider is returned if a key provider failed or wrote an invalid answer.
+var ErrExecKeyProvider = errors.New("key provider failed")
+
+// ExecRepository runs an executable to get keys from a key source which is neither an
+// ETSI 014 KMS nor a file. The executable is started without a shell, with a minimal
+// environment and killed once the timeout expires. It writes the base64 encoded key on
+// the first line of stdout and optionally a key ID on the second line. To request a key
+// by ID, the executable is started with the ID in ARNIKA_KEY_ID.
+//
+// ExecRepository implements KeyReaderManaged and requires the key ID, see Unmanaged for
+// key sources without IDs. Which of both a key source uses is up to its registration in
+// the providers package.
+type ExecRepository struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+// NewExecRepository returns a repository running the executable at path with args.
+func NewExecRepository(path string, args []string, timeout time.Duration) *ExecRepository {
+	return &ExecRepository{path: path, args: args, timeout: timeout}
+}
+
+// GetNewKey runs the executable and returns the key and its ID.
+func (r *ExecRepository) GetNewKey(ctx context.Context) (string, []byte, error) {
+	id, key, err := r.run(ctx, "")
+	if err != nil {
+		return "", nil, err
+	}
+	if id == "" {
+		clear(key)
+		return "", nil, fmt.Errorf("%w: no key ID on the second line of stdout", ErrExecKeyProvider)
+	}
+	return id, key, nil
+}
+
+// GetKeyByID runs the executable with keyID in ARNIKA_KEY_ID and returns the key. A key
+// ID written by the executable must match keyID.
+func (r *ExecRepository) GetKeyByID(ctx context.Context, keyID *string) ([]byte, error) {
+	if keyID == nil || *keyID == "" {
+		return nil, fmt.Errorf("%w: empty key ID", ErrExecKeyProvider)
+	}
+	id, key, err := r.run(ctx, *keyID)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" && id != *keyID {
+		clear(key)
+		return nil, fmt.Errorf("%w: requested key %s, got %s", ErrExecKeyProvider, *keyID, id)
+	}
+	return key, nil
+}
+
+// Unmanaged returns the repository as KeyReaderUnmanaged, a key ID written by the
+// executable is ignored.
+func (r *ExecRepository) Unmanaged() *UnmanagedExecRepository {
+	return &UnmanagedExecRepository{repo: r}
+}
+
+// UnmanagedExecRepository is an ExecRepository for key sources without key IDs.
+type UnmanagedExecRepository struct {
+	repo *ExecRepository
+}
+
+// GetNewKey runs the executable and returns the key.
+func (u *UnmanagedExecRepository) GetNewKey(ctx context.Context) ([]byte, error) {
+	_, key, err := u.repo.run(ctx, "")
+	return key, err
+}
+
+// run starts the executable, with keyID in ARNIKA_KEY_ID if set, and parses its stdout.
+// The buffer holding stdout is cleared before run returns.
+func (r *ExecRepository) run(ctx context.Context, keyID string) (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, r.path, r.args...)
+	cmd.Env = []string{execPath}
+	if keyID != "" {
+		cmd.Env = append(cmd.Env, "ARNIKA_KEY_ID="+keyID)
+	}
+	cmd.Dir = "/"
+	cmd.WaitDelay = execWaitDelay
+	stdout := &boundedBuffer{buf: make([]byte, 0, execMaxOutput)}
+	defer stdout.clear()
+	stderr := &boundedBuffer{buf: make([]byte, 0, execMaxStderr), truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w after %s", ctx.Err(), r.timeout)
+		}
+		if msg := strings.TrimSpace(string(stderr.buf)); msg != "" {
+			return "", nil, fmt.Errorf("%w: %s: %w: %s", ErrExecKeyProvider, r.path, err, msg)
+		}
+		return "", nil, fmt.Errorf("%w: %s: %w", ErrExecKeyProvider, r.path, err)
+	}
+	return parseExecOutput(stdout.buf)
+}
+
+// parseExecOutput parses the base64 encoded key and the optional key ID written by a key
+// provider.
+func parseExecOutput(out []byte) (string, []byte, error) {
+	line, rest, _ := bytes.Cut(out, []byte("\n"))
+	id := string(bytes.TrimSpace(rest))
+	if strings.ContainsAny(id, " \t\r\n") {
+		return "", nil, fmt.Errorf("%w: unexpected output after the key ID", ErrExecKeyProvider)
+	}
+	if len(id) > execMaxKeyID {
+		return "", nil, fmt.Errorf("%w: key ID longer than %d bytes", ErrExecKeyProvider, execMaxKeyID)
+	}
+	var key []byte
+	var err error
+	secret.Do(func() {
+		line = bytes.TrimSpace(line)
+		key = make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		var n int
+		n, err = base64.StdEncoding.Decode(key, line)
+		if err != nil {
+			clear(key)
+			return
+		}
+		key = key[:n]
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: failed to decode key: %w", ErrExecKeyProvider, err)
+	}
+	if len(key) == 0 {
+		return "", nil, fmt.Errorf("%w: no key on stdout", ErrExecKeyProvider)
+	}
+	return id, key, nil
+}
+
+// boundedBuffer collects the output of a key provider in a buffer which is never grown,
+// so no copies of the key are left behind. Output beyond its capacity is an error unless
+// truncate is set.
+type boundedBuffer struct {
+	buf      []byte
+	truncate bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	free := cap(b.buf) - len(b.buf)
+	if len(p) > free {
+		if !b.truncate {
+			return 0, fmt.Errorf("output exceeds %d bytes", cap(b.buf))
+		}
+		b.buf = append(b.buf, p[:free]...)
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// clear wipes the collected output.
+func (b *boundedBuffer) clear() {
+	clear(b.buf[:cap(b.buf)])
+	b.buf = b.buf[:0]
+}
@@ -0,0 +1,124 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyProvider writes a shell script with body to a temporary directory and returns its path.
+func keyProvider(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provider.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecRepository_Managed(t *testing.T) {
+	path := keyProvider(t, `if [ -n "$ARNIKA_KEY_ID" ]; then echo dGVzdGtleQ==; echo "$ARNIKA_KEY_ID"; else echo dGVzdGtleQ==; echo key-1; fi`)
+	repo := NewExecRepository(path, nil, time.Second)
+	id, key, err := repo.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "key-1" || string(key) != "testkey" {
+		t.Fatalf("unexpected key %q with ID %q", key, id)
+	}
+	requested := "key-2"
+	key, err = repo.GetKeyByID(context.Background(), &requested)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(key) != "testkey" {
+		t.Fatalf("unexpected key %q", key)
+	}
+}
+
+func TestExecRepository_Unmanaged(t *testing.T) {
+	path := keyProvider(t, `echo dGVzdGtleQ==`)
+	repo := NewExecRepository(path, nil, time.Second)
+	if _, _, err := repo.GetNewKey(context.Background()); !errors.Is(err, ErrExecKeyProvider) {
+		t.Fatalf("expected a key without ID to be rejected by the managed repository, got %v", err)
+	}
+	key, err := repo.Unmanaged().GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(key) != "testkey" {
+		t.Fatalf("unexpected key %q", key)
+	}
+}
+
+func TestExecRepository_Environment(t *testing.T) {
+	t.Setenv("ARNIKA_PSK", "secret")
+	path := keyProvider(t, `env | grep -v '^PWD=\|^SHLVL=\|^_=' >&2; pwd >&2; exit 1`)
+	_, err := NewExecRepository(path, nil, time.Second).Unmanaged().GetNewKey(context.Background())
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strings.Contains(err.Error(), "ARNIKA_PSK") {
+		t.Fatalf("environment of Arnika passed to key provider: %v", err)
+	}
+	if !strings.Contains(err.Error(), execPath+"\n/") {
+		t.Fatalf("expected minimal environment and root directory, got %v", err)
+	}
+}
+
+func TestExecRepository_Args(t *testing.T) {
+	path := keyProvider(t, `echo "$2"; echo "$1"`)
+	id, key, err := NewExecRepository(path, []string{"id-1", "dGVzdGtleQ=="}, time.Second).GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "id-1" || string(key) != "testkey" {
+		t.Fatalf("unexpected key %q with ID %q", key, id)
+	}
+}
+
+func TestExecRepository_Timeout(t *testing.T) {
+	path := keyProvider(t, `exec sleep 10`)
+	start := time.Now()
+	_, err := NewExecRepository(path, nil, 100*time.Millisecond).Unmanaged().GetNewKey(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("key provider not killed after timeout, took %s", elapsed)
+	}
+}
+
+func TestExecRepository_InvalidOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "exit status", body: `echo dGVzdGtleQ==; exit 3`},
+		{name: "invalid base64", body: `echo 'not base64!'`},
+		{name: "empty output", body: `true`},
+		{name: "extra output", body: `echo dGVzdGtleQ==; echo key-1; echo more`},
+		{name: "key ID too long", body: `echo dGVzdGtleQ==; head -c 300 /dev/zero | tr '\0' a`},
+		{name: "output too large", body: `head -c 100000 /dev/zero`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := keyProvider(t, tt.body)
+			if _, err := NewExecRepository(path, nil, time.Second).Unmanaged().GetNewKey(context.Background()); !errors.Is(err, ErrExecKeyProvider) {
+				t.Fatalf("expected ErrExecKeyProvider, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExecRepository_KeyIDMismatch(t *testing.T) {
+	path := keyProvider(t, `echo dGVzdGtleQ==; echo other`)
+	requested := "key-1"
+	if _, err := NewExecRepository(path, nil, time.Second).GetKeyByID(context.Background(), &requested); !errors.Is(err, ErrExecKeyProvider) {
+		t.Fatalf("expected a different key ID to be rejected, got %v", err)
+	}
+}
@@ -2,17 +2,28 @@
 package repositories
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime/secret"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
 )
 
 type KMSAuth struct {
@@ -48,18 +59,154 @@ type kmsResponse struct {
 	Keys []kmsKey `json:"keys"`
 }
 
+// encKeysRequest is the ETSI 014 POST body of enc_keys.
+type encKeysRequest struct {
+	Number                int              `json:"number"`
+	Size                  int              `json:"size"`
+	AdditionalSlaveSAEIDs []string         `json:"additional_slave_SAE_IDs,omitempty"`
+	ExtensionMandatory    []map[string]any `json:"extension_mandatory,omitempty"`
+	ExtensionOptional     []map[string]any `json:"extension_optional,omitempty"`
+}
+
+type kmsKeyID struct {
+	KeyID string `json:"key_ID"`
+}
+
+// decKeysRequest is the ETSI 014 POST body of dec_keys.
+type decKeysRequest struct {
+	KeyIDs []kmsKeyID `json:"key_IDs"`
+}
+
+// kmsCall describes an enc_keys or dec_keys request, query holds the parameters
+// of the GET request and body the equivalent POST body.
+type kmsCall struct {
+	operation string
+	query     url.Values
+	body      any
+}
+
+// kmsStatus holds the fields of the ETSI 014 status response used by arnika.
+type kmsStatus struct {
+	MaxKeyPerRequest int `json:"max_key_per_request"`
+}
+
+// keyMaterial is a decoded key returned by the KMS, kms is the position of the
+// endpoint which issued the key.
+type keyMaterial struct {
+	id  string
+	kms int
+	key []byte
+}
+
+// keyHandlePrefix starts the key handle of a key not issued by the first endpoint.
+const keyHandlePrefix = "kms"
+
+// handle returns the key ID handed out for k. The peer passes it back to GetKeyByID,
+// which needs the position of the endpoint next to the key ID of the KMS. Keys of the
+// first endpoint keep the key ID of the KMS, others are prefixed with "kms<position>:".
+// A key ID of the first endpoint which already looks like a prefixed one is prefixed
+// with "kms0:", so handles are unambiguous.
+func (k keyMaterial) handle() string {
+	if _, _, prefixed := cutKeyHandle(k.id); k.kms == 0 && !prefixed {
+		return k.id
+	}
+	return keyHandlePrefix + strconv.Itoa(k.kms) + ":" + k.id
+}
+
+// parseKeyHandle returns the key ID of the KMS and the position of the endpoint which
+// issued the key of handle, see keyMaterial.handle.
+func parseKeyHandle(handle string) (id string, kms int) {
+	if id, kms, ok := cutKeyHandle(handle); ok {
+		return id, kms
+	}
+	return handle, 0
+}
+
+// cutKeyHandle splits a prefixed key handle, ok is false if handle is not prefixed.
+func cutKeyHandle(handle string) (id string, kms int, ok bool) {
+	rest, ok := strings.CutPrefix(handle, keyHandlePrefix)
+	if !ok {
+		return "", 0, false
+	}
+	position, id, ok := strings.Cut(rest, ":")
+	if !ok || position == "" || strings.TrimLeft(position, "0123456789") != "" {
+		return "", 0, false
+	}
+	kms, err := strconv.Atoi(position)
+	if err != nil || strconv.Itoa(kms) != position {
+		return "", 0, false
+	}
+	return id, kms, true
+}
+
+// HTTP methods used for enc_keys and dec_keys requests. KMSMethodAuto uses POST and
+// falls back to GET once the KMS rejects POST requests.
+const (
+	KMSMethodAuto = "auto"
+	KMSMethodPost = "post"
+	KMSMethodGet  = "get"
+)
+
+// KMSEndpoint is a KMS base URL together with the client certificate used for it.
+type KMSEndpoint struct {
+	URL  string
+	Auth *KMSAuth
+}
+
+// kmsEndpoint holds the HTTP client and the circuit breaker state of a KMS base URL.
+type kmsEndpoint struct {
+	baseURL string
+	conn    *http.Client
+	// postUnsupported is set in KMSMethodAuto once the KMS rejected a POST request,
+	// postSupported once it answered one
+	postUnsupported atomic.Bool
+	postSupported   atomic.Bool
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// HTTPKMSRepository requests keys from an ordered list of KMS endpoints. Requests go to
+// the first endpoint whose circuit breaker is closed and fail over to the next one on
+// connection errors and 5xx responses. An endpoint is skipped for breakerCooldown after
+// breakerThreshold consecutive failures, afterwards it is tried again.
 type HTTPKMSRepository struct {
-	baseURL          string
+	endpoints        []*kmsEndpoint
+	method           string
 	maxRetries       int
 	backoffBaseDelay time.Duration
-	conn             *http.Client
+	breakerThreshold int
+	breakerCooldown  time.Duration
 	Managed          bool
 }
 
-func NewHTTPKMSRepository(url string, timeout time.Duration, maxRetries int, backoffBaseDelay time.Duration, auth *KMSAuth) *HTTPKMSRepository {
+func NewHTTPKMSRepository(endpoints []KMSEndpoint, method string, timeout time.Duration, maxRetries int, backoffBaseDelay time.Duration, breakerThreshold int, breakerCooldown time.Duration) *HTTPKMSRepository {
+	r := &HTTPKMSRepository{
+		method:           method,
+		maxRetries:       maxRetries,
+		backoffBaseDelay: backoffBaseDelay,
+		breakerThreshold: breakerThreshold,
+		breakerCooldown:  breakerCooldown,
+		Managed:          true,
+	}
+	for _, endpoint := range endpoints {
+		r.endpoints = append(r.endpoints, &kmsEndpoint{
+			baseURL: endpoint.URL,
+			conn: &http.Client{
+				Timeout:   timeout,
+				Transport: newKMSTransport(endpoint.Auth),
+			},
+		})
+		metrics.KMSEndpointUp.Set(1, endpoint.URL)
+	}
+	return r
+}
+
+func newKMSTransport(auth *KMSAuth) *http.Transport {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{
-			// InsecureSkipVerify: true, // removed as fix for GHSA-rc6v-5rmx-w5mv 
+			// InsecureSkipVerify: true, // removed as fix for GHSA-rc6v-5rmx-w5mv
 			MinVersion: tls.VersionTLS12,
 		},
 		Proxy: http.ProxyFromEnvironment,
@@ -67,82 +214,350 @@ func NewHTTPKMSRepository(url string, timeout time.Duration, maxRetries int, bac
 	if auth.IsClientCertAuth() {
 		clientCert, err := tls.LoadX509KeyPair(*auth.cert, *auth.key)
 		if err != nil {
-			log.Fatal(err)
+			slog.Error("failed to load KMS client certificate", logging.KeyError, err)
+			os.Exit(1)
 		}
 		tr.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
 		caCert, err := os.ReadFile(*auth.cacert)
 		if err != nil {
-			log.Fatal(err)
+			slog.Error("failed to read KMS CA certificate", logging.KeyError, err)
+			os.Exit(1)
 		}
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(caCert)
 		tr.TLSClientConfig.RootCAs = caCertPool
 	}
-	return &HTTPKMSRepository{
-		baseURL:          url,
-		maxRetries:       maxRetries,
-		backoffBaseDelay: backoffBaseDelay,
-		conn: &http.Client{
-			Timeout:   timeout,
-			Transport: tr,
-		},
-		Managed: true,
+	return tr
+}
+
+// name identifies the repository in logs and metrics by its preferred endpoint.
+func (r *HTTPKMSRepository) name() string {
+	return r.endpoints[0].baseURL
+}
+
+// GetNewKey requests a new key and returns it with its key handle, see keyHandle.
+func (r *HTTPKMSRepository) GetNewKey(ctx context.Context) (keyID string, key []byte, err error) {
+	keys, err := r.getNewKeys(ctx, 1)
+	if err != nil {
+		return "", nil, err
 	}
+	return keys[0].handle(), keys[0].key, nil
 }
 
-func (r *HTTPKMSRepository) GetNewKey() (keyID string, key []byte, err error) {
-	return r.kmsRequest("/enc_keys?number=1&size=256")
+// getNewKeys fetches number new keys with a single enc_keys request.
+func (r *HTTPKMSRepository) getNewKeys(ctx context.Context, number int) ([]keyMaterial, error) {
+	return r.kmsRequest(ctx, kmsCall{
+		operation: "enc_keys",
+		query:     url.Values{"number": {strconv.Itoa(number)}, "size": {"256"}},
+		body:      encKeysRequest{Number: number, Size: 256},
+	}, 0)
 }
 
-func (r *HTTPKMSRepository) GetKeyByID(keyID *string) (key []byte, err error) {
+// GetKeyByID requests the key of the key handle keyID from the endpoint at the position
+// encoded in the handle first, i.e. the KME paired with the KME of the peer which issued
+// the key.
+func (r *HTTPKMSRepository) GetKeyByID(ctx context.Context, keyID *string) (key []byte, err error) {
 	if keyID == nil || *keyID == "" {
 		return nil, fmt.Errorf("keyID is empty")
 	}
-	_, key, err = r.kmsRequest("/dec_keys?key_ID=" + *keyID)
-	return key, err
+	id, kms := parseKeyHandle(*keyID)
+	if id == "" {
+		return nil, fmt.Errorf("keyID is empty")
+	}
+	keys, err := r.kmsRequest(ctx, kmsCall{
+		operation: "dec_keys",
+		query:     url.Values{"key_ID": {id}},
+		body:      decKeysRequest{KeyIDs: []kmsKeyID{{KeyID: id}}},
+	}, kms)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0].key, nil
+}
+
+// Check verifies that a KMS endpoint is reachable by querying the ETSI 014 status endpoint.
+// Unlike key requests it bypasses the circuit breakers, so health probes neither open nor
+// close them.
+func (r *HTTPKMSRepository) Check(ctx context.Context) error {
+	var errs []error
+	for _, e := range r.endpoints {
+		err := e.probe(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e.baseURL, err))
+	}
+	return errors.Join(errs...)
+}
+
+// probe queries the ETSI 014 status endpoint of e.
+func (e *kmsEndpoint) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.baseURL+"/status", nil)
+	if err != nil {
+		return err
+	}
+	res, err := e.conn.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return parseKMSError("status", res)
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	return res.Body.Close()
+}
+
+// status queries the ETSI 014 status endpoint.
+func (r *HTTPKMSRepository) status(ctx context.Context) (*kmsStatus, error) {
+	res, _, err := r.failover(ctx, 0, func(e *kmsEndpoint) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.baseURL+"/status", nil)
+		if err != nil {
+			return nil, err
+		}
+		return e.conn.Do(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, parseKMSError("status", res)
+	}
+	defer func() { _ = res.Body.Close() }()
+	var status kmsStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("cant parse KMS status: %w", err)
+	}
+	return &status, nil
 }
 
-func (r *HTTPKMSRepository) kmsRequest(path string) (id string, key []byte, err error) {
+// kmsRequest fetches keys from the KMS starting with the endpoint at position preferred,
+// the operation labels the request in the metrics. Requests and retries stop once ctx is done.
+func (r *HTTPKMSRepository) kmsRequest(ctx context.Context, call kmsCall, preferred int) (keys []keyMaterial, err error) {
+	operation := call.operation
 	var kmsResp kmsResponse
 	var res *http.Response
+	var kms int
 
-	for attempt := 0; attempt <= r.maxRetries; attempt++ {
-		res, err = r.conn.Get(r.baseURL + path)
+	start := time.Now()
+	defer func() { metrics.KMSRequestDuration.Observe(time.Since(start).Seconds(), operation) }()
+	for attempt := 0; ; attempt++ {
+		res, kms, err = r.failover(ctx, preferred, func(e *kmsEndpoint) (*http.Response, error) {
+			return r.send(ctx, e, call)
+		})
 		if err == nil && res.StatusCode == http.StatusOK {
 			break
 		}
-		if attempt < r.maxRetries {
-			delay := r.backoffBaseDelay * time.Duration(1<<uint(attempt))
-			log.Printf("Attempt %d: Retrying in %s...", attempt+1, delay)
-			time.Sleep(delay)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("KMS %s canceled: %w", operation, ctxErr)
 		}
-		if res != nil {
-			_ = res.Body.Close()
+		if err == nil {
+			err = parseKMSError(operation, res)
+		}
+		metrics.KMSErrors.Inc(operation, kmsErrorKind(err))
+		// Only server and connection errors are retried, a KMS rejecting the
+		// request gives the same answer again.
+		if !IsTransient(err) || attempt >= r.maxRetries {
+			return nil, err
+		}
+		delay := r.backoffBaseDelay * time.Duration(1<<uint(attempt))
+		metrics.KMSRetries.Inc(operation)
+		slog.Warn("KMS request failed, retrying", "operation", operation, "attempt", attempt+1, "delay", delay, logging.KeyError, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("KMS %s canceled: %w", operation, ctx.Err())
+		case <-timer.C:
 		}
-	}
-	if err != nil {
-		return "", nil, err
 	}
 	defer func() { _ = res.Body.Close() }()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 	defer clear(body)
 	if err := json.Unmarshal(body, &kmsResp); err != nil {
-		return "", nil, fmt.Errorf("cant parse KMS response: %w", err)
+		return nil, fmt.Errorf("cant parse KMS response: %w", err)
 	}
-	if len(kmsResp.Keys) == 0 || kmsResp.Keys[0].ID == "" || kmsResp.Keys[0].Key == "" {
-		return "", nil, fmt.Errorf("unable to fetch key from KMS")
+	if len(kmsResp.Keys) == 0 {
+		return nil, fmt.Errorf("unable to fetch key from KMS")
 	}
 
-	var rawKey []byte
-	secret.Do(func() {
-		rawKey, err = base64.StdEncoding.DecodeString(kmsResp.Keys[0].Key)
-	})
+	keys = make([]keyMaterial, 0, len(kmsResp.Keys))
+	for _, k := range kmsResp.Keys {
+		if k.ID == "" || k.Key == "" {
+			err = fmt.Errorf("unable to fetch key from KMS")
+			break
+		}
+		var rawKey []byte
+		secret.Do(func() {
+			rawKey, err = base64.StdEncoding.DecodeString(k.Key)
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to decode KMS key: %w", err)
+			break
+		}
+		keys = append(keys, keyMaterial{id: k.ID, kms: kms, key: rawKey})
+	}
+	if err != nil {
+		for _, k := range keys {
+			clear(k.key)
+		}
+		return nil, err
+	}
+	return keys, nil
+}
+
+// failover runs request against the endpoints starting with the one at position
+// preferred and moves on to the next endpoint on connection errors and 5xx responses.
+// Endpoints with an open circuit breaker are skipped unless all breakers are open.
+// It returns the response of the last endpoint tried and its position. A request
+// canceled by ctx is not counted as failure of the endpoint.
+func (r *HTTPKMSRepository) failover(ctx context.Context, preferred int, request func(*kmsEndpoint) (*http.Response, error)) (*http.Response, int, error) {
+	order := r.order(preferred)
+	for i, pos := range order {
+		e := r.endpoints[pos]
+		res, err := request(e)
+		if err != nil && ctx.Err() != nil {
+			return nil, pos, err
+		}
+		if err == nil && res.StatusCode < http.StatusInternalServerError {
+			r.succeeded(e)
+			return res, pos, nil
+		}
+		r.failed(e, kmsAttemptError(res, err))
+		if i == len(order)-1 {
+			return res, pos, err
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+		metrics.KMSFailovers.Inc(e.baseURL)
+		slog.Warn("KMS endpoint failed, failing over", "kms_url", e.baseURL, "next_kms_url", r.endpoints[order[i+1]].baseURL, logging.KeyError, kmsAttemptError(res, err))
+	}
+	return nil, 0, fmt.Errorf("no KMS endpoint configured")
+}
+
+// order returns the positions of the endpoints to try, preferred first. Endpoints
+// with an open circuit breaker are left out unless all breakers are open.
+func (r *HTTPKMSRepository) order(preferred int) []int {
+	if preferred < 0 || preferred >= len(r.endpoints) {
+		preferred = 0
+	}
+	all := []int{preferred}
+	for i := range r.endpoints {
+		if i != preferred {
+			all = append(all, i)
+		}
+	}
+	now := time.Now()
+	var closed []int
+	for _, i := range all {
+		if r.endpoints[i].available(now) {
+			closed = append(closed, i)
+		}
+	}
+	if len(closed) == 0 {
+		return all
+	}
+	return closed
+}
+
+// available reports whether the circuit breaker of e lets requests pass at now.
+func (e *kmsEndpoint) available(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.openUntil)
+}
+
+// succeeded closes the circuit breaker of e.
+func (r *HTTPKMSRepository) succeeded(e *kmsEndpoint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failures >= r.breakerThreshold {
+		slog.Info("KMS endpoint recovered", "kms_url", e.baseURL)
+	}
+	e.failures = 0
+	e.openUntil = time.Time{}
+	metrics.KMSEndpointUp.Set(1, e.baseURL)
+}
+
+// failed counts a failed request and opens the circuit breaker of e for breakerCooldown
+// once breakerThreshold consecutive requests failed.
+func (r *HTTPKMSRepository) failed(e *kmsEndpoint, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	if e.failures < r.breakerThreshold {
+		return
+	}
+	if e.failures == r.breakerThreshold {
+		slog.Warn("KMS endpoint unavailable, opening circuit breaker", "kms_url", e.baseURL, "cooldown", r.breakerCooldown, logging.KeyError, err)
+	}
+	e.openUntil = time.Now().Add(r.breakerCooldown)
+	metrics.KMSEndpointUp.Set(0, e.baseURL)
+}
+
+// send issues a single attempt of call to e with the configured HTTP method. In
+// KMSMethodAuto a POST request rejected with 405 or 501 falls back to GET. Until the
+// KMS answered a POST request, GET is tried on any 4xx response as well, as some KMSs
+// reject unsupported POST requests with 400 or 404. Once the GET request succeeds, the
+// endpoint is only sent GET requests.
+func (r *HTTPKMSRepository) send(ctx context.Context, e *kmsEndpoint, call kmsCall) (*http.Response, error) {
+	if r.method == KMSMethodGet || e.postUnsupported.Load() {
+		return e.get(ctx, call)
+	}
+	body, err := json.Marshal(call.body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.baseURL+"/"+call.operation, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.conn.Do(req)
+	if err != nil || r.method != KMSMethodAuto {
+		return res, err
+	}
+	rejected := res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented
+	probe := !e.postSupported.Load() && res.StatusCode >= http.StatusBadRequest && res.StatusCode < http.StatusInternalServerError
+	if !rejected && !probe {
+		if res.StatusCode < http.StatusBadRequest {
+			e.postSupported.Store(true)
+		}
+		return res, nil
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	if rejected {
+		slog.Warn("KMS does not support POST requests, falling back to GET", "kms_url", e.baseURL, "status", res.Status)
+		e.postUnsupported.Store(true)
+		return e.get(ctx, call)
+	}
+	res, err = e.get(ctx, call)
+	if err == nil && res.StatusCode < http.StatusBadRequest {
+		slog.Warn("KMS rejected a POST request but answered GET, falling back to GET", "kms_url", e.baseURL)
+		e.postUnsupported.Store(true)
+	}
+	return res, err
+}
+
+// get issues call to e as GET request.
+func (e *kmsEndpoint) get(ctx context.Context, call kmsCall) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.baseURL+"/"+call.operation+"?"+call.query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return e.conn.Do(req)
+}
+
+// kmsAttemptError describes why a single KMS request attempt failed.
+func kmsAttemptError(res *http.Response, err error) error {
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to decode KMS key: %w", err)
+		return err
 	}
-	return kmsResp.Keys[0].ID, rawKey, nil
+	return fmt.Errorf("KMS returned %s", res.Status)
 }
@@ -0,0 +1,265 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newFakeRepo(t *testing.T, kms *fakeKMS, method string) *HTTPKMSRepository {
+	t.Helper()
+	return NewHTTPKMSRepository([]KMSEndpoint{{URL: kms.start(t)}}, method, time.Second, 0, time.Millisecond, 3, time.Minute)
+}
+
+func TestHTTPKMSRepositoryPost(t *testing.T) {
+	kms := &fakeKMS{}
+	repo := newFakeRepo(t, kms, KMSMethodPost)
+
+	if _, _, err := repo.GetNewKey(context.Background()); err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	keyID := "a&b=c"
+	if _, err := repo.GetKeyByID(context.Background(), &keyID); err != nil {
+		t.Fatalf("GetKeyByID failed: %v", err)
+	}
+	if batches := kms.batchSizes(); len(batches) != 1 || batches[0] != 1 {
+		t.Errorf("expected enc_keys body with number 1, got %v", batches)
+	}
+	if keyIDs := kms.requestedKeyIDs(); len(keyIDs) != 1 || keyIDs[0] != keyID {
+		t.Errorf("expected dec_keys body with key_ID %q, got %v", keyID, keyIDs)
+	}
+	for _, method := range kms.requestMethods() {
+		if method != http.MethodPost {
+			t.Errorf("expected only POST requests, got %s", method)
+		}
+	}
+}
+
+func TestHTTPKMSRepositoryGetEscapesKeyID(t *testing.T) {
+	kms := &fakeKMS{}
+	repo := newFakeRepo(t, kms, KMSMethodGet)
+
+	keyID := "a&b=c"
+	if _, err := repo.GetKeyByID(context.Background(), &keyID); err != nil {
+		t.Fatalf("GetKeyByID failed: %v", err)
+	}
+	if keyIDs := kms.requestedKeyIDs(); len(keyIDs) != 1 || keyIDs[0] != keyID {
+		t.Errorf("expected key_ID %q, got %v", keyID, keyIDs)
+	}
+}
+
+func TestHTTPKMSRepositoryAutoFallsBackToGet(t *testing.T) {
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusNotFound, http.StatusBadRequest} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			kms := &fakeKMS{rejectPost: status}
+			repo := newFakeRepo(t, kms, KMSMethodAuto)
+
+			for range 2 {
+				if _, _, err := repo.GetNewKey(context.Background()); err != nil {
+					t.Fatalf("GetNewKey failed: %v", err)
+				}
+			}
+			expectMethods(t, kms, http.MethodPost, http.MethodGet, http.MethodGet)
+		})
+	}
+}
+
+func TestHTTPKMSRepositoryAutoKeepsPost(t *testing.T) {
+	kms := &fakeKMS{}
+	repo := newFakeRepo(t, kms, KMSMethodAuto)
+
+	if _, _, err := repo.GetNewKey(context.Background()); err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	// Once the KMS answered a POST request, a 4xx is an error of the request
+	kms.fail(http.StatusBadRequest)
+	if _, _, err := repo.GetNewKey(context.Background()); err == nil {
+		t.Fatal("expected an error for 400 Bad Request")
+	}
+	kms.fail(0)
+	if _, _, err := repo.GetNewKey(context.Background()); err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	expectMethods(t, kms, http.MethodPost, http.MethodPost, http.MethodPost)
+}
+
+// expectMethods checks the HTTP methods of all requests kms received.
+func expectMethods(t *testing.T, kms *fakeKMS, expected ...string) {
+	t.Helper()
+	methods := kms.requestMethods()
+	if len(methods) != len(expected) {
+		t.Fatalf("expected requests %v, got %v", expected, methods)
+	}
+	for i := range expected {
+		if methods[i] != expected[i] {
+			t.Fatalf("expected requests %v, got %v", expected, methods)
+		}
+	}
+}
+
+func TestHTTPKMSRepositoryPostWithoutFallback(t *testing.T) {
+	kms := &fakeKMS{rejectPost: http.StatusMethodNotAllowed}
+	repo := newFakeRepo(t, kms, KMSMethodPost)
+
+	if _, _, err := repo.GetNewKey(context.Background()); err == nil {
+		t.Fatal("expected an error if the KMS rejects POST requests")
+	}
+}
+
+func newFailoverRepo(t *testing.T, cooldown time.Duration, kmss ...*fakeKMS) *HTTPKMSRepository {
+	t.Helper()
+	var endpoints []KMSEndpoint
+	for _, kms := range kmss {
+		endpoints = append(endpoints, KMSEndpoint{URL: kms.start(t)})
+	}
+	return NewHTTPKMSRepository(endpoints, KMSMethodGet, time.Second, 0, time.Millisecond, 1, cooldown)
+}
+
+func TestHTTPKMSRepositoryFailover(t *testing.T) {
+	primary, secondary := &fakeKMS{name: "primary", status: http.StatusServiceUnavailable}, &fakeKMS{name: "secondary"}
+	repo := newFailoverRepo(t, time.Minute, primary, secondary)
+
+	keyID, _, err := repo.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	if keyID != "kms1:secondary-1" {
+		t.Fatalf("expected key of the secondary KMS at position 1, got %s", keyID)
+	}
+
+	// The open circuit breaker skips the primary KMS
+	if _, _, err := repo.GetNewKey(context.Background()); err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	if primary.count() != 1 {
+		t.Fatalf("expected the primary KMS to be skipped, got %d requests", primary.count())
+	}
+}
+
+func TestHTTPKMSRepositoryConnectErrorFailover(t *testing.T) {
+	secondary := &fakeKMS{name: "secondary"}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	repo := NewHTTPKMSRepository([]KMSEndpoint{{URL: closed.URL}, {URL: secondary.start(t)}}, KMSMethodGet, time.Second, 0, time.Millisecond, 3, time.Minute)
+
+	if keyID, _, err := repo.GetNewKey(context.Background()); err != nil || !secondary.issued(keyID) {
+		t.Fatalf("expected key of the secondary KMS, got %q, %v", keyID, err)
+	}
+}
+
+func TestHTTPKMSRepositoryReturnsToPreferred(t *testing.T) {
+	primary, secondary := &fakeKMS{name: "primary", status: http.StatusServiceUnavailable}, &fakeKMS{name: "secondary"}
+	repo := newFailoverRepo(t, 20*time.Millisecond, primary, secondary)
+
+	if keyID, _, err := repo.GetNewKey(context.Background()); err != nil || !secondary.issued(keyID) {
+		t.Fatalf("expected key of the secondary KMS, got %q, %v", keyID, err)
+	}
+	primary.fail(0)
+	time.Sleep(30 * time.Millisecond)
+	if keyID, _, err := repo.GetNewKey(context.Background()); err != nil || !primary.issued(keyID) {
+		t.Fatalf("expected key of the recovered primary KMS, got %q, %v", keyID, err)
+	}
+}
+
+func TestHTTPKMSRepositoryGetKeyByIDPrefersIssuer(t *testing.T) {
+	first, second := &fakeKMS{name: "first"}, &fakeKMS{name: "second"}
+	repo := newFailoverRepo(t, time.Minute, first, second)
+
+	keyID := "kms1:key"
+	if _, err := repo.GetKeyByID(context.Background(), &keyID); err != nil {
+		t.Fatalf("GetKeyByID failed: %v", err)
+	}
+	if first.count() != 0 || second.count() != 1 {
+		t.Fatalf("expected dec_keys at the KMS at position 1, got %d/%d requests", first.count(), second.count())
+	}
+	if keyIDs := second.requestedKeyIDs(); len(keyIDs) != 1 || keyIDs[0] != "key" {
+		t.Fatalf("expected dec_keys with key_ID %q, got %v", "key", keyIDs)
+	}
+}
+
+func TestKeyHandle(t *testing.T) {
+	tests := []struct {
+		id     string
+		kms    int
+		handle string
+	}{
+		{id: "a1b2-c3", kms: 0, handle: "a1b2-c3"},
+		{id: "a1b2-c3", kms: 2, handle: "kms2:a1b2-c3"},
+		{id: "kms:a1b2", kms: 0, handle: "kms:a1b2"},
+		{id: "kms01:a1b2", kms: 0, handle: "kms01:a1b2"},
+		{id: "kms1:a1b2", kms: 0, handle: "kms0:kms1:a1b2"},
+		{id: "kms1:a1b2", kms: 1, handle: "kms1:kms1:a1b2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handle, func(t *testing.T) {
+			handle := keyMaterial{id: tt.id, kms: tt.kms}.handle()
+			if handle != tt.handle {
+				t.Fatalf("handle() = %q, want %q", handle, tt.handle)
+			}
+			if id, kms := parseKeyHandle(handle); id != tt.id || kms != tt.kms {
+				t.Fatalf("parseKeyHandle(%q) = %q, %d, want %q, %d", handle, id, kms, tt.id, tt.kms)
+			}
+		})
+	}
+}
+
+func TestHTTPKMSRepositoryAllEndpointsDown(t *testing.T) {
+	primary := &fakeKMS{name: "primary", status: http.StatusServiceUnavailable}
+	secondary := &fakeKMS{name: "secondary", status: http.StatusServiceUnavailable}
+	repo := newFailoverRepo(t, time.Minute, primary, secondary)
+
+	for range 2 {
+		if _, _, err := repo.GetNewKey(context.Background()); err == nil {
+			t.Fatal("expected an error if all KMS endpoints are down")
+		}
+	}
+	// With all circuit breakers open every endpoint is still tried
+	if primary.count() != 2 || secondary.count() != 2 {
+		t.Fatalf("expected both KMS to be tried twice, got %d/%d requests", primary.count(), secondary.count())
+	}
+}
+
+func TestHTTPKMSRepositoryCanceledDuringRetry(t *testing.T) {
+	kms := &fakeKMS{status: http.StatusServiceUnavailable}
+	repo := NewHTTPKMSRepository([]KMSEndpoint{{URL: kms.start(t)}}, KMSMethodGet, time.Second, 5, time.Minute, 3, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := repo.GetNewKey(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the retry backoff to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected GetNewKey to return at the deadline, took %s", elapsed)
+	}
+	if kms.count() != 1 {
+		t.Fatalf("expected a single request before the deadline, got %d", kms.count())
+	}
+}
+
+func TestHTTPKMSRepositoryCheckBypassesBreaker(t *testing.T) {
+	primary, secondary := &fakeKMS{name: "primary", status: http.StatusServiceUnavailable}, &fakeKMS{name: "secondary"}
+	repo := newFailoverRepo(t, time.Minute, primary, secondary)
+
+	for range 3 {
+		if err := repo.Check(context.Background()); err != nil {
+			t.Fatalf("expected the secondary KMS to be reachable, got %v", err)
+		}
+	}
+	// Failed probes do not open the circuit breaker, so enc_keys still tries the primary KMS
+	if keyID, _, err := repo.GetNewKey(context.Background()); err != nil || !secondary.issued(keyID) {
+		t.Fatalf("expected key of the secondary KMS, got %q, %v", keyID, err)
+	}
+	if primary.count() != 4 {
+		t.Fatalf("expected the primary KMS to be probed and requested, got %d requests", primary.count())
+	}
+
+	secondary.fail(http.StatusServiceUnavailable)
+	if err := repo.Check(context.Background()); err == nil {
+		t.Fatal("expected an error if no KMS is reachable")
+	}
+}
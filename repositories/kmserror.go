@@ -0,0 +1,119 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Kinds of ETSI 014 error responses, a *KMSError matches one of them with errors.Is.
+var (
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrEndpointNotFound = errors.New("KMS endpoint not found")
+	ErrSAEUnauthorized  = errors.New("SAE unauthorized")
+	ErrKeyExhausted     = errors.New("key exhausted")
+	ErrBadRequest       = errors.New("bad request")
+	ErrServerError      = errors.New("server error")
+)
+
+// maxKMSErrorBody limits the size of an error response read from the KMS.
+const maxKMSErrorBody = 64 << 10
+
+// KMSError is an ETSI 014 error response of the KMS.
+type KMSError struct {
+	Operation  string           // enc_keys, dec_keys or status
+	StatusCode int              // HTTP status code of the response
+	Message    string           // message of the error response
+	Details    []map[string]any // details of the error response
+	kind       error
+}
+
+func (e *KMSError) Error() string {
+	msg := fmt.Sprintf("KMS %s failed: %s (%d)", e.Operation, e.kind, e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *KMSError) Unwrap() error { return e.kind }
+
+// Transient reports whether repeating the request may succeed.
+func (e *KMSError) Transient() bool {
+	return e.kind == ErrServerError
+}
+
+// IsTransient reports whether a failed KMS request is worth repeating. Errors other than
+// a *KMSError, e.g. connection errors, are considered transient.
+func IsTransient(err error) bool {
+	var kmsErr *KMSError
+	if errors.As(err, &kmsErr) {
+		return kmsErr.Transient()
+	}
+	return err != nil
+}
+
+// kmsErrorKind returns the metrics label of the kind of err.
+func kmsErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return "key_not_found"
+	case errors.Is(err, ErrEndpointNotFound):
+		return "endpoint_not_found"
+	case errors.Is(err, ErrSAEUnauthorized):
+		return "sae_unauthorized"
+	case errors.Is(err, ErrKeyExhausted):
+		return "key_exhausted"
+	case errors.Is(err, ErrBadRequest):
+		return "bad_request"
+	case errors.Is(err, ErrServerError):
+		return "server_error"
+	}
+	return "connection"
+}
+
+// parseKMSError builds the KMSError of a non-200 response and closes its body.
+func parseKMSError(operation string, res *http.Response) *KMSError {
+	defer func() { _ = res.Body.Close() }()
+	e := &KMSError{Operation: operation, StatusCode: res.StatusCode}
+	var body struct {
+		Message string           `json:"message"`
+		Details []map[string]any `json:"details"`
+	}
+	if json.NewDecoder(io.LimitReader(res.Body, maxKMSErrorBody)).Decode(&body) == nil {
+		e.Message, e.Details = body.Message, body.Details
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	e.kind = classifyKMSError(operation, res.StatusCode, e.Message)
+	return e
+}
+
+// classifyKMSError maps the operation, status code and message of an ETSI 014 error
+// response to its kind. ETSI 014 only defines 400, 401 and 503, so key not found and key
+// exhaustion are recognized by the message of a 4xx response as well. A 404 without such
+// a message only means a missing key for dec_keys, otherwise the URL of the KMS or its
+// SAE ID is wrong. The message of a server error is not inspected, a 5xx response stays
+// transient whatever it says.
+func classifyKMSError(operation string, status int, message string) error {
+	if status >= http.StatusInternalServerError {
+		return ErrServerError
+	}
+	msg := strings.ToLower(message)
+	clientError := status >= http.StatusBadRequest
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrSAEUnauthorized
+	case clientError && strings.Contains(msg, "key") && strings.Contains(msg, "not found"):
+		return ErrKeyNotFound
+	case status == http.StatusNotFound && operation == "dec_keys" && message == "":
+		return ErrKeyNotFound
+	case status == http.StatusNotFound:
+		return ErrEndpointNotFound
+	case clientError && (strings.Contains(msg, "exhaust") || strings.Contains(msg, "insufficient") || strings.Contains(msg, "not enough")):
+		return ErrKeyExhausted
+	}
+	return ErrBadRequest
+}
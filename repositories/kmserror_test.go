@@ -0,0 +1,95 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyKMSError(t *testing.T) {
+	tests := []struct {
+		operation string
+		status    int
+		message   string
+		want      error
+	}{
+		{"enc_keys", http.StatusBadRequest, "size shall be a multiple of 8", ErrBadRequest},
+		{"dec_keys", http.StatusBadRequest, "Key not found", ErrKeyNotFound},
+		{"dec_keys", http.StatusNotFound, "", ErrKeyNotFound},
+		{"dec_keys", http.StatusNotFound, "key_ID unknown: key not found", ErrKeyNotFound},
+		{"dec_keys", http.StatusNotFound, "SAE not found", ErrEndpointNotFound},
+		{"enc_keys", http.StatusNotFound, "", ErrEndpointNotFound},
+		{"status", http.StatusNotFound, "", ErrEndpointNotFound},
+		{"enc_keys", http.StatusBadRequest, "SAE not found", ErrBadRequest},
+		{"enc_keys", http.StatusBadRequest, "keys exhausted", ErrKeyExhausted},
+		{"enc_keys", http.StatusBadRequest, "insufficient key material", ErrKeyExhausted},
+		{"enc_keys", http.StatusUnauthorized, "SAE unknown", ErrSAEUnauthorized},
+		{"enc_keys", http.StatusForbidden, "", ErrSAEUnauthorized},
+		{"enc_keys", http.StatusServiceUnavailable, "", ErrServerError},
+		{"enc_keys", http.StatusInternalServerError, "", ErrServerError},
+		{"enc_keys", http.StatusServiceUnavailable, "upstream KME not found", ErrServerError},
+		{"enc_keys", http.StatusInternalServerError, "insufficient resources", ErrServerError},
+		{"enc_keys", http.StatusFound, "key not found", ErrBadRequest},
+	}
+	for _, tt := range tests {
+		if got := classifyKMSError(tt.operation, tt.status, tt.message); got != tt.want {
+			t.Errorf("classifyKMSError(%s, %d, %q) = %v, want %v", tt.operation, tt.status, tt.message, got, tt.want)
+		}
+	}
+}
+
+// newErrorRepo returns a repository of a KMS answering every request with status and body.
+func newErrorRepo(t *testing.T, status int, body string) (*HTTPKMSRepository, *fakeKMS) {
+	t.Helper()
+	kms := &fakeKMS{status: status, body: body}
+	return NewHTTPKMSRepository([]KMSEndpoint{{URL: kms.start(t)}}, KMSMethodGet, time.Second, 2, time.Millisecond, 10, time.Minute), kms
+}
+
+func TestKMSRequestTypedError(t *testing.T) {
+	repo, kms := newErrorRepo(t, http.StatusBadRequest, `{"message":"key not found","details":[{"key_ID":"abc"}]}`)
+
+	keyID := "abc"
+	_, err := repo.GetKeyByID(context.Background(), &keyID)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	var kmsErr *KMSError
+	if !errors.As(err, &kmsErr) {
+		t.Fatalf("expected a *KMSError, got %T", err)
+	}
+	if kmsErr.Operation != "dec_keys" || kmsErr.StatusCode != http.StatusBadRequest || kmsErr.Message != "key not found" {
+		t.Errorf("unexpected error fields: %+v", kmsErr)
+	}
+	if len(kmsErr.Details) != 1 || kmsErr.Details[0]["key_ID"] != "abc" {
+		t.Errorf("expected details to be parsed, got %v", kmsErr.Details)
+	}
+	if kms.count() != 1 {
+		t.Errorf("expected a rejected request not to be retried, got %d requests", kms.count())
+	}
+}
+
+func TestKMSRequestEndpointNotFound(t *testing.T) {
+	repo, kms := newErrorRepo(t, http.StatusNotFound, "404 page not found")
+
+	_, _, err := repo.GetNewKey(context.Background())
+	if !errors.Is(err, ErrEndpointNotFound) || IsTransient(err) {
+		t.Fatalf("expected a permanent ErrEndpointNotFound, got %v", err)
+	}
+	if kms.count() != 1 {
+		t.Errorf("expected a wrong KMS URL not to be retried, got %d requests", kms.count())
+	}
+}
+
+func TestKMSRequestRetriesServerError(t *testing.T) {
+	repo, kms := newErrorRepo(t, http.StatusServiceUnavailable, `{"message":"KME busy"}`)
+
+	_, _, err := repo.GetNewKey(context.Background())
+	if !errors.Is(err, ErrServerError) || !IsTransient(err) {
+		t.Fatalf("expected a transient ErrServerError, got %v", err)
+	}
+	if kms.count() != 3 {
+		t.Errorf("expected 1 request and 2 retries, got %d requests", kms.count())
+	}
+}
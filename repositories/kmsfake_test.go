@@ -0,0 +1,166 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKMS is an ETSI 014 KMS for tests. It issues numbered keys on enc_keys, answers
+// dec_keys with a key of the requested ID and reports maxPerRequest on status. While a
+// status is injected with fail, every request is answered with it. All requests are
+// counted and recorded.
+type fakeKMS struct {
+	name          string // prefix of the issued key IDs, "key" if empty
+	maxPerRequest int    // max_key_per_request reported by status
+	rejectPost    int    // status answering POST requests, none if zero
+
+	mu       sync.Mutex
+	status   int    // injected HTTP status, none if zero
+	body     string // body sent with the injected status
+	next     int    // number of issued keys
+	calls    int
+	statuses int      // requests of status
+	methods  []string // HTTP methods of all requests
+	keyIDs   []string // key IDs requested by dec_keys
+	batches  []int    // numbers of keys requested by enc_keys
+}
+
+// start serves the KMS until the end of the test and returns its URL.
+func (k *fakeKMS) start(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(k)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func (k *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.calls++
+	k.methods = append(k.methods, r.Method)
+	switch {
+	case k.status != 0:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(k.status)
+		_, _ = io.WriteString(w, k.body)
+	case r.Method == http.MethodPost && k.rejectPost != 0:
+		w.WriteHeader(k.rejectPost)
+	case r.URL.Path == "/status":
+		k.statuses++
+		_ = json.NewEncoder(w).Encode(map[string]int{"max_key_per_request": k.maxPerRequest})
+	case r.URL.Path == "/enc_keys":
+		number, ok := encKeysNumber(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		k.batches = append(k.batches, number)
+		var res kmsResponse
+		for range number {
+			k.next++
+			key := make([]byte, 32)
+			key[0] = byte(k.next)
+			res.Keys = append(res.Keys, kmsKey{ID: fmt.Sprintf("%s-%d", k.prefix(), k.next), Key: base64.StdEncoding.EncodeToString(key)})
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	case r.URL.Path == "/dec_keys":
+		keyID, ok := decKeysID(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		k.keyIDs = append(k.keyIDs, keyID)
+		key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+		_ = json.NewEncoder(w).Encode(kmsResponse{Keys: []kmsKey{{ID: keyID, Key: key}}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// encKeysNumber returns the number of keys requested by enc_keys, 1 if not set.
+func encKeysNumber(r *http.Request) (int, bool) {
+	if r.Method == http.MethodPost {
+		var req encKeysRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Size != 256 || req.Number < 1 {
+			return 0, false
+		}
+		return req.Number, true
+	}
+	v := r.URL.Query().Get("number")
+	if v == "" {
+		return 1, true
+	}
+	number, err := strconv.Atoi(v)
+	return number, err == nil && number > 0
+}
+
+// decKeysID returns the single key ID requested by dec_keys.
+func decKeysID(r *http.Request) (string, bool) {
+	if r.Method == http.MethodPost {
+		var req decKeysRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.KeyIDs) != 1 {
+			return "", false
+		}
+		return req.KeyIDs[0].KeyID, true
+	}
+	keyID := r.URL.Query().Get("key_ID")
+	return keyID, keyID != ""
+}
+
+func (k *fakeKMS) prefix() string {
+	if k.name == "" {
+		return "key"
+	}
+	return k.name
+}
+
+// issued reports whether the key of the key handle keyID was issued by this KMS.
+func (k *fakeKMS) issued(keyID string) bool {
+	id, _ := parseKeyHandle(keyID)
+	return strings.HasPrefix(id, k.prefix()+"-")
+}
+
+// fail answers every following request with status, recovered with fail(0).
+func (k *fakeKMS) fail(status int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.status = status
+}
+
+func (k *fakeKMS) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.calls
+}
+
+func (k *fakeKMS) statusRequests() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.statuses
+}
+
+func (k *fakeKMS) requestMethods() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.methods...)
+}
+
+func (k *fakeKMS) requestedKeyIDs() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.keyIDs...)
+}
+
+func (k *fakeKMS) batchSizes() []int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]int(nil), k.batches...)
+}
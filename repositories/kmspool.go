@@ -0,0 +1,226 @@
+package repositories
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// KMSKeyPool prefetches keys from the KMS in the background, so that a rotation
+// does not depend on the KMS answering at that very moment. Keys are requested in
+// batches of up to max_key_per_request as announced by the KMS status endpoint, which is
+// read on the first refill and again after a failed one.
+//
+// Only an active pool is refilled, see SetActive, so a node which is not going to
+// request keys does not take them from the KMS. Keys older than maxAge are discarded,
+// all keys left in the pool are zeroized on Close. If the pool is empty GetNewKey falls
+// back to a direct KMS request.
+type KMSKeyPool struct {
+	repo       *HTTPKMSRepository
+	size       int
+	maxAge     time.Duration
+	retryDelay time.Duration
+
+	mu     sync.Mutex
+	keys   []pooledKey
+	active bool
+	closed bool
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type pooledKey struct {
+	keyMaterial
+	fetched time.Time
+}
+
+// NewKMSKeyPool creates a pool holding up to size keys of repo for at most maxAge.
+// retryDelay is the pause after a failed refill. Call Start and SetActive to begin
+// prefetching.
+func NewKMSKeyPool(repo *HTTPKMSRepository, size int, maxAge, retryDelay time.Duration) *KMSKeyPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KMSKeyPool{
+		repo:       repo,
+		size:       size,
+		maxAge:     maxAge,
+		retryDelay: retryDelay,
+		wake:       make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start launches the background refill.
+func (p *KMSKeyPool) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+// SetActive starts or stops the refill of the pool. Keys already pooled are kept until
+// they expire.
+func (p *KMSKeyPool) SetActive(active bool) {
+	p.mu.Lock()
+	changed := p.active != active
+	p.active = active
+	p.mu.Unlock()
+	if changed && active {
+		p.refill()
+	}
+}
+
+// Close stops the background refill and zeroizes all unused keys.
+func (p *KMSKeyPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	p.cancel()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		clear(k.key)
+	}
+	p.keys = nil
+	p.updateMetric()
+	return nil
+}
+
+// GetNewKey returns the oldest key of the pool which has not expired yet.
+func (p *KMSKeyPool) GetNewKey(ctx context.Context) (keyID string, key []byte, err error) {
+	p.mu.Lock()
+	p.expire()
+	var k pooledKey
+	pooled := len(p.keys) > 0
+	if pooled {
+		k = p.keys[0]
+		p.keys[0] = pooledKey{}
+		p.keys = p.keys[1:]
+		p.updateMetric()
+	}
+	p.mu.Unlock()
+	p.refill()
+	if !pooled {
+		slog.Warn("KMS key pool empty, requesting key directly", "kms_url", p.repo.name())
+		return p.repo.GetNewKey(ctx)
+	}
+	return k.handle(), k.key, nil
+}
+
+// GetKeyByID requests the key from the KMS, keys of the peer are never pooled.
+func (p *KMSKeyPool) GetKeyByID(ctx context.Context, keyID *string) (key []byte, err error) {
+	return p.repo.GetKeyByID(ctx, keyID)
+}
+
+// Check verifies that the KMS is reachable.
+func (p *KMSKeyPool) Check(ctx context.Context) error {
+	return p.repo.Check(ctx)
+}
+
+// Len returns the number of keys in the pool.
+func (p *KMSKeyPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.keys)
+}
+
+// refill wakes up the background refill without blocking.
+func (p *KMSKeyPool) refill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *KMSKeyPool) run() {
+	defer p.wg.Done()
+	perRequest, checked := 1, false
+	for {
+		wait := p.maxAge
+		p.mu.Lock()
+		p.expire()
+		missing := 0
+		if p.active {
+			missing = p.size - len(p.keys)
+		}
+		if len(p.keys) > 0 {
+			wait = time.Until(p.keys[0].fetched.Add(p.maxAge))
+		}
+		p.mu.Unlock()
+
+		if missing > 0 {
+			if !checked {
+				if status, err := p.repo.status(p.ctx); err == nil && status.MaxKeyPerRequest > 0 {
+					perRequest = status.MaxKeyPerRequest
+				}
+				checked = true
+			}
+			keys, err := p.repo.getNewKeys(p.ctx, min(missing, perRequest))
+			if err == nil {
+				p.add(keys)
+				continue
+			}
+			if p.ctx.Err() != nil {
+				return
+			}
+			slog.Warn("failed to refill KMS key pool", "kms_url", p.repo.name(), logging.KeyError, err)
+			// The KMS may have changed its limits, e.g. after a restart
+			checked = false
+			wait = p.retryDelay
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-p.ctx.Done():
+			timer.Stop()
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// add stores fetched keys, keys exceeding the pool size are zeroized.
+func (p *KMSKeyPool) add(keys []keyMaterial) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range keys {
+		if p.closed || len(p.keys) >= p.size {
+			clear(k.key)
+			continue
+		}
+		p.keys = append(p.keys, pooledKey{keyMaterial: k, fetched: now})
+	}
+	p.updateMetric()
+}
+
+// expire zeroizes and drops keys older than maxAge, the caller must hold p.mu.
+func (p *KMSKeyPool) expire() {
+	i := 0
+	for i < len(p.keys) && time.Since(p.keys[i].fetched) > p.maxAge {
+		clear(p.keys[i].key)
+		i++
+	}
+	if i > 0 {
+		p.keys = p.keys[i:]
+		p.updateMetric()
+	}
+}
+
+// updateMetric exports the pool size, the caller must hold p.mu.
+func (p *KMSKeyPool) updateMetric() {
+	metrics.KMSPoolKeys.Set(float64(len(p.keys)), p.repo.name())
+}
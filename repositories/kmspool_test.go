@@ -0,0 +1,143 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, kms *fakeKMS, size int, maxAge time.Duration) *KMSKeyPool {
+	t.Helper()
+	repo := NewHTTPKMSRepository([]KMSEndpoint{{URL: kms.start(t)}}, KMSMethodGet, time.Second, 0, time.Millisecond, 3, time.Minute)
+	pool := NewKMSKeyPool(repo, size, maxAge, 10*time.Millisecond)
+	t.Cleanup(func() { _ = pool.Close() })
+	return pool
+}
+
+func waitForLen(t *testing.T, pool *KMSKeyPool, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Len() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pooled keys, got %d", want, pool.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestKMSKeyPoolBatchesByMaxKeyPerRequest(t *testing.T) {
+	kms := &fakeKMS{maxPerRequest: 2}
+	pool := newTestPool(t, kms, 5, time.Minute)
+	pool.Start()
+	pool.SetActive(true)
+	waitForLen(t, pool, 5)
+
+	batches := kms.batchSizes()
+	if len(batches) != 3 || batches[0] != 2 || batches[1] != 2 || batches[2] != 1 {
+		t.Fatalf("expected batches [2 2 1], got %v", batches)
+	}
+	if kms.statusRequests() != 1 {
+		t.Fatalf("expected max_key_per_request to be read once, got %d status requests", kms.statusRequests())
+	}
+}
+
+func TestKMSKeyPoolRefillsOnlyWhileActive(t *testing.T) {
+	kms := &fakeKMS{maxPerRequest: 10}
+	pool := newTestPool(t, kms, 3, time.Minute)
+	pool.Start()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(kms.batchSizes()); n != 0 {
+		t.Fatalf("expected an inactive pool not to request keys, got %d requests", n)
+	}
+	pool.SetActive(true)
+	waitForLen(t, pool, 3)
+
+	pool.SetActive(false)
+	if _, _, err := pool.GetNewKey(context.Background()); err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pool.Len() != 2 || len(kms.batchSizes()) != 1 {
+		t.Fatalf("expected an inactive pool to keep its keys without refill, got %d keys after %d requests", pool.Len(), len(kms.batchSizes()))
+	}
+}
+
+func TestKMSKeyPoolGetNewKeyRefills(t *testing.T) {
+	kms := &fakeKMS{maxPerRequest: 10}
+	pool := newTestPool(t, kms, 3, time.Minute)
+	pool.Start()
+	pool.SetActive(true)
+	waitForLen(t, pool, 3)
+
+	keyID, key, err := pool.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	if keyID != "key-1" || key[0] != 1 {
+		t.Fatalf("expected oldest key key-1, got %s", keyID)
+	}
+	waitForLen(t, pool, 3)
+}
+
+func TestKMSKeyPoolFallsBackWhenEmpty(t *testing.T) {
+	kms := &fakeKMS{maxPerRequest: 1}
+	pool := newTestPool(t, kms, 1, time.Minute)
+
+	keyID, _, err := pool.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	if keyID != "key-1" {
+		t.Fatalf("expected direct KMS key key-1, got %s", keyID)
+	}
+}
+
+func TestKMSKeyPoolExpiresKeys(t *testing.T) {
+	kms := &fakeKMS{maxPerRequest: 1}
+	pool := newTestPool(t, kms, 1, time.Minute)
+	pool.add([]keyMaterial{{id: "old", key: []byte{1, 2, 3}}})
+	old := pool.keys[0].key
+	pool.keys[0].fetched = time.Now().Add(-2 * time.Minute)
+
+	keyID, _, err := pool.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetNewKey failed: %v", err)
+	}
+	if keyID == "old" {
+		t.Fatal("expired key must not be returned")
+	}
+	for _, b := range old {
+		if b != 0 {
+			t.Fatal("expired key must be zeroized")
+		}
+	}
+}
+
+func TestKMSKeyPoolCloseZeroizesKeys(t *testing.T) {
+	kms := &fakeKMS{maxPerRequest: 4}
+	pool := newTestPool(t, kms, 4, time.Minute)
+	pool.Start()
+	pool.SetActive(true)
+	waitForLen(t, pool, 4)
+
+	pool.mu.Lock()
+	var keys [][]byte
+	for _, k := range pool.keys {
+		keys = append(keys, k.key)
+	}
+	pool.mu.Unlock()
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if pool.Len() != 0 {
+		t.Fatalf("expected empty pool after Close, got %d keys", pool.Len())
+	}
+	for _, key := range keys {
+		for _, b := range key {
+			if b != 0 {
+				t.Fatal("pooled key must be zeroized on Close")
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime/secret"
+	"strconv"
+	"sync"
+)
+
+// ErrNoMLKEMKey is returned by MLKEMRepository.GetNewKey as long as no ML-KEM exchange
+// established a key for the current or the previous interval.
+var ErrNoMLKEMKey = errors.New("no ML-KEM key established for the current interval")
+
+// ErrMLKEMGenerationUnknown is returned by MLKEMRepository.GetKeyByID if no ML-KEM
+// exchange established a key for the requested generation.
+var ErrMLKEMGenerationUnknown = errors.New("ML-KEM key generation unknown")
+
+// mlkemLabel separates the keys derived from ML-KEM shared secrets from any other use.
+const mlkemLabel = "arnika mlkem:"
+
+// MLKEMRepository holds the PQC keys established by ML-KEM exchanges (FIPS 203) with
+// the remote node. The initiator sends the encapsulation key of a fresh decapsulation
+// key, the responder answers with the ciphertext, and both derive the same key bound to
+// the exchange.
+//
+// Every key belongs to a generation, the epoch interval from which on it is used. The
+// key of the next interval is exchanged while the current one is still in use, so both
+// nodes read the same key during a rotation. If an exchange fails the key of the
+// previous interval is used once more.
+//
+// The ID of a key is its generation. The PRIMARY picks the key by its own clock and
+// sends the ID along, the BACKUP reads the same key with GetKeyByID even if its clock
+// is in another interval.
+type MLKEMRepository struct {
+	level      int
+	generation func() uint64
+
+	mu   sync.Mutex
+	keys map[uint64][]byte
+	// last exchange answered by Respond, a retransmitted encapsulation key is
+	// answered with the same ciphertext so that both nodes keep the same key
+	lastGeneration uint64
+	lastEK, lastCT []byte
+}
+
+// NewMLKEMRepository returns a repository for ML-KEM-768 or ML-KEM-1024 keys, generation
+// returns the current epoch interval.
+func NewMLKEMRepository(level int, generation func() uint64) (*MLKEMRepository, error) {
+	if level != 768 && level != 1024 {
+		return nil, fmt.Errorf("unsupported ML-KEM parameter set: %d", level)
+	}
+	return &MLKEMRepository{level: level, generation: generation, keys: make(map[uint64][]byte)}, nil
+}
+
+// Level returns the ML-KEM parameter set, 768 or 1024.
+func (r *MLKEMRepository) Level() int {
+	return r.level
+}
+
+// Initiate returns a fresh decapsulation key for an exchange started by this node. The
+// encapsulation key sent to the remote node is dk.Encapsulator().Bytes().
+func (r *MLKEMRepository) Initiate() (crypto.Decapsulator, error) {
+	if r.level == 1024 {
+		return mlkem.GenerateKey1024()
+	}
+	return mlkem.GenerateKey768()
+}
+
+// Complete decapsulates the ciphertext the remote node answered an exchange of
+// Initiate with and stores the key for generation.
+func (r *MLKEMRepository) Complete(dk crypto.Decapsulator, generation uint64, ciphertext []byte) error {
+	var key []byte
+	var err error
+	secret.Do(func() {
+		var shared []byte
+		shared, err = dk.Decapsulate(ciphertext)
+		if err != nil {
+			return
+		}
+		defer clear(shared)
+		key, err = deriveMLKEMKey(shared, generation, dk.Encapsulator().Bytes(), ciphertext)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decapsulate ML-KEM ciphertext: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store(generation, key)
+	return nil
+}
+
+// Respond encapsulates a key to the encapsulation key of an exchange started by the
+// remote node, stores it for generation and returns the ciphertext. Only exchanges
+// for the current and the next interval are answered.
+func (r *MLKEMRepository) Respond(generation uint64, encapsulationKey []byte) ([]byte, error) {
+	if current := r.generation(); generation != current && generation != current+1 {
+		return nil, fmt.Errorf("ML-KEM exchange for interval %d outside of interval %d", generation, current)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if generation == r.lastGeneration && bytes.Equal(encapsulationKey, r.lastEK) {
+		return r.lastCT, nil
+	}
+	var ek crypto.Encapsulator
+	var err error
+	if r.level == 1024 {
+		ek, err = mlkem.NewEncapsulationKey1024(encapsulationKey)
+	} else {
+		ek, err = mlkem.NewEncapsulationKey768(encapsulationKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM-%d encapsulation key: %w", r.level, err)
+	}
+	var key, ciphertext []byte
+	secret.Do(func() {
+		var shared []byte
+		shared, ciphertext = ek.Encapsulate()
+		defer clear(shared)
+		key, err = deriveMLKEMKey(shared, generation, encapsulationKey, ciphertext)
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.store(generation, key)
+	r.lastGeneration = generation
+	r.lastEK = bytes.Clone(encapsulationKey)
+	r.lastCT = ciphertext
+	return ciphertext, nil
+}
+
+// store replaces the key of generation and drops keys that are no longer used.
+// The caller must hold r.mu.
+func (r *MLKEMRepository) store(generation uint64, key []byte) {
+	if old, ok := r.keys[generation]; ok {
+		clear(old)
+	}
+	r.keys[generation] = key
+	for g, old := range r.keys {
+		if g+1 < generation {
+			clear(old)
+			delete(r.keys, g)
+		}
+	}
+}
+
+// GetNewKey returns a copy of the key of the current interval, or of the previous
+// interval if the last exchange failed, and its generation as ID.
+func (r *MLKEMRepository) GetNewKey(ctx context.Context) (string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	current := r.generation()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	generation := current
+	key, ok := r.keys[generation]
+	if !ok && current > 0 {
+		generation = current - 1
+		key, ok = r.keys[generation]
+	}
+	if !ok {
+		return "", nil, ErrNoMLKEMKey
+	}
+	return strconv.FormatUint(generation, 10), bytes.Clone(key), nil
+}
+
+// GetKeyByID returns a copy of the key of the generation keyID.
+func (r *MLKEMRepository) GetKeyByID(ctx context.Context, keyID *string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if keyID == nil {
+		return nil, fmt.Errorf("%w: empty key ID", ErrMLKEMGenerationUnknown)
+	}
+	generation, err := strconv.ParseUint(*keyID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrMLKEMGenerationUnknown, *keyID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keys[generation]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrMLKEMGenerationUnknown, generation)
+	}
+	return bytes.Clone(key), nil
+}
+
+// deriveMLKEMKey binds the shared secret to the generation and the transcript of the
+// exchange.
+func deriveMLKEMKey(shared []byte, generation uint64, encapsulationKey, ciphertext []byte) ([]byte, error) {
+	transcript := sha256.New()
+	transcript.Write(encapsulationKey)
+	transcript.Write(ciphertext)
+	info := binary.BigEndian.AppendUint64([]byte(mlkemLabel), generation)
+	info = transcript.Sum(info)
+	return hkdf.Key(sha256.New, shared, nil, string(info), mlkem.SharedKeySize)
+}
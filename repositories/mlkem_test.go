@@ -0,0 +1,152 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// exchange runs an ML-KEM exchange for generation from initiator to responder.
+func exchange(t *testing.T, initiator, responder *MLKEMRepository, generation uint64) {
+	t.Helper()
+	dk, err := initiator.Initiate()
+	if err != nil {
+		t.Fatalf("initiate failed: %v", err)
+	}
+	ct, err := responder.Respond(generation, dk.Encapsulator().Bytes())
+	if err != nil {
+		t.Fatalf("respond failed: %v", err)
+	}
+	if err := initiator.Complete(dk, generation, ct); err != nil {
+		t.Fatalf("complete failed: %v", err)
+	}
+}
+
+func TestMLKEMRepository_Exchange(t *testing.T) {
+	for _, level := range []int{768, 1024} {
+		current := uint64(10)
+		generation := func() uint64 { return current }
+		a, err := NewMLKEMRepository(level, generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := NewMLKEMRepository(level, generation)
+
+		if _, _, err := a.GetNewKey(context.Background()); !errors.Is(err, ErrNoMLKEMKey) {
+			t.Fatalf("ML-KEM-%d: expected ErrNoMLKEMKey before the first exchange, got %v", level, err)
+		}
+		exchange(t, a, b, 10)
+		idA, keyA, err := a.GetNewKey(context.Background())
+		if err != nil {
+			t.Fatalf("ML-KEM-%d: initiator key: %v", level, err)
+		}
+		idB, keyB, err := b.GetNewKey(context.Background())
+		if err != nil {
+			t.Fatalf("ML-KEM-%d: responder key: %v", level, err)
+		}
+		if len(keyA) != 32 || !bytes.Equal(keyA, keyB) {
+			t.Fatalf("ML-KEM-%d: nodes derived different keys", level)
+		}
+		if idA != "10" || idB != "10" {
+			t.Fatalf("ML-KEM-%d: expected generation 10 as key ID, got %q and %q", level, idA, idB)
+		}
+
+		// The key of the next interval is not used before that interval starts
+		exchange(t, b, a, 11)
+		if _, key, _ := a.GetNewKey(context.Background()); !bytes.Equal(key, keyA) {
+			t.Fatalf("ML-KEM-%d: key of the next interval used too early", level)
+		}
+		current = 11
+		_, next, _ := a.GetNewKey(context.Background())
+		if bytes.Equal(next, keyA) {
+			t.Fatalf("ML-KEM-%d: key of the next interval not used", level)
+		}
+
+		// Without an exchange for the next interval the key is used once more
+		current = 12
+		if _, key, err := b.GetNewKey(context.Background()); err != nil || !bytes.Equal(key, next) {
+			t.Fatalf("ML-KEM-%d: expected key of the previous interval, got %v", level, err)
+		}
+		current = 13
+		if _, _, err := b.GetNewKey(context.Background()); !errors.Is(err, ErrNoMLKEMKey) {
+			t.Fatalf("ML-KEM-%d: expected outdated key to be rejected, got %v", level, err)
+		}
+	}
+}
+
+func TestMLKEMRepository_GetKeyByID(t *testing.T) {
+	current := uint64(10)
+	primary, _ := NewMLKEMRepository(768, func() uint64 { return current })
+	backup, _ := NewMLKEMRepository(768, func() uint64 { return current })
+	exchange(t, primary, backup, 10)
+	exchange(t, primary, backup, 11)
+
+	// The BACKUP reads the key of the generation picked by the PRIMARY, even if its
+	// own clock is already in the next interval
+	current = 11
+	id, key, err := primary.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := "10"
+	old, err := backup.GetKeyByID(context.Background(), &previous)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(old, key) {
+		t.Fatal("expected the keys of different generations to differ")
+	}
+	got, err := backup.GetKeyByID(context.Background(), &id)
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("expected the key of generation %s, got %v", id, err)
+	}
+	for _, id := range []string{"9", "12", "", "eleven"} {
+		if _, err := backup.GetKeyByID(context.Background(), &id); !errors.Is(err, ErrMLKEMGenerationUnknown) {
+			t.Errorf("expected ErrMLKEMGenerationUnknown for key ID %q, got %v", id, err)
+		}
+	}
+}
+
+func TestMLKEMRepository_RetransmissionKeepsKey(t *testing.T) {
+	generation := func() uint64 { return 1 }
+	a, _ := NewMLKEMRepository(768, generation)
+	b, _ := NewMLKEMRepository(768, generation)
+	dk, err := a.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := b.Respond(2, dk.Encapsulator().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Respond(2, dk.Encapsulator().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("expected the retransmitted encapsulation key to get the same ciphertext")
+	}
+}
+
+func TestMLKEMRepository_RejectsInvalidExchanges(t *testing.T) {
+	generation := func() uint64 { return 5 }
+	if _, err := NewMLKEMRepository(512, generation); err == nil {
+		t.Fatal("expected unsupported parameter set to be rejected")
+	}
+	a, _ := NewMLKEMRepository(1024, generation)
+	b, _ := NewMLKEMRepository(768, generation)
+	dk, err := a.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Respond(5, dk.Encapsulator().Bytes()); err == nil {
+		t.Fatal("expected ML-KEM-1024 encapsulation key to be rejected by ML-KEM-768 responder")
+	}
+	dk, _ = b.Initiate()
+	for _, g := range []uint64{3, 4, 7} {
+		if _, err := b.Respond(g, dk.Encapsulator().Bytes()); err == nil {
+			t.Fatalf("expected exchange for interval %d to be rejected in interval 5", g)
+		}
+	}
+}
@@ -1,26 +1,153 @@
 package repositories
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
 	"runtime/secret"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ErrPQCKeyStale is returned if the PQC key file has not changed within the staleness
+// window, e.g. because Rosenpass stopped rotating it.
+var ErrPQCKeyStale = errors.New("PQC key is stale")
+
+// ErrInsecurePQCFile is returned if the PQC key file or its directory could be replaced
+// or read by other users, see readPQCFile.
+var ErrInsecurePQCFile = errors.New("insecure PQC key file")
+
+// ErrPQCGenerationUnknown is returned by GetKeyByID if the requested generation of the
+// PQC key file is neither the current nor the previous one.
+var ErrPQCGenerationUnknown = errors.New("PQC key generation unknown")
+
+// generationLabel separates the generation ID from any other use of the PQC key.
+const generationLabel = "arnika pqc generation:"
+
+const (
+	// generationWait bounds the time GetKeyByID waits for the generation the peer
+	// combined, both nodes see a new key at about the same time but not at once.
+	generationWait = 5 * time.Second
+	// generationPoll is the interval GetKeyByID rereads the file while waiting.
+	generationPoll = 250 * time.Millisecond
+)
+
+// pqcGeneration is a version of the PQC key file. Generations are numbered locally,
+// the ID is derived from the key and therefore the same on both nodes.
+type pqcGeneration struct {
+	number  uint64
+	id      string
+	key     []byte
+	modTime time.Time
+}
+
+// FilePQCRepository reads the PQC key written by e.g. Rosenpass from a file. Every
+// change of the key starts a new generation, the key of the previous generation is
+// kept so that the BACKUP can combine the same key as the PRIMARY while one of the
+// nodes already sees the next one. The generation ID is the key ID of the PQC key.
 type FilePQCRepository struct {
 	filePath string
+	maxAge   time.Duration
 	Managed  bool
+
+	mu       sync.Mutex
+	current  *pqcGeneration
+	previous *pqcGeneration
 }
 
-func NewFilePQCRepository(filePath string) *FilePQCRepository {
-	return &FilePQCRepository{filePath: filePath}
+// NewFilePQCRepository returns a repository for the PQC key file at filePath. A key older
+// than maxAge, measured from the modification time of the file when the key changed
+// last, is rejected. maxAge 0 disables the check.
+func NewFilePQCRepository(filePath string, maxAge time.Duration) *FilePQCRepository {
+	return &FilePQCRepository{filePath: filePath, maxAge: maxAge, Managed: true}
 }
 
-func (r *FilePQCRepository) GetNewKey() ([]byte, error) {
-	fileData, err := os.ReadFile(r.filePath)
+// GetNewKey rereads the file and returns the current key and its generation ID.
+func (r *FilePQCRepository) GetNewKey(ctx context.Context) (string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	gen, _, err := r.reload()
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+	if err := r.checkAge(gen); err != nil {
+		return "", nil, err
+	}
+	return gen.id, gen.key, nil
+}
+
+// GetKeyByID returns the key of the generation keyID, the current or the previous one.
+// If the file has not changed to that generation yet it is reread until generationWait
+// expires.
+func (r *FilePQCRepository) GetKeyByID(ctx context.Context, keyID *string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, generationWait)
+	defer cancel()
+	for {
+		if _, _, err := r.reload(); err != nil {
+			return nil, err
+		}
+		if gen := r.generation(*keyID); gen != nil {
+			if err := r.checkAge(gen); err != nil {
+				return nil, err
+			}
+			return gen.key, nil
+		}
+		timer := time.NewTimer(generationPoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: %s", ErrPQCGenerationUnknown, *keyID)
+		case <-timer.C:
+		}
+	}
+}
+
+// Generation returns the local number and the ID of the current generation, 0 and an
+// empty ID before the file has been read.
+func (r *FilePQCRepository) Generation() (uint64, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return 0, ""
+	}
+	return r.current.number, r.current.id
+}
+
+// generation returns a copy of the generation with id, nil if it is not known.
+func (r *FilePQCRepository) generation(id string) *pqcGeneration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, gen := range []*pqcGeneration{r.current, r.previous} {
+		if gen != nil && gen.id == id {
+			c := *gen
+			c.key = bytes.Clone(gen.key)
+			return &c
+		}
+	}
+	return nil
+}
+
+// checkAge rejects a generation older than maxAge.
+func (r *FilePQCRepository) checkAge(gen *pqcGeneration) error {
+	if age := time.Since(gen.modTime); r.maxAge > 0 && age > r.maxAge {
+		clear(gen.key)
+		return fmt.Errorf("%w: unchanged for %s, longer than %s", ErrPQCKeyStale, age.Truncate(time.Second), r.maxAge)
+	}
+	return nil
+}
+
+// reload reads the file and starts a new generation if the key changed. It returns a
+// copy of the current generation and whether it is new.
+func (r *FilePQCRepository) reload() (*pqcGeneration, bool, error) {
+	fileData, modTime, err := readPQCFile(r.filePath)
+	if err != nil {
+		return nil, false, err
 	}
 	defer clear(fileData)
 
@@ -30,10 +157,41 @@ func (r *FilePQCRepository) GetNewKey() ([]byte, error) {
 		rawKey, err = base64.StdEncoding.DecodeString(line)
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode PQC key: %w", err)
+		return nil, false, fmt.Errorf("failed to decode PQC key: %w", err)
 	}
 	if len(rawKey) == 0 {
-		return nil, fmt.Errorf("PQC key file is empty or contains only whitespace")
+		return nil, false, fmt.Errorf("PQC key file is empty or contains only whitespace")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.current == nil || !bytes.Equal(r.current.key, rawKey)
+	if changed {
+		if r.previous != nil {
+			clear(r.previous.key)
+		}
+		gen := &pqcGeneration{number: 1, id: generationID(rawKey), key: rawKey, modTime: modTime}
+		if r.current != nil {
+			gen.number = r.current.number + 1
+		}
+		r.previous, r.current = r.current, gen
+	} else {
+		clear(rawKey)
 	}
-	return rawKey, nil
+	c := *r.current
+	c.key = bytes.Clone(r.current.key)
+	return &c, changed, nil
+}
+
+// generationID derives the ID of a PQC key generation. It is a truncated hash over a
+// dedicated label and the key, so both nodes agree on it without revealing the key.
+func generationID(key []byte) string {
+	var id []byte
+	secret.Do(func() {
+		h := sha256.New()
+		h.Write([]byte(generationLabel))
+		h.Write(key)
+		id = h.Sum(nil)[:8]
+	})
+	return hex.EncodeToString(id)
 }
@@ -1,21 +1,25 @@
 package repositories
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFilePQCRepository_EmptyKey(t *testing.T) {
 	tmpDir := t.TempDir()
 
 	emptyFile := filepath.Join(tmpDir, "empty.key")
-	if err := os.WriteFile(emptyFile, []byte(""), 0644); err != nil {
+	if err := os.WriteFile(emptyFile, []byte(""), 0600); err != nil {
 		t.Fatalf("failed to create empty key file: %v", err)
 	}
 
-	repo := NewFilePQCRepository(emptyFile)
-	_, err := repo.GetNewKey()
+	repo := NewFilePQCRepository(emptyFile, 0)
+	_, _, err := repo.GetNewKey(context.Background())
 	if err == nil {
 		t.Error("expected error for empty key file, got nil")
 	}
@@ -25,12 +29,12 @@ func TestFilePQCRepository_WhitespaceOnly(t *testing.T) {
 	tmpDir := t.TempDir()
 
 	wsFile := filepath.Join(tmpDir, "whitespace.key")
-	if err := os.WriteFile(wsFile, []byte("   \n\t  "), 0644); err != nil {
+	if err := os.WriteFile(wsFile, []byte("   \n\t  "), 0600); err != nil {
 		t.Fatalf("failed to create whitespace key file: %v", err)
 	}
 
-	repo := NewFilePQCRepository(wsFile)
-	_, err := repo.GetNewKey()
+	repo := NewFilePQCRepository(wsFile, 0)
+	_, _, err := repo.GetNewKey(context.Background())
 	if err == nil {
 		t.Error("expected error for whitespace-only key file, got nil")
 	}
@@ -41,12 +45,12 @@ func TestFilePQCRepository_ValidKey(t *testing.T) {
 
 	validKey := "dGVzdGtleTEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="
 	validFile := filepath.Join(tmpDir, "valid.key")
-	if err := os.WriteFile(validFile, []byte(validKey), 0644); err != nil {
+	if err := os.WriteFile(validFile, []byte(validKey), 0600); err != nil {
 		t.Fatalf("failed to create valid key file: %v", err)
 	}
 
-	repo := NewFilePQCRepository(validFile)
-	key, err := repo.GetNewKey()
+	repo := NewFilePQCRepository(validFile, 0)
+	_, key, err := repo.GetNewKey(context.Background())
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -54,3 +58,112 @@ func TestFilePQCRepository_ValidKey(t *testing.T) {
 		t.Error("expected non-empty key")
 	}
 }
+
+func TestFilePQCRepository_Generations(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "pqc.key")
+	write := func(key string) {
+		t.Helper()
+		if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString([]byte(key))), 0600); err != nil {
+			t.Fatalf("failed to write key file: %v", err)
+		}
+	}
+	write("first key")
+	repo := NewFilePQCRepository(keyFile, 0)
+	first, _, err := repo.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again, _, _ := repo.GetNewKey(context.Background()); again != first {
+		t.Fatalf("expected unchanged file to keep generation %s, got %s", first, again)
+	}
+
+	write("second key")
+	second, key, err := repo.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second == first || string(key) != "second key" {
+		t.Fatalf("expected a new generation for the changed key, got %s", second)
+	}
+	if number, id := repo.Generation(); number != 2 || id != second {
+		t.Fatalf("expected generation 2 %s, got %d %s", second, number, id)
+	}
+	if other := NewFilePQCRepository(keyFile, 0); generationOf(t, other) != second {
+		t.Fatal("expected the generation ID to depend on the key only")
+	}
+
+	// The peer may still combine the previous key
+	key, err = repo.GetKeyByID(context.Background(), &first)
+	if err != nil || string(key) != "first key" {
+		t.Fatalf("expected key of the previous generation, got %q: %v", key, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	unknown := "0000000000000000"
+	if _, err := repo.GetKeyByID(ctx, &unknown); !errors.Is(err, ErrPQCGenerationUnknown) {
+		t.Fatalf("expected ErrPQCGenerationUnknown, got %v", err)
+	}
+}
+
+func generationOf(t *testing.T, repo *FilePQCRepository) string {
+	t.Helper()
+	id, _, err := repo.GetNewKey(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return id
+}
+
+func TestFilePQCRepository_StaleKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "pqc.key")
+	if err := os.WriteFile(keyFile, []byte("dGVzdGtleQ=="), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(keyFile, old, old); err != nil {
+		t.Fatalf("failed to age key file: %v", err)
+	}
+	if _, _, err := NewFilePQCRepository(keyFile, 10*time.Minute).GetNewKey(context.Background()); !errors.Is(err, ErrPQCKeyStale) {
+		t.Fatalf("expected ErrPQCKeyStale, got %v", err)
+	}
+	if _, _, err := NewFilePQCRepository(keyFile, 2*time.Hour).GetNewKey(context.Background()); err != nil {
+		t.Fatalf("unexpected error within the staleness window: %v", err)
+	}
+}
+
+func TestFilePQCRepository_Watch(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "pqc.key")
+	if err := os.WriteFile(keyFile, []byte("Zmlyc3Q="), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	repo := NewFilePQCRepository(keyFile, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan string, 4)
+	done := make(chan error, 1)
+	go func() { done <- repo.Watch(ctx, func(_ uint64, id string) { changed <- id }) }()
+	for number, _ := repo.Generation(); number == 0; number, _ = repo.Generation() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Keys are usually replaced by renaming a temporary file onto the key file
+	tmp := filepath.Join(dir, "pqc.key.tmp")
+	if err := os.WriteFile(tmp, []byte("c2Vjb25k"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	if err := os.Rename(tmp, keyFile); err != nil {
+		t.Fatalf("failed to replace key file: %v", err)
+	}
+	select {
+	case id := <-changed:
+		if _, current := repo.Generation(); id != current {
+			t.Fatalf("expected change to generation %s, got %s", current, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported for the replaced key file")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package repositories
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPQCFile returns the content and the modification time of the PQC key file. The
+// directory and the file are opened with openat2 without following symlinks, and both
+// are checked on the opened descriptors, so the file can not be swapped between the
+// checks and the read (GHSA-rc6v-5rmx-w5mv):
+//   - the directory must be owned by root or the Arnika user and not writable by group or others
+//   - the file must be a regular file without further hard links, owned by root or the
+//     Arnika user and not accessible by group or others
+func readPQCFile(path string) ([]byte, time.Time, error) {
+	dirfd, err := unix.Openat2(unix.AT_FDCWD, filepath.Dir(path), &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS,
+	})
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open directory of PQC key file: %w", err)
+	}
+	defer func() { _ = unix.Close(dirfd) }()
+	var dir unix.Stat_t
+	if err := unix.Fstat(dirfd, &dir); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to stat directory of PQC key file: %w", err)
+	}
+	if err := checkPQCDir(&dir); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// O_NONBLOCK keeps a FIFO planted in place of the file from blocking the open
+	fd, err := unix.Openat2(dirfd, filepath.Base(path), &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC | unix.O_NOFOLLOW | unix.O_NONBLOCK | unix.O_NOCTTY,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_BENEATH,
+	})
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to open PQC key file: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer func() { _ = f.Close() }()
+	var file unix.Stat_t
+	if err := unix.Fstat(fd, &file); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to stat PQC key file: %w", err)
+	}
+	if err := checkPQCFile(&file); err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		clear(data)
+		return nil, time.Time{}, err
+	}
+	return data, time.Unix(file.Mtim.Unix()), nil
+}
+
+// checkPQCDir checks the directory of the PQC key file, see readPQCFile.
+func checkPQCDir(st *unix.Stat_t) error {
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return fmt.Errorf("%w: parent is not a directory", ErrInsecurePQCFile)
+	}
+	if !trustedOwner(st.Uid) {
+		return fmt.Errorf("%w: directory is owned by uid %d", ErrInsecurePQCFile, st.Uid)
+	}
+	if perms := st.Mode & 0o7777; perms&0o022 != 0 {
+		return fmt.Errorf("%w: directory has insecure permissions %o: must not be writable by group or others", ErrInsecurePQCFile, perms)
+	}
+	return nil
+}
+
+// checkPQCFile checks the opened PQC key file, see readPQCFile.
+func checkPQCFile(st *unix.Stat_t) error {
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return fmt.Errorf("%w: not a regular file", ErrInsecurePQCFile)
+	}
+	if st.Nlink != 1 {
+		return fmt.Errorf("%w: file has %d hard links", ErrInsecurePQCFile, st.Nlink)
+	}
+	if !trustedOwner(st.Uid) {
+		return fmt.Errorf("%w: file is owned by uid %d", ErrInsecurePQCFile, st.Uid)
+	}
+	if perms := st.Mode & 0o7777; perms&0o077 != 0 {
+		return fmt.Errorf("%w: file has insecure permissions %o: must be 0600 or stricter", ErrInsecurePQCFile, perms)
+	}
+	return nil
+}
+
+// trustedOwner reports whether uid is root or the user Arnika runs as.
+func trustedOwner(uid uint32) bool {
+	return uid == 0 || int(uid) == os.Geteuid()
+}
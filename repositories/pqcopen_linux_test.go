@@ -0,0 +1,147 @@
+package repositories
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestReadPQCFile_Rejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string) string
+		// insecure is set if the file is opened and rejected by the checks, otherwise
+		// openat2 already refuses to open it
+		insecure bool
+	}{
+		{
+			name: "symlinked file",
+			setup: func(t *testing.T, dir string) string {
+				target := writeKey(t, dir, "target.key", 0600)
+				link := filepath.Join(dir, "pqc.key")
+				if err := os.Symlink(target, link); err != nil {
+					t.Fatal(err)
+				}
+				return link
+			},
+		},
+		{
+			name: "symlinked directory",
+			setup: func(t *testing.T, dir string) string {
+				target := filepath.Join(dir, "target")
+				if err := os.Mkdir(target, 0700); err != nil {
+					t.Fatal(err)
+				}
+				writeKey(t, target, "pqc.key", 0600)
+				if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(dir, "link", "pqc.key")
+			},
+		},
+		{
+			name: "hard linked file",
+			setup: func(t *testing.T, dir string) string {
+				target := writeKey(t, dir, "target.key", 0600)
+				link := filepath.Join(dir, "pqc.key")
+				if err := os.Link(target, link); err != nil {
+					t.Fatal(err)
+				}
+				return link
+			},
+			insecure: true,
+		},
+		{
+			name: "FIFO",
+			setup: func(t *testing.T, dir string) string {
+				fifo := filepath.Join(dir, "pqc.key")
+				if err := syscall.Mkfifo(fifo, 0600); err != nil {
+					t.Fatal(err)
+				}
+				return fifo
+			},
+			insecure: true,
+		},
+		{
+			name: "directory",
+			setup: func(t *testing.T, dir string) string {
+				sub := filepath.Join(dir, "pqc.key")
+				if err := os.Mkdir(sub, 0700); err != nil {
+					t.Fatal(err)
+				}
+				return sub
+			},
+			insecure: true,
+		},
+		{
+			name: "group readable file",
+			setup: func(t *testing.T, dir string) string {
+				return writeKey(t, dir, "pqc.key", 0640)
+			},
+			insecure: true,
+		},
+		{
+			name: "group writable directory",
+			setup: func(t *testing.T, dir string) string {
+				if err := os.Chmod(dir, 0770); err != nil {
+					t.Fatal(err)
+				}
+				return writeKey(t, dir, "pqc.key", 0600)
+			},
+			insecure: true,
+		},
+		{
+			name: "world writable directory",
+			setup: func(t *testing.T, dir string) string {
+				if err := os.Chmod(dir, 0o1777); err != nil {
+					t.Fatal(err)
+				}
+				return writeKey(t, dir, "pqc.key", 0600)
+			},
+			insecure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.setup(t, t.TempDir())
+			data, _, err := readPQCFile(path)
+			if err == nil {
+				t.Fatalf("expected file to be rejected, read %q", data)
+			}
+			if tt.insecure && !errors.Is(err, ErrInsecurePQCFile) {
+				t.Fatalf("expected ErrInsecurePQCFile, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadPQCFile_Valid(t *testing.T) {
+	path := writeKey(t, t.TempDir(), "pqc.key", 0400)
+	data, modTime, err := readPQCFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "dGVzdGtleQ==" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	info, _ := os.Stat(path)
+	if !modTime.Equal(info.ModTime()) {
+		t.Fatalf("expected modification time %v, got %v", info.ModTime(), modTime)
+	}
+}
+
+// writeKey writes a PQC key file with perm to dir and returns its path.
+func writeKey(t *testing.T, dir, name string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("dGVzdGtleQ=="), perm); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile is subject to the umask
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+
+package repositories
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// readPQCFile returns the content and the modification time of the PQC key file. The
+// hardened open of Linux is not available, only the opened file is checked.
+func readPQCFile(path string) ([]byte, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, time.Time{}, fmt.Errorf("%w: not a regular file", ErrInsecurePQCFile)
+	}
+	if perms := info.Mode().Perm(); perms&0o077 != 0 {
+		return nil, time.Time{}, fmt.Errorf("%w: file has insecure permissions %o: must be 0600 or stricter", ErrInsecurePQCFile, perms)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		clear(data)
+		return nil, time.Time{}, err
+	}
+	return data, info.ModTime(), nil
+}
@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the events on the directory of the PQC key file which may replace
+// the key: the file was written and closed, or another file was renamed onto it.
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO
+
+// Watch watches the directory of the PQC key file with inotify until ctx is done and
+// calls changed with the number and the ID of the new generation whenever the key changed. The directory is
+// watched instead of the file, so keys written to a temporary file and renamed onto the
+// PQC key file are seen as well. Errors reading a changed file are reported by the next
+// GetNewKey.
+func (r *FilePQCRepository) Watch(ctx context.Context, changed func(generation uint64, id string)) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	// A non-blocking descriptor is served by the runtime poller, so closing it ends Read
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	defer func() { _ = inotify.Close() }()
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(r.filePath), watchMask); err != nil {
+		return fmt.Errorf("failed to watch directory of PQC key file: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = inotify.Close() })
+	defer stop()
+	if _, _, err := r.reload(); err != nil {
+		return err
+	}
+
+	name := []byte(filepath.Base(r.filePath))
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := inotify.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read inotify events: %w", err)
+		}
+		match := false
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + unix.SizeofInotifyEvent
+			end := start + int(event.Len)
+			if end > n {
+				break
+			}
+			if event.Mask&watchMask != 0 && bytes.Equal(bytes.TrimRight(buf[start:end], "\x00"), name) {
+				match = true
+			}
+			off = end
+		}
+		if !match {
+			continue
+		}
+		if gen, isNew, err := r.reload(); err == nil {
+			clear(gen.key)
+			if isNew {
+				changed(gen.number, gen.id)
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package repositories
+
+import (
+	"context"
+	"errors"
+)
+
+// Watch is only supported on Linux, elsewhere the PQC key file is reread by every
+// GetNewKey only.
+func (r *FilePQCRepository) Watch(ctx context.Context, changed func(generation uint64, id string)) error {
+	return errors.ErrUnsupported
+}
@@ -1,8 +1,10 @@
 package repositories
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/arnika-project/arnika/models"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -25,26 +27,53 @@ func NewWireguardNetlinkRepository(interfaceName, peerPublicKey string) (*Wiregu
 	}, nil
 }
 
-func (r *WireguardNetlinkRepository) InvalidateTunnel() error {
+func (r *WireguardNetlinkRepository) InvalidateTunnel(ctx context.Context) error {
 	psk, err := wgtypes.GenerateKey()
 	if err != nil {
 		return err
 	}
-	return r.SetPSK(psk.String())
+	return r.SetPSK(ctx, psk.String())
 }
 
-func (r *WireguardNetlinkRepository) SetPSK(psk string) error {
+// Check verifies that the interface exists and carries the configured peer. Netlink
+// requests can not be interrupted, ctx is only checked before they are sent.
+func (r *WireguardNetlinkRepository) Check(ctx context.Context) error {
+	_, err := r.peer(ctx)
+	return err
+}
+
+// Traffic returns the byte counters of the configured peer.
+func (r *WireguardNetlinkRepository) Traffic(ctx context.Context) (*models.Traffic, error) {
+	peer, err := r.peer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Traffic{ReceiveBytes: peer.ReceiveBytes, TransmitBytes: peer.TransmitBytes}, nil
+}
+
+// peer returns the configured peer of the interface.
+func (r *WireguardNetlinkRepository) peer(ctx context.Context) (*wgtypes.Peer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	// Verify the specified interface exists
-	peers, err := r.conn.Device(r.InterfaceName)
+	device, err := r.conn.Device(r.InterfaceName)
 	if err != nil {
-		return fmt.Errorf("failed to get device %s: %w", r.InterfaceName, err)
+		return nil, fmt.Errorf("failed to get device %s: %w", r.InterfaceName, err)
 	}
-	// verify that the peer public key exists
-	for _, peer := range peers.Peers {
-		if peer.PublicKey.String() != r.PeerPublicKey {
-			return fmt.Errorf("peer with public key %s not found on interface %s", r.PeerPublicKey, r.InterfaceName)
+	// verify that the peer public key exists, the interface may carry further peers
+	for i := range device.Peers {
+		if device.Peers[i].PublicKey.String() == r.PeerPublicKey {
+			return &device.Peers[i], nil
 		}
 	}
+	return nil, fmt.Errorf("peer with public key %s not found on interface %s", r.PeerPublicKey, r.InterfaceName)
+}
+
+func (r *WireguardNetlinkRepository) SetPSK(ctx context.Context, psk string) error {
+	if err := r.Check(ctx); err != nil {
+		return err
+	}
 	validPSK, err := wgtypes.ParseKey(psk)
 	if err != nil {
 		return err
@@ -2,59 +2,116 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"io"
+
 	"github.com/arnika-project/arnika/models"
 )
 
-type keyReaderRepository interface {
-	*KeyReaderManaged | *KeyReaderUnmanaged
-}
-
 type KeyReaderUnmanaged interface {
-	GetNewKey() (key []byte, err error)
+	GetNewKey(ctx context.Context) (key []byte, err error)
 }
 
+// KeyReaderManaged is implemented by key sources with key IDs. The key ID is opaque to
+// the caller, it is sent to the peer which passes it to GetKeyByID of its key source.
 type KeyReaderManaged interface {
-	GetNewKey() (keyID string, key []byte, err error)
-	GetKeyByID(keyID *string) (key []byte, err error)
+	GetNewKey(ctx context.Context) (keyID string, key []byte, err error)
+	GetKeyByID(ctx context.Context, keyID *string) (key []byte, err error)
+}
+
+// keyReaderChecker is implemented by repositories which can check the reachability of their key source.
+type keyReaderChecker interface {
+	Check(ctx context.Context) error
+}
+
+// keyReaderWatcher is implemented by repositories which notice a new key of their key
+// source, changed is called with the local generation number and the key ID.
+type keyReaderWatcher interface {
+	Watch(ctx context.Context, changed func(generation uint64, id string)) error
 }
 
+// ErrKeyIDUnsupported is returned by GetKeyByID for repositories without key IDs.
+var ErrKeyIDUnsupported = errors.New("key source has no key IDs")
+
 type KeyReaderService struct {
 	repoManaged   KeyReaderManaged
 	repoUnmanaged KeyReaderUnmanaged
 }
 
-func NewKeyReaderService[T keyReaderRepository](repo T) *KeyReaderService {
-	if managedRepo, ok := any(repo).(*KeyReaderManaged); ok && managedRepo != nil {
-		return &KeyReaderService{repoManaged: *managedRepo}
-	}
-	if unmanagedRepo, ok := any(repo).(*KeyReaderUnmanaged); ok && unmanagedRepo != nil {
-		return &KeyReaderService{repoUnmanaged: *unmanagedRepo}
-	}
-	panic("invalid repository type passed to NewKeyReaderService")
+// NewManagedKeyReaderService returns the service of a repository with key IDs.
+func NewManagedKeyReaderService(repo KeyReaderManaged) *KeyReaderService {
+	return &KeyReaderService{repoManaged: repo}
 }
 
-func (s *KeyReaderService) GetNewKey() (key *models.Key, err error) {
+// NewUnmanagedKeyReaderService returns the service of a repository without key IDs.
+func NewUnmanagedKeyReaderService(repo KeyReaderUnmanaged) *KeyReaderService {
+	return &KeyReaderService{repoUnmanaged: repo}
+}
+
+// GetNewKey fetches a new key, ctx bounds the request to the key source.
+func (s *KeyReaderService) GetNewKey(ctx context.Context) (key *models.Key, err error) {
 	if s.repoManaged != nil {
-		id, keyBytes, err := s.repoManaged.GetNewKey()
+		id, keyBytes, err := s.repoManaged.GetNewKey(ctx)
 		if err != nil {
 			return nil, err
 		}
 		return &models.Key{ID: &id, Key: keyBytes, Type: models.KeyTypeManaged}, nil
 	}
-	keyBytes, err := s.repoUnmanaged.GetNewKey()
+	keyBytes, err := s.repoUnmanaged.GetNewKey(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return &models.Key{Key: keyBytes, Type: models.KeyTypeUnmanaged}, nil
 }
 
-func (s *KeyReaderService) GetKeyByID(keyID *string) (*models.Key, error) {
-	if s.repoUnmanaged != nil {
-		panic("GetKeyByID is not supported for unmanaged keys")
+// IsManaged reports whether the keys of the repository have IDs, see GetKeyByID.
+func (s *KeyReaderService) IsManaged() bool {
+	return s.repoManaged != nil
+}
+
+func (s *KeyReaderService) GetKeyByID(ctx context.Context, keyID *string) (*models.Key, error) {
+	if s.repoManaged == nil {
+		return nil, ErrKeyIDUnsupported
 	}
-	keyBytes, err := s.repoManaged.GetKeyByID(keyID)
+	keyBytes, err := s.repoManaged.GetKeyByID(ctx, keyID)
 	if err != nil {
 		return nil, err
 	}
 	return &models.Key{ID: keyID, Key: keyBytes, Type: models.KeyTypeManaged}, nil
 }
+
+// Check verifies that the key source is reachable. Repositories without a
+// reachability check are always considered reachable.
+func (s *KeyReaderService) Check(ctx context.Context) error {
+	if checker, ok := s.Repository().(keyReaderChecker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// Watch calls changed whenever the key source has a new key until ctx is done. It
+// returns errors.ErrUnsupported for repositories which can not be watched.
+func (s *KeyReaderService) Watch(ctx context.Context, changed func(generation uint64, id string)) error {
+	if watcher, ok := s.Repository().(keyReaderWatcher); ok {
+		return watcher.Watch(ctx, changed)
+	}
+	return errors.ErrUnsupported
+}
+
+// Repository returns the repository of the service, e.g. for features of a key source
+// beyond reading keys.
+func (s *KeyReaderService) Repository() any {
+	if s.repoManaged != nil {
+		return s.repoManaged
+	}
+	return s.repoUnmanaged
+}
+
+// Close releases resources held by the repository, e.g. zeroizes prefetched keys.
+func (s *KeyReaderService) Close() error {
+	if closer, ok := s.Repository().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -1,8 +1,16 @@
 package services
 
+import (
+	"context"
+
+	"github.com/arnika-project/arnika/models"
+)
+
 type keyWriterRepository interface {
-	InvalidateTunnel() error // Invalidate the WireGuard session by setting a random PSK
-	SetPSK(psk string) error // Set the PSK on the WireGuard interface
+	InvalidateTunnel(ctx context.Context) error           // Invalidate the WireGuard session by setting a random PSK
+	SetPSK(ctx context.Context, psk string) error         // Set the PSK on the WireGuard interface
+	Check(ctx context.Context) error                      // Verify that the WireGuard interface and peer are present
+	Traffic(ctx context.Context) (*models.Traffic, error) // Read the byte counters of the WireGuard peer
 }
 
 type KeyWriterService struct {
@@ -13,11 +21,19 @@ func NewKeyWriterService(repo keyWriterRepository) *KeyWriterService {
 	return &KeyWriterService{repo: repo}
 }
 
-func (s *KeyWriterService) InvalidateTunnel() error {
+func (s *KeyWriterService) InvalidateTunnel(ctx context.Context) error {
+
+	return s.repo.InvalidateTunnel(ctx)
+}
+
+func (s *KeyWriterService) SetPSK(ctx context.Context, psk string) error {
+	return s.repo.SetPSK(ctx, psk)
+}
 
-	return s.repo.InvalidateTunnel()
+func (s *KeyWriterService) Check(ctx context.Context) error {
+	return s.repo.Check(ctx)
 }
 
-func (s *KeyWriterService) SetPSK(psk string) error {
-	return s.repo.SetPSK(psk)
+func (s *KeyWriterService) Traffic(ctx context.Context) (*models.Traffic, error) {
+	return s.repo.Traffic(ctx)
 }
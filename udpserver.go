@@ -1,86 +1,189 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/arnika-project/arnika/auth"
+	"github.com/arnika-project/arnika/logging"
+	"github.com/arnika-project/arnika/metrics"
 )
 
+// replayCacheSize bounds the number of packet signatures kept for replay detection.
+const replayCacheSize = 4096
+
+// errPSKMismatch is returned by udpClient if the PSK confirmation of the peer differs from ours.
+var errPSKMismatch = errors.New("PSK confirmation mismatch")
+
+// keyRequest is a key ID received from the PRIMARY. The BACKUP answers it with
+// reply once the PSK is ready to be installed at activation (auth.ErrorNone and its
+// PSK confirmation) or could not be prepared.
+type keyRequest struct {
+	keyID        string
+	activation   time.Time
+	confirmation []byte
+	pqcID        string // generation of the PQC key combined by the PRIMARY
+	reply        func(class auth.ErrorClass, confirmation []byte)
+}
+
+// udpPeer binds an Arnika PSK to the channel receiving the key IDs authenticated with it.
+type udpPeer struct {
+	psk      []byte
+	result   chan keyRequest
+	log      *slog.Logger
+	election *election
+
+	mu        sync.Mutex
+	lastKeyID string // last delivered key ID
+	lastReply []byte // reply sent for lastKeyID, nil while it is processed
+
+	// left is called once the remote node shut down, invalidated tells whether it
+	// replaced its PSK with a random one. It must not block the UDP server.
+	left func(invalidated bool)
+	// joined is called once a HELLO announced a new instance of the remote node.
+	joined func()
+	// kem answers an ML-KEM exchange started by the remote node with the ciphertext,
+	// nil if PQC_MLKEM is not set.
+	kem func(generation uint64, encapsulationKey []byte) ([]byte, error)
+}
+
+// deliver hands the key request to the peer without blocking the server. A request
+// that has not been picked up yet is answered with a NACK, the latest key ID always wins.
+func (p *udpPeer) deliver(req keyRequest) {
+	for {
+		select {
+		case p.result <- req:
+			return
+		default:
+		}
+		select {
+		case stale := <-p.result:
+			p.log.Warn("key_id superseded before it was processed", logging.KeyKeyID, stale.keyID)
+			stale.reply(auth.ErrorSuperseded, nil)
+		default:
+		}
+	}
+}
+
+// track records keyID as the current key ID of the peer. For a retransmission of
+// the current key ID it returns true and the reply to resend, nil while pending.
+func (p *udpPeer) track(keyID string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if keyID == p.lastKeyID {
+		return p.lastReply, true
+	}
+	p.lastKeyID = keyID
+	p.lastReply = nil
+	return nil, false
+}
+
+// replyFunc returns the function answering keyID to the PRIMARY at addr.
+func (p *udpPeer) replyFunc(conn *net.UDPConn, addr *net.UDPAddr, keyID string) func(auth.ErrorClass, []byte) {
+	return func(class auth.ErrorClass, confirmation []byte) {
+		pkt, err := auth.NewReply(p.psk, keyID, class, confirmation)
+		if err != nil {
+			p.log.Error("failed to create reply", logging.KeyKeyID, keyID, logging.KeyError, err)
+			return
+		}
+		data := []byte(base64.StdEncoding.EncodeToString(pkt.Marshal(p.psk)))
+		p.mu.Lock()
+		if p.lastKeyID == keyID {
+			p.lastReply = data
+		}
+		p.mu.Unlock()
+		if _, err := conn.WriteToUDP(data, addr); err != nil {
+			p.log.Error("failed to send reply", logging.KeyKeyID, keyID, "remote", addr, logging.KeyError, err)
+		}
+	}
+}
+
 // udpServer listens for incoming UDP packets using the security-hardened protocol:
 //   - HMAC-SHA256 signature verification (authentication)
-//   - Timestamp validation (replay protection)
+//   - Timestamp validation and replay cache (replay protection)
 //   - Per-IP rate limiting (flood protection)
 //   - Constant-time checks, uniform error messages (side-channel resistance)
 //
+// Packets are attributed to a peer by the PSK their HMAC signature verifies with.
+//
 // Protocol flow:
-//  1. Client sends DATA packet (signed + encrypted payload) -> Server replies with ACK
-func udpServer(address string, psk []byte, result chan string, done chan bool, rateLimit int, rateWindow, maxClockSkew time.Duration) {
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit,
-		syscall.SIGTERM,
-		syscall.SIGINT,
-	)
-	addr, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		log.Panicf("[ERROR] failed to resolve UDP address %s: %v", address, err)
-	}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		log.Panicf("[ERROR] failed to listen on UDP %s: %v", address, err)
-	}
-	log.Printf("[INFO] %s UDP server started on %s\n", ARNIKALOGPREFIX, address)
+//  1. Client sends DATA packet (signed + encrypted payload)
+//  2. Server prepares the PSK, compares the PSK confirmation and replies with ACK
+//     carrying its own confirmation, or NACK with an auth.ErrorClass
+//  3. Both nodes install the PSK at the activation time carried in the DATA payload
+//  4. Retransmitted DATA packets are answered with the same reply once it is known
+//
+// HELLO packets exchange the election rank, they are answered with our own HELLO.
+// BYE packets announce that the remote node shuts down, they are not answered.
+// KEM packets start an ML-KEM exchange, they are answered with a KEMCT packet.
+// Packets are rejected by type if PQC_MLKEM is not set for the peer.
+// The server reads from conn of udpListener until ctx is done and closes it.
+func udpServer(ctx context.Context, conn *net.UDPConn, peers []*udpPeer, rateLimit int, rateWindow, maxClockSkew time.Duration) {
+	address := conn.LocalAddr().String()
+	slog.Info("UDP server started", "address", address)
+	udpServerRunning.Store(true)
+	defer udpServerRunning.Store(false)
 
 	// Rate limiter: configurable requests per IP per window
 	limiter := newRateLimiter(rateLimit, rateWindow)
+	replays := auth.NewReplayCache(maxClockSkew, replayCacheSize)
 
-	go func() {
-		<-quit
-		log.Printf("[INFO] %s UDP server shutdown triggered on %s", ARNIKALOGPREFIX, address)
-		close(done)
+	stop := context.AfterFunc(ctx, func() {
+		slog.Info("UDP server shutdown triggered", "address", address)
 		_ = conn.Close()
-	}()
+	})
+	defer stop()
 
 	buf := make([]byte, 4096)
 	for {
 		n, remoteAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			select {
-			case <-done:
+			if ctx.Err() != nil {
 				return
-			default:
-				log.Printf("[ERROR] %s UDP read error: %v", ARNIKALOGPREFIX, err)
-				continue
 			}
+			slog.Error("UDP read error", logging.KeyError, err)
+			continue
 		}
 
 		clientIP := remoteAddr.IP.String()
 
 		// 1. Rate limit check (cheapest, no crypto)
 		if !limiter.Allow(clientIP) {
-			log.Printf("[DEBUG] %s rate limited %s", BACKUPLOGPREFIX, remoteAddr)
+			metrics.RateLimited.Inc()
+			slog.Debug("rate limited", "remote", remoteAddr)
 			continue
 		}
 
 		// 2. Base64 decode
 		raw, err := base64.StdEncoding.DecodeString(string(buf[:n]))
 		if err != nil {
-			log.Printf("[DEBUG] %s packet rejected from %s", BACKUPLOGPREFIX, remoteAddr)
+			metrics.UDPRejected.Inc("decode")
+			slog.Debug("packet rejected", "remote", remoteAddr, "reason", "decode")
 			continue
 		}
 
 		// 3. Unmarshal + HMAC verify (cheap, before any decryption)
-		pkt, err := auth.UnmarshalPacket(psk, raw)
-		if err != nil {
-			log.Printf("[WARNING] %s packet rejected from %s", BACKUPLOGPREFIX, remoteAddr)
+		var peer *udpPeer
+		var pkt *auth.Packet
+		for _, p := range peers {
+			if pkt, err = auth.UnmarshalPacket(p.psk, raw); err == nil {
+				peer = p
+				break
+			}
+		}
+		if peer == nil {
+			metrics.UDPRejected.Inc("signature")
+			slog.Warn("packet rejected", "remote", remoteAddr, "reason", "signature")
 			continue
 		}
+		psk := peer.psk
 
 		// 4. Timestamp check (replay protection)
 		now := time.Now().Unix()
@@ -89,42 +192,384 @@ func udpServer(address string, psk []byte, result chan string, done chan bool, r
 			diff = -diff
 		}
 		if diff > int64(maxClockSkew.Seconds()) {
-			log.Printf("[DEBUG] %s packet rejected from %s (timestamp)", BACKUPLOGPREFIX, remoteAddr)
+			metrics.UDPRejected.Inc("timestamp")
+			peer.log.Debug("packet rejected", "remote", remoteAddr, "reason", "timestamp")
 			continue
 		}
 
-		if pkt.Type != auth.PacketData {
-			log.Printf("[DEBUG] %s packet rejected from %s", BACKUPLOGPREFIX, remoteAddr)
+		if pkt.Type != auth.PacketData && pkt.Type != auth.PacketHello && pkt.Type != auth.PacketBye &&
+			(pkt.Type != auth.PacketKEM || peer.kem == nil) {
+			metrics.UDPRejected.Inc("type")
+			peer.log.Debug("packet rejected", "remote", remoteAddr, "reason", "type")
 			continue
 		}
 
-		// 5. Decrypt payload (expensive, only after all cheap checks pass)
+		// 5. Replay check, retransmissions of udpClient are freshly signed and pass
+		if err := replays.Check(pkt); err != nil {
+			reason := "replay"
+			if errors.Is(err, auth.ErrReplayCacheFull) {
+				reason = "replay_cache_full"
+			}
+			metrics.UDPRejected.Inc(reason)
+			peer.log.Warn("packet rejected", "remote", remoteAddr, "reason", reason)
+			continue
+		}
+
+		// 6. Decrypt payload (expensive, only after all cheap checks pass)
 		decrypted, err := auth.Decrypt(psk, pkt.Payload)
 		if err != nil {
-			log.Printf("[DEBUG] %s packet rejected from %s", BACKUPLOGPREFIX, remoteAddr)
-			log.Printf("[ERROR] %s authentication failed, psk mismatch or message corrupted", BACKUPLOGPREFIX)
+			metrics.UDPRejected.Inc("decrypt")
+			peer.log.Debug("packet rejected", "remote", remoteAddr, "reason", "decrypt")
+			peer.log.Error("authentication failed, psk mismatch or message corrupted")
 			continue
 		}
 
-		// 6. Send ACK
-		ack := &auth.Packet{
-			Type:      auth.PacketAck,
-			Timestamp: time.Now().Unix(),
+		if pkt.Type == auth.PacketHello {
+			peer.hello(conn, remoteAddr, decrypted)
+			continue
+		}
+		if pkt.Type == auth.PacketBye {
+			peer.bye(remoteAddr, decrypted)
+			continue
+		}
+		if pkt.Type == auth.PacketKEM {
+			peer.encapsulate(conn, remoteAddr, decrypted)
+			continue
+		}
+
+		// 7. Hand the key ID to the BACKUP, the reply is sent once the PSK is prepared
+		payload, err := auth.UnmarshalKeyPayload(decrypted)
+		if errors.Is(err, auth.ErrUnsupportedVersion) {
+			metrics.UDPRejected.Inc("version")
+			peer.log.Error("packet rejected, the peer runs an incompatible Arnika version", "remote", remoteAddr, "reason", "version", logging.KeyError, err)
+			continue
+		}
+		if err != nil {
+			metrics.UDPRejected.Inc("decode")
+			peer.log.Debug("packet rejected", "remote", remoteAddr, "reason", "decode")
+			continue
 		}
-		ackB64 := base64.StdEncoding.EncodeToString(ack.Marshal(psk))
-		_, _ = conn.WriteToUDP([]byte(ackB64), remoteAddr)
+		if payload.Sender == peer.election.nonce() {
+			metrics.UDPRejected.Inc("reflected")
+			peer.log.Warn("packet rejected", "remote", remoteAddr, "reason", "reflected")
+			continue
+		}
+		keyID := payload.KeyID
+		if reply, retransmit := peer.track(keyID); retransmit {
+			peer.log.Debug("retransmitted key_id", logging.KeyKeyID, keyID, "remote", remoteAddr, "answered", reply != nil)
+			if reply != nil {
+				_, _ = conn.WriteToUDP(reply, remoteAddr)
+			}
+			continue
+		}
+		peer.log.Info("received key_id", logging.KeyKeyID, keyID, "remote", remoteAddr, "activation", payload.Activation)
+		peer.deliver(keyRequest{
+			keyID:        keyID,
+			activation:   payload.Activation,
+			confirmation: payload.Confirmation,
+			pqcID:        payload.PQCID,
+			reply:        peer.replyFunc(conn, remoteAddr, keyID),
+		})
+	}
+}
+
+// hello records the election rank received in a HELLO packet and answers with our own.
+func (p *udpPeer) hello(conn *net.UDPConn, addr *net.UDPAddr, plain []byte) {
+	arnikaID, nonce, err := auth.DecodeHello(plain)
+	var remote rank
+	if err == nil {
+		remote, err = parseRank(arnikaID, nonce)
+	}
+	if err != nil {
+		metrics.UDPRejected.Inc("decode")
+		p.log.Debug("packet rejected", "remote", addr, "reason", "decode")
+		return
+	}
+	if p.election.isSelf(remote) {
+		metrics.UDPRejected.Inc("reflected")
+		p.log.Warn("packet rejected", "remote", addr, "reason", "reflected")
+		return
+	}
+	if p.election.learn(remote) {
+		p.log.Info("role handshake completed", "remote_id", remote.id)
+		p.joined()
+	}
+	encrypted, err := auth.Encrypt(p.psk, p.election.hello())
+	if err != nil {
+		p.log.Error("failed to encrypt HELLO", logging.KeyError, err)
+		return
+	}
+	reply := &auth.Packet{Type: auth.PacketHello, Timestamp: time.Now().Unix(), Payload: encrypted}
+	_, _ = conn.WriteToUDP([]byte(base64.StdEncoding.EncodeToString(reply.Marshal(p.psk))), addr)
+}
+
+// encapsulate answers the ML-KEM exchange started by a KEM packet with the ciphertext.
+func (p *udpPeer) encapsulate(conn *net.UDPConn, addr *net.UDPAddr, plain []byte) {
+	req, err := auth.DecodeKEM(plain)
+	if err != nil {
+		metrics.UDPRejected.Inc("decode")
+		p.log.Debug("packet rejected", "remote", addr, "reason", "decode")
+		return
+	}
+	if req.Sender == p.election.nonce() {
+		metrics.UDPRejected.Inc("reflected")
+		p.log.Warn("packet rejected", "remote", addr, "reason", "reflected")
+		return
+	}
+	ciphertext, err := p.kem(req.Generation, req.Data)
+	if err != nil {
+		p.log.Warn("rejected ML-KEM exchange", "remote", addr, "generation", req.Generation, logging.KeyError, err)
+		return
+	}
+	encrypted, err := auth.Encrypt(p.psk, auth.EncodeKEM(&auth.KEM{Sender: p.election.nonce(), Generation: req.Generation, Data: ciphertext}))
+	if err != nil {
+		p.log.Error("failed to encrypt KEMCT", logging.KeyError, err)
+		return
+	}
+	reply := &auth.Packet{Type: auth.PacketKEMCT, Timestamp: time.Now().Unix(), Payload: encrypted}
+	_, _ = conn.WriteToUDP([]byte(base64.StdEncoding.EncodeToString(reply.Marshal(p.psk))), addr)
+}
+
+// bye records that the remote node announced its shutdown in a BYE packet.
+func (p *udpPeer) bye(addr *net.UDPAddr, plain []byte) {
+	bye, err := auth.DecodeBye(plain)
+	var remote rank
+	if err == nil {
+		remote, err = parseRank(bye.ArnikaID, bye.Nonce)
+	}
+	if err != nil {
+		metrics.UDPRejected.Inc("decode")
+		p.log.Debug("packet rejected", "remote", addr, "reason", "decode")
+		return
+	}
+	if !p.election.leave(remote) {
+		p.log.Debug("ignoring BYE of unknown node", "remote", addr, "remote_id", remote.id)
+		return
+	}
+	p.log.Info("peer shut down, taking over PRIMARY role until it returns", "remote", addr, "remote_id", remote.id, "invalidated", bye.Invalidated)
+	p.left(bye.Invalidated)
+}
 
-		log.Printf("[INFO] %s [RCV] received key_id %s from %s", BACKUPLOGPREFIX, string(decrypted), remoteAddr)
-		result <- string(decrypted)
+// udpListener binds the UDP address of the server, so that an invalid or used address
+// fails the startup.
+func udpListener(address string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP address %s: %w", address, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", address, err)
 	}
+	return conn, nil
 }
 
-// udpClient sends an encrypted, HMAC-signed key ID to the peer via the security-hardened
-// UDP protocol. Retries up to 3 times on timeout.
+// udpBye tells the peer in a single BYE packet that this node shuts down. The packet
+// is not answered, a lost BYE is detected by the peer like any other outage.
+func udpBye(address string, psk, bye []byte) error {
+	if address == "" {
+		return fmt.Errorf("address is empty")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return fmt.Errorf("failed to dial UDP: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	encrypted, err := auth.Encrypt(psk, bye)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt BYE: %w", err)
+	}
+	pkt := &auth.Packet{Type: auth.PacketBye, Timestamp: time.Now().Unix(), Payload: encrypted}
+	if _, err := conn.Write([]byte(base64.StdEncoding.EncodeToString(pkt.Marshal(psk)))); err != nil {
+		return fmt.Errorf("failed to write BYE packet: %w", err)
+	}
+	return nil
+}
+
+// udpHello sends our election rank in a HELLO packet and returns the rank of the peer
+// from its HELLO reply. Retries up to 3 times on timeout.
+func udpHello(ctx context.Context, address string, psk, hello []byte, timeout, maxClockSkew time.Duration) (rank, error) {
+	if address == "" {
+		return rank{}, fmt.Errorf("address is empty")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return rank{}, fmt.Errorf("failed to resolve address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return rank{}, fmt.Errorf("failed to dial UDP: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	const maxRetries = 3
+	buf := make([]byte, 1024)
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		encrypted, err := auth.Encrypt(psk, hello)
+		if err != nil {
+			return rank{}, fmt.Errorf("failed to encrypt HELLO: %w", err)
+		}
+		pkt := &auth.Packet{Type: auth.PacketHello, Timestamp: time.Now().Unix(), Payload: encrypted}
+		if _, err := conn.Write([]byte(base64.StdEncoding.EncodeToString(pkt.Marshal(psk)))); err != nil {
+			return rank{}, fmt.Errorf("failed to write HELLO packet: %w", err)
+		}
+		readDeadline := time.Now().Add(timeout)
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return rank{}, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		n, err := conn.Read(buf)
+		if ctx.Err() != nil {
+			return rank{}, fmt.Errorf("role handshake canceled: %w", ctx.Err())
+		}
+		if err != nil {
+			if attempt < maxRetries {
+				if err := sleep(ctx, time.Until(readDeadline)); err != nil {
+					return rank{}, fmt.Errorf("role handshake canceled: %w", err)
+				}
+				continue
+			}
+			return rank{}, fmt.Errorf("no HELLO after %d attempts: %w", maxRetries, err)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(string(buf[:n]))
+		if err != nil {
+			return rank{}, fmt.Errorf("authentication failed")
+		}
+		reply, err := auth.UnmarshalPacket(psk, raw)
+		if err != nil || reply.Type != auth.PacketHello {
+			return rank{}, fmt.Errorf("authentication failed")
+		}
+		diff := time.Now().Unix() - reply.Timestamp
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > int64(maxClockSkew.Seconds()) {
+			return rank{}, fmt.Errorf("authentication failed")
+		}
+		plain, err := auth.Decrypt(psk, reply.Payload)
+		if err != nil {
+			return rank{}, fmt.Errorf("authentication failed")
+		}
+		arnikaID, nonce, err := auth.DecodeHello(plain)
+		if err != nil {
+			return rank{}, err
+		}
+		return parseRank(arnikaID, nonce)
+	}
+	return rank{}, fmt.Errorf("unreachable")
+}
+
+// udpKEM sends the encapsulation key of an ML-KEM exchange for generation in a KEM
+// packet and returns the ciphertext from the KEMCT reply of the peer. Retries up to 3
+// times on timeout with the same encapsulation key, the peer answers it with the same
+// ciphertext.
+func udpKEM(ctx context.Context, address string, psk []byte, req *auth.KEM, timeout, maxClockSkew time.Duration) ([]byte, error) {
+	if address == "" {
+		return nil, fmt.Errorf("address is empty")
+	}
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial UDP: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	const maxRetries = 3
+	plain := auth.EncodeKEM(req)
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		encrypted, err := auth.Encrypt(psk, plain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt KEM: %w", err)
+		}
+		pkt := &auth.Packet{Type: auth.PacketKEM, Timestamp: time.Now().Unix(), Payload: encrypted}
+		if _, err := conn.Write([]byte(base64.StdEncoding.EncodeToString(pkt.Marshal(psk)))); err != nil {
+			return nil, fmt.Errorf("failed to write KEM packet: %w", err)
+		}
+		readDeadline := time.Now().Add(timeout)
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return nil, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		reply, err := awaitKEM(conn, psk, req, maxClockSkew)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ML-KEM exchange canceled: %w", ctx.Err())
+		}
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			return reply, err // KEMCT or authentication failure
+		}
+		if attempt < maxRetries {
+			if err := sleep(ctx, time.Until(readDeadline)); err != nil {
+				return nil, fmt.Errorf("ML-KEM exchange canceled: %w", err)
+			}
+			continue
+		}
+		return nil, fmt.Errorf("no KEMCT after %d attempts: %w", maxRetries, err)
+	}
+	return nil, fmt.Errorf("unreachable")
+}
+
+// awaitKEM reads replies until the KEMCT answering req arrives and returns its
+// ciphertext. Read errors are returned as is, malformed replies with a uniform error
+// message. Replies carrying the sender of req were reflected and are skipped.
+func awaitKEM(conn *net.UDPConn, psk []byte, req *auth.KEM, maxClockSkew time.Duration) ([]byte, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := base64.StdEncoding.DecodeString(string(buf[:n]))
+		if err != nil {
+			return nil, fmt.Errorf("authentication failed")
+		}
+		pkt, err := auth.UnmarshalPacket(psk, raw)
+		if err != nil || pkt.Type != auth.PacketKEMCT {
+			return nil, fmt.Errorf("authentication failed")
+		}
+		diff := time.Now().Unix() - pkt.Timestamp
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > int64(maxClockSkew.Seconds()) {
+			return nil, fmt.Errorf("authentication failed")
+		}
+		plain, err := auth.Decrypt(psk, pkt.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("authentication failed")
+		}
+		reply, err := auth.DecodeKEM(plain)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Generation != req.Generation || reply.Sender == req.Sender {
+			continue
+		}
+		return reply.Data, nil
+	}
+}
+
+// udpClient sends an encrypted, HMAC-signed key ID with its activation time and PSK
+// confirmation to the peer via the security-hardened UDP protocol and waits until the
+// peer confirms it is ready to install the same PSK at that time. The DATA packet
+// is retransmitted with exponential backoff starting at timeout until ackTimeout expires.
 //
 // Protocol flow:
-//  1. Send DATA (signed + encrypted keyID) -> Receive ACK
-func udpClient(address string, psk []byte, keyID string, timeout time.Duration, maxClockSkew time.Duration) error {
+//  1. Send DATA (signed + encrypted auth.KeyPayload) -> Receive ACK or NACK
+//
+// A NACK is returned as *auth.NackError, an ACK with a different PSK confirmation as errPSKMismatch.
+func udpClient(ctx context.Context, address string, psk []byte, payload *auth.KeyPayload, timeout, ackTimeout, maxClockSkew time.Duration, logger *slog.Logger) error {
+	keyID := payload.KeyID
 	if address == "" {
 		return fmt.Errorf("address is empty")
 	}
@@ -141,11 +586,14 @@ func udpClient(address string, psk []byte, keyID string, timeout time.Duration,
 		return fmt.Errorf("failed to dial UDP: %w", err)
 	}
 	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
 
-	const maxRetries = 3
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		// Step 1: Encrypt keyID and send DATA packet
-		encrypted, err := auth.Encrypt(psk, []byte(keyID))
+	deadline := time.Now().Add(ackTimeout)
+	wait := timeout
+	for attempt := 1; ; attempt++ {
+		// Step 1: Encrypt the key payload and send DATA packet
+		encrypted, err := auth.Encrypt(psk, payload.Marshal())
 		if err != nil {
 			return fmt.Errorf("failed to encrypt key_id: %w", err)
 		}
@@ -160,42 +608,73 @@ func udpClient(address string, psk []byte, keyID string, timeout time.Duration,
 			return fmt.Errorf("failed to write DATA packet: %w", err)
 		}
 
-		// Step 2: Wait for ACK
-		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		// Step 2: Wait for ACK or NACK
+		readDeadline := time.Now().Add(wait)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
 			return fmt.Errorf("failed to set read deadline: %w", err)
 		}
-		ackBuf := make([]byte, 1024)
-		n, err := conn.Read(ackBuf)
-		if err != nil {
-			if attempt < maxRetries {
-				log.Printf("[DEBUG] %s ACK timeout (attempt %d/%d), retrying...", PRIMARYLOGPREFIX, attempt, maxRetries)
-				continue
-			}
-			return fmt.Errorf("no ACK after %d attempts: %w", maxRetries, err)
+		confirmation, err := awaitReply(conn, psk, keyID, maxClockSkew)
+		if ctx.Err() != nil {
+			return fmt.Errorf("key_id exchange canceled: %w", ctx.Err())
+		}
+		var opErr *net.OpError
+		if err == nil && subtle.ConstantTimeCompare(confirmation, payload.Confirmation) != 1 {
+			return errPSKMismatch
 		}
+		if !errors.As(err, &opErr) {
+			return err // ACK, NACK or authentication failure
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("no reply after %d attempts: %w", attempt, err)
+		}
+		logger.Debug("no reply, retransmitting", "attempt", attempt, logging.KeyError, err)
+		if err := sleep(ctx, time.Until(readDeadline)); err != nil {
+			return fmt.Errorf("key_id exchange canceled: %w", err)
+		}
+		wait *= 2
+	}
+}
 
-		ackRaw, err := base64.StdEncoding.DecodeString(string(ackBuf[:n]))
+// awaitReply reads replies until the one answering keyID arrives. Replies to other
+// key IDs are left over from earlier exchanges and ignored. Read errors are returned
+// as is, malformed replies with a uniform error message. An ACK returns the PSK
+// confirmation of the peer.
+func awaitReply(conn *net.UDPConn, psk []byte, keyID string, maxClockSkew time.Duration) ([]byte, error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
 		if err != nil {
-			return fmt.Errorf("authentication failed")
+			return nil, err
 		}
-		ackPkt, err := auth.UnmarshalPacket(psk, ackRaw)
+		raw, err := base64.StdEncoding.DecodeString(string(buf[:n]))
 		if err != nil {
-			return fmt.Errorf("authentication failed")
+			return nil, fmt.Errorf("authentication failed")
 		}
-		if ackPkt.Type != auth.PacketAck {
-			return fmt.Errorf("authentication failed")
+		pkt, err := auth.UnmarshalPacket(psk, raw)
+		if err != nil {
+			return nil, fmt.Errorf("authentication failed")
 		}
 
 		now := time.Now().Unix()
-		diff := now - ackPkt.Timestamp
+		diff := now - pkt.Timestamp
 		if diff < 0 {
 			diff = -diff
 		}
 		if diff > int64(maxClockSkew.Seconds()) {
-			return fmt.Errorf("authentication failed")
+			return nil, fmt.Errorf("authentication failed")
 		}
 
-		return nil // success
+		replyKeyID, confirmation, err := auth.ParseReply(psk, pkt)
+		var nack *auth.NackError
+		if err != nil && !errors.As(err, &nack) {
+			return nil, err
+		}
+		if replyKeyID != keyID {
+			continue
+		}
+		return confirmation, err
 	}
-	return fmt.Errorf("unreachable")
 }
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestUDPListener(t *testing.T) {
+	conn, err := udpListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("udpListener failed: %v", err)
+	}
+	defer conn.Close()
+	// A used or invalid address is reported instead of crashing the server
+	for _, address := range []string{conn.LocalAddr().String(), "127.0.0.1:99999"} {
+		if _, err := udpListener(address); err == nil {
+			t.Errorf("expected an error for address %s", address)
+		}
+	}
+}
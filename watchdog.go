@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/arnika-project/arnika/metrics"
+)
+
+// watchdogPoll is the interval in which an expired PSK is checked for a replacement.
+const watchdogPoll = time.Second
+
+// watchdog invalidates the tunnel once the installed PSK is older than MAX_PSK_AGE,
+// e.g. because the BACKUP does not hear from the PRIMARY anymore. Until the first PSK
+// installation the age is counted from startup, as the PSK found on the WireGuard peer
+// is at least that old.
+func (r *peerRunner) watchdog(ctx context.Context) {
+	if r.peer.MaxPSKAge == 0 {
+		return
+	}
+	started := time.Now()
+	name := r.peer.LogName()
+	metrics.PSKExpired.Set(0, name)
+	for {
+		age, keyed := r.state.pskAge()
+		if !keyed {
+			age = time.Since(started)
+		}
+		wait := r.peer.MaxPSKAge - age
+		if wait > 0 {
+			if r.state.setExpired(false) {
+				metrics.PSKExpired.Set(0, name)
+				r.log.Info("PSK replaced after exceeding MAX_PSK_AGE")
+			}
+		} else {
+			if !r.state.setExpired(true) {
+				metrics.PSKExpired.Set(1, name)
+				r.log.Error("PSK exceeded MAX_PSK_AGE, no successful rotation in time", "psk_age", age.Truncate(time.Second), "max_psk_age", r.peer.MaxPSKAge)
+				r.invalidateTunnel(ctx, r.log)
+			}
+			wait = watchdogPoll
+		}
+		if sleep(ctx, wait) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func TestWatchdog(t *testing.T) {
+	tests := []struct {
+		name          string
+		pskAge        time.Duration // age of the installed PSK, none if zero
+		maxAge        time.Duration
+		replace       bool // install a fresh PSK once the tunnel is invalidated
+		invalidations int
+		expired       bool
+	}{
+		{name: "PSK within max age", pskAge: time.Minute, maxAge: time.Hour},
+		{name: "PSK older than max age", pskAge: 2 * time.Hour, maxAge: time.Hour, invalidations: 1, expired: true},
+		{name: "no PSK past max age since startup", maxAge: 50 * time.Millisecond, invalidations: 1, expired: true},
+		{name: "fresh PSK after expiry", pskAge: 2 * time.Hour, maxAge: time.Hour, replace: true, invalidations: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			r := testRunner()
+			r.peer.MaxPSKAge = tt.maxAge
+			w := withWriter(r)
+			if tt.pskAge > 0 {
+				r.state.pskInstalled("key-0")
+				r.state.lastSuccess = time.Now().Add(-tt.pskAge)
+			}
+			ctx, cancel := context.WithCancel(t.Context())
+			var wg sync.WaitGroup
+			wg.Go(func() { r.watchdog(ctx) })
+
+			if tt.invalidations > 0 && !waitFor(time.Second, func() bool { return w.invalidations() > 0 }) {
+				t.Fatal("expected the tunnel to be invalidated")
+			}
+			if tt.replace {
+				r.state.pskInstalled("key-1")
+			}
+			// The watchdog polls again within watchdogPoll, an expired PSK is not
+			// invalidated a second time and a fresh one clears the expiry.
+			time.Sleep(watchdogPoll + 100*time.Millisecond)
+			cancel()
+			wg.Wait()
+
+			if got := w.invalidations(); got != tt.invalidations {
+				t.Fatalf("expected %d invalidations, got %d", tt.invalidations, got)
+			}
+			if expired := r.state.setExpired(false); expired != tt.expired {
+				t.Fatalf("PSK expired %t, want %t", expired, tt.expired)
+			}
+		})
+	}
+}
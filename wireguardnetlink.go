@@ -8,8 +8,8 @@ import (
 	"github.com/arnika-project/arnika/services"
 )
 
-func getKeyWriterService(cfg *config.Config) (*services.KeyWriterService, error) {
-	wireguardRepo, err := repositories.NewWireguardNetlinkRepository(cfg.WireGuardInterface, cfg.WireguardPeerPublicKey)
+func getKeyWriterService(peer *config.Peer) (*services.KeyWriterService, error) {
+	wireguardRepo, err := repositories.NewWireguardNetlinkRepository(peer.WireGuardInterface, peer.WireguardPeerPublicKey)
 	if err != nil {
 		return nil, err
 